@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/config"
+	"github.com/Ringyuki/cf-ip-guard/internal/daemon"
+)
+
+const (
+	defaultConfigPath = "/etc/cf-ip-guard/config.toml"
+	envPrefix         = "CF_IP_GUARD_"
+)
+
+// fileKeys maps config file keys to the flags they stand for, so the file,
+// the environment and the command line share one set of value parsers.
+var fileKeys = map[string]string{
+	"interval":  "interval",
+	"schedule":  "schedule",
+	"jitter":    "jitter",
+	"log_level": "log-level",
+	"once":      "once",
+
+	"firewall.backend":         "backend",
+	"firewall.nft_table":       "nft-table",
+	"firewall.delta_ratio":     "delta-ratio",
+	"firewall.persistent_save": "persistent-save",
+	"firewall.adopt_sets":      "adopt-sets",
+	"firewall.flush_conntrack": "flush-conntrack",
+	"firewall.drift_interval":  "drift-interval",
+
+	"sets.ipv4":         "ipset4",
+	"sets.ipv6":         "ipset6",
+	"sets.ipv4_options": "ipset4-options",
+	"sets.ipv6_options": "ipset6-options",
+	"sets.aggregate":    "aggregate",
+
+	"rules.manage": "manage-rules",
+	"rules.chain":  "rule-chain",
+	"rules.ports":  "rule-ports",
+
+	"cloudflare.api_url":           "api-url",
+	"cloudflare.fallback_ipv4_url": "fallback-ipv4-url",
+	"cloudflare.fallback_ipv6_url": "fallback-ipv6-url",
+	"cloudflare.jdcloud":           "jdcloud",
+	"cloudflare.jdcloud_ipv4_set":  "jdcloud-ipset4",
+	"cloudflare.jdcloud_ipv6_set":  "jdcloud-ipset6",
+
+	"sources.files":  "source",
+	"sources.static": "static-cidrs",
+
+	"guard.min_ipv4":           "guard-min-ipv4",
+	"guard.min_ipv6":           "guard-min-ipv6",
+	"guard.max_remove_percent": "guard-max-remove",
+	"guard.anchors":            "guard-anchors",
+	"guard.override":           "guard-override",
+
+	"retry.min": "retry-min",
+	"retry.max": "retry-max",
+
+	"state.dir":       "state-dir",
+	"state.bootstrap": "bootstrap",
+
+	"hooks.on_update":  "on-update",
+	"hooks.on_failure": "on-failure",
+	"hooks.timeout":    "hook-timeout",
+
+	"aws.enabled":  "aws",
+	"aws.services": "aws-services",
+	"aws.regions":  "aws-regions",
+	"aws.ipv4_set": "aws-ipset4",
+	"aws.ipv6_set": "aws-ipset6",
+
+	"github.enabled":  "github",
+	"github.keys":     "github-keys",
+	"github.ipv4_set": "github-ipset4",
+	"github.ipv6_set": "github-ipset6",
+
+	"fastly.enabled":  "fastly",
+	"fastly.ipv4_set": "fastly-ipset4",
+	"fastly.ipv6_set": "fastly-ipset6",
+
+	"google.enabled":  "google",
+	"google.url":      "google-url",
+	"google.scopes":   "google-scopes",
+	"google.ipv4_set": "google-ipset4",
+	"google.ipv6_set": "google-ipset6",
+}
+
+// envName is the variable that overrides a flag, e.g. CF_IP_GUARD_RETRY_MAX
+// for --retry-max.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// flagDefaults records what every flag holds before any layer is applied.
+func flagDefaults(flags *pflag.FlagSet) map[string][]string {
+	defaults := map[string][]string{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			defaults[f.Name] = sv.GetSlice()
+		} else {
+			defaults[f.Name] = []string{f.Value.String()}
+		}
+	})
+	return defaults
+}
+
+// configPath is the file named by --config or CF_IP_GUARD_CONFIG. Only an
+// explicitly named file has to exist.
+func configPath(flags *pflag.FlagSet) (string, bool) {
+	if flags.Changed("config") {
+		return flagConfig, true
+	}
+	if path, ok := os.LookupEnv(envName("config")); ok {
+		return path, true
+	}
+	return flagConfig, false
+}
+
+// loadConfig reads the config file, layers it and the environment under the
+// command line and builds the daemon configuration from the result.
+func loadConfig(flags *pflag.FlagSet, defaults map[string][]string) (daemon.Config, error) {
+	var file *config.File
+	if path, explicit := configPath(flags); path != "" {
+		var err error
+		file, err = config.Load(path)
+		if errors.Is(err, fs.ErrNotExist) && !explicit {
+			file, err = nil, nil
+		}
+		if err != nil {
+			return daemon.Config{}, err
+		}
+	}
+	if err := applyLayers(flags, defaults, file, os.LookupEnv); err != nil {
+		return daemon.Config{}, err
+	}
+	return buildConfig()
+}
+
+// applyLayers gives every flag that was not set on the command line its
+// CF_IP_GUARD_* variable, else its config file key, else its default.
+// Unknown keys and values that do not parse are errors.
+func applyLayers(flags *pflag.FlagSet, defaults map[string][]string, file *config.File, lookupEnv func(string) (string, bool)) error {
+	fromFile := map[string]config.Value{}
+	if file != nil {
+		for _, v := range file.Values {
+			name, ok := fileKeys[v.Key]
+			if !ok || flags.Lookup(name) == nil {
+				return fmt.Errorf("%s: line %d: unknown key %s", file.Path, v.Line, v.Key)
+			}
+			fromFile[name] = v
+		}
+	}
+
+	var errs []error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Name == "config" {
+			return
+		}
+		items, source := defaults[f.Name], "default of --"+f.Name
+		if v, ok := fromFile[f.Name]; ok {
+			if v.List && !isList(f) {
+				errs = append(errs, fmt.Errorf("%s: line %d: %s takes a single value", file.Path, v.Line, v.Key))
+				return
+			}
+			items, source = v.Items, fmt.Sprintf("%s: line %d: %s", file.Path, v.Line, v.Key)
+		}
+		if s, ok := lookupEnv(envName(f.Name)); ok {
+			items, source = envItems(f, s), envName(f.Name)
+		}
+		if err := setFlag(f, items); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func isList(f *pflag.Flag) bool {
+	_, ok := f.Value.(pflag.SliceValue)
+	return ok
+}
+
+// envItems splits a variable for a list flag on commas, except for hook
+// commands, which take the whole value as one command.
+func envItems(f *pflag.Flag, s string) []string {
+	if !isList(f) {
+		return []string{s}
+	}
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	if f.Value.Type() == "stringArray" {
+		return []string{s}
+	}
+	items := strings.Split(s, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+func setFlag(f *pflag.Flag, items []string) error {
+	if sv, ok := f.Value.(pflag.SliceValue); ok {
+		return sv.Replace(items)
+	}
+	if len(items) != 1 {
+		return fmt.Errorf("--%s takes a single value", f.Name)
+	}
+	return f.Value.Set(items[0])
+}
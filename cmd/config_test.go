@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/config"
+)
+
+func TestFileKeysCoverFlags(t *testing.T) {
+	byFlag := map[string]string{}
+	for key, name := range fileKeys {
+		if daemonCmd.Flags().Lookup(name) == nil {
+			t.Errorf("config key %s maps to unknown flag --%s", key, name)
+		}
+		if other, ok := byFlag[name]; ok {
+			t.Errorf("--%s has two config keys: %s and %s", name, key, other)
+		}
+		byFlag[name] = key
+	}
+	daemonCmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if _, ok := byFlag[f.Name]; !ok && f.Name != "config" {
+			t.Errorf("--%s has no config key", f.Name)
+		}
+	})
+}
+
+func TestApplyLayers(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	interval := flags.Duration("interval", 30*time.Minute, "")
+	jitter := flags.Duration("jitter", 2*time.Minute, "")
+	chain := flags.String("rule-chain", "CF-IP-GUARD", "")
+	ports := flags.IntSlice("rule-ports", []int{80, 443}, "")
+	anchors := flags.StringSlice("guard-anchors", nil, "")
+	onUpdate := flags.StringArray("on-update", nil, "")
+	aws := flags.Bool("aws", false, "")
+	defaults := flagDefaults(flags)
+
+	if err := flags.Parse([]string{"--jitter=1m"}); err != nil {
+		t.Fatal(err)
+	}
+	file := &config.File{Path: "config.toml", Values: []config.Value{
+		{Key: "interval", Line: 1, Items: []string{"10m"}},
+		{Key: "jitter", Line: 2, Items: []string{"5m"}},
+		{Key: "rules.ports", Line: 3, List: true, Items: []string{"8443"}},
+		{Key: "guard.anchors", Line: 4, List: true, Items: []string{"192.0.2.0/24"}},
+		{Key: "aws.enabled", Line: 5, Items: []string{"true"}},
+	}}
+	env := map[string]string{
+		"CF_IP_GUARD_RULE_CHAIN": "EDGE",
+		"CF_IP_GUARD_ON_UPDATE":  "systemctl reload nginx, haproxy",
+		"CF_IP_GUARD_AWS":        "false",
+	}
+	lookup := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+
+	if err := applyLayers(flags, defaults, file, lookup); err != nil {
+		t.Fatalf("applyLayers error: %v", err)
+	}
+	if *interval != 10*time.Minute {
+		t.Errorf("interval = %s, want 10m from the file", *interval)
+	}
+	if *jitter != time.Minute {
+		t.Errorf("jitter = %s, want 1m from the command line", *jitter)
+	}
+	if *chain != "EDGE" || *aws {
+		t.Errorf("rule-chain = %q, aws = %v, want the environment to win", *chain, *aws)
+	}
+	if !reflect.DeepEqual(*ports, []int{8443}) || !reflect.DeepEqual(*anchors, []string{"192.0.2.0/24"}) {
+		t.Errorf("rule-ports = %v, guard-anchors = %v, want the file lists", *ports, *anchors)
+	}
+	if !reflect.DeepEqual(*onUpdate, []string{"systemctl reload nginx, haproxy"}) {
+		t.Errorf("on-update = %q, want one command", *onUpdate)
+	}
+
+	// Keys removed from the file fall back to the defaults on reload.
+	env = nil
+	if err := applyLayers(flags, defaults, &config.File{Path: "config.toml"}, lookup); err != nil {
+		t.Fatalf("applyLayers error: %v", err)
+	}
+	if *interval != 30*time.Minute || *jitter != time.Minute || *chain != "CF-IP-GUARD" ||
+		!reflect.DeepEqual(*ports, []int{80, 443}) || len(*anchors) != 0 || len(*onUpdate) != 0 {
+		t.Errorf("after reload: interval %s, jitter %s, chain %q, ports %v, anchors %v, on-update %q",
+			*interval, *jitter, *chain, *ports, *anchors, *onUpdate)
+	}
+}
+
+func TestApplyLayersErrors(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Duration("interval", 30*time.Minute, "")
+	flags.IntSlice("rule-ports", nil, "")
+	defaults := flagDefaults(flags)
+	noEnv := func(string) (string, bool) { return "", false }
+
+	cases := []struct {
+		values []config.Value
+		want   string
+	}{
+		{[]config.Value{{Key: "intervall", Line: 3, Items: []string{"1m"}}}, "config.toml: line 3: unknown key intervall"},
+		{[]config.Value{{Key: "interval", Line: 1, Items: []string{"soon"}}}, "config.toml: line 1: interval: "},
+		{[]config.Value{{Key: "interval", Line: 2, List: true, Items: []string{"1m"}}}, "interval takes a single value"},
+		{[]config.Value{{Key: "rules.ports", Line: 4, List: true, Items: []string{"http"}}}, "config.toml: line 4: rules.ports: "},
+	}
+	for _, tc := range cases {
+		err := applyLayers(flags, defaults, &config.File{Path: "config.toml", Values: tc.values}, noEnv)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("applyLayers(%+v) error = %v, want %q", tc.values, err, tc.want)
+		}
+	}
+
+	env := func(k string) (string, bool) { return "soon", k == "CF_IP_GUARD_INTERVAL" }
+	if err := applyLayers(flags, defaults, nil, env); err == nil || !strings.HasPrefix(err.Error(), "CF_IP_GUARD_INTERVAL: ") {
+		t.Errorf("bad environment value error = %v", err)
+	}
+}
@@ -2,22 +2,81 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/Ringyuki/cf-ip-guard/internal/cloudflare"
 	"github.com/Ringyuki/cf-ip-guard/internal/daemon"
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/google"
 	"github.com/Ringyuki/cf-ip-guard/internal/logging"
 )
 
 var (
+	flagConfig         string
 	flagInterval       time.Duration
+	flagSchedule       string
+	flagJitter         time.Duration
+	flagBackend        string
+	flagNFTTable       string
+	flagDeltaRatio     float64
 	flagIPv4Set        string
 	flagIPv6Set        string
+	flagIPv4Options    string
+	flagIPv6Options    string
 	flagCloudflare     string
+	flagFallbackIPv4   string
+	flagFallbackIPv6   string
+	flagSources        []string
+	flagStaticCIDRs    []string
+	flagAggregate      bool
+	flagGuardMinIPv4   int
+	flagGuardMinIPv6   int
+	flagGuardMaxRemove float64
+	flagGuardAnchors   []string
+	flagGuardOverride  bool
+	flagBootstrap      bool
+	flagRetryMin       time.Duration
+	flagRetryMax       time.Duration
+	flagOnUpdate       []string
+	flagOnFailure      []string
+	flagHookTimeout    time.Duration
 	flagOnce           bool
 	flagLogLevel       string
 	flagPersistentSave bool
+	flagManageRules    bool
+	flagRuleChain      string
+	flagRulePorts      []int
+	flagConntrack      bool
+	flagDriftInterval  time.Duration
+	flagStateDir       string
+	flagAdoptSets      bool
+	flagJDCloud        bool
+	flagJDCloudIPv4Set string
+	flagJDCloudIPv6Set string
+	flagAWS            bool
+	flagAWSServices    []string
+	flagAWSRegions     []string
+	flagAWSIPv4Set     string
+	flagAWSIPv6Set     string
+	flagGitHub         bool
+	flagGitHubKeys     []string
+	flagGitHubIPv4Set  string
+	flagGitHubIPv6Set  string
+	flagFastly         bool
+	flagFastlyIPv4Set  string
+	flagFastlyIPv6Set  string
+	flagGoogle         bool
+	flagGoogleURL      string
+	flagGoogleScopes   []string
+	flagGoogleIPv4Set  string
+	flagGoogleIPv6Set  string
 )
 
 var daemonCmd = &cobra.Command{
@@ -25,43 +84,304 @@ var daemonCmd = &cobra.Command{
 	Short: "Run cf-ip-guard in daemon mode",
 	Long:  "Scrape Cloudflare IP ranges from /ips api and update ipset",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx := context.Background()
+		// The daemon finishes an apply in progress before it returns.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
 
+		defaults := flagDefaults(cmd.Flags())
+		load := func() (daemon.Config, error) { return loadConfig(cmd.Flags(), defaults) }
+		cfg, err := load()
+		if err != nil {
+			return err
+		}
 		logger, err := logging.Init(flagLogLevel, "", "")
 		if err != nil {
 			return err
 		}
+		cfg.Logger = logger
+		path, _ := configPath(cmd.Flags())
+		cfg.Reload, cfg.Resync = watchReloads(ctx, logger, load, path)
 
-		cfg := daemon.Config{
-			Interval:       flagInterval,
-			IPv4SetName:    flagIPv4Set,
-			IPv6SetName:    flagIPv6Set,
-			CloudflareAPI:  flagCloudflare,
-			Once:           flagOnce,
-			PersistentSave: flagPersistentSave,
-			Logger:         logger,
+		err = daemon.Run(ctx, cfg)
+		if errors.Is(err, context.Canceled) {
+			logger.Infow("shutdown complete")
+			return nil
 		}
-
-		return daemon.Run(ctx, cfg)
+		return err
 	},
 }
 
+// buildConfig turns the flags, once layered, into a daemon configuration.
+func buildConfig() (daemon.Config, error) {
+	ipv4Opts, err := firewall.ParseSetOptions(flagIPv4Options)
+	if err != nil {
+		return daemon.Config{}, fmt.Errorf("--ipset4-options: %w", err)
+	}
+	ipv6Opts, err := firewall.ParseSetOptions(flagIPv6Options)
+	if err != nil {
+		return daemon.Config{}, fmt.Errorf("--ipset6-options: %w", err)
+	}
+
+	cfg := daemon.Config{
+		Interval:        flagInterval,
+		Schedule:        flagSchedule,
+		Jitter:          flagJitter,
+		Backend:         flagBackend,
+		NFTTable:        flagNFTTable,
+		DeltaRatio:      flagDeltaRatio,
+		IPv4SetName:     flagIPv4Set,
+		IPv6SetName:     flagIPv6Set,
+		IPv4Options:     ipv4Opts,
+		IPv6Options:     ipv6Opts,
+		CloudflareAPI:   flagCloudflare,
+		FallbackIPv4URL: flagFallbackIPv4,
+		FallbackIPv6URL: flagFallbackIPv6,
+		Sources:         flagSources,
+		StaticCIDRs:     flagStaticCIDRs,
+		Aggregate:       flagAggregate,
+		Guard: daemon.GuardConfig{
+			MinIPv4:          flagGuardMinIPv4,
+			MinIPv6:          flagGuardMinIPv6,
+			MaxRemovePercent: flagGuardMaxRemove,
+			Anchors:          flagGuardAnchors,
+			Override:         flagGuardOverride,
+		},
+		Once:               flagOnce,
+		PersistentSave:     flagPersistentSave,
+		ManageRules:        flagManageRules,
+		RuleChain:          flagRuleChain,
+		RulePorts:          flagRulePorts,
+		FlushConntrack:     flagConntrack,
+		DriftInterval:      flagDriftInterval,
+		StateDir:           flagStateDir,
+		AdoptSets:          flagAdoptSets,
+		Bootstrap:          flagBootstrap,
+		RetryMin:           flagRetryMin,
+		RetryMax:           flagRetryMax,
+		JDCloud:            flagJDCloud,
+		JDCloudIPv4SetName: flagJDCloudIPv4Set,
+		JDCloudIPv6SetName: flagJDCloudIPv6Set,
+		AWS: daemon.AWSConfig{
+			Enabled:     flagAWS,
+			Services:    flagAWSServices,
+			Regions:     flagAWSRegions,
+			IPv4SetName: flagAWSIPv4Set,
+			IPv6SetName: flagAWSIPv6Set,
+		},
+		GitHub: daemon.GitHubConfig{
+			Enabled:     flagGitHub,
+			Keys:        flagGitHubKeys,
+			IPv4SetName: flagGitHubIPv4Set,
+			IPv6SetName: flagGitHubIPv6Set,
+		},
+		Fastly: daemon.FastlyConfig{
+			Enabled:     flagFastly,
+			IPv4SetName: flagFastlyIPv4Set,
+			IPv6SetName: flagFastlyIPv6Set,
+		},
+		Google: daemon.GoogleConfig{
+			Enabled:     flagGoogle,
+			URL:         flagGoogleURL,
+			Scopes:      flagGoogleScopes,
+			IPv4SetName: flagGoogleIPv4Set,
+			IPv6SetName: flagGoogleIPv6Set,
+		},
+		Hooks: daemon.HookConfig{
+			OnUpdate:  flagOnUpdate,
+			OnFailure: flagOnFailure,
+			Timeout:   flagHookTimeout,
+		},
+	}
+
+	return cfg, nil
+}
+
+// watchReloads turns SIGHUP and changes to the config file at path into a
+// reload of the configuration, and SIGUSR1 into a forced resync.
+func watchReloads(ctx context.Context, logger logging.Logger, load func() (daemon.Config, error), path string) (<-chan daemon.Config, <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1)
+	reload := make(chan daemon.Config)
+	resync := make(chan struct{}, 1)
+	last := statConfig(path)
+	go func() {
+		defer signal.Stop(sigs)
+		var poll <-chan time.Time
+		if path != "" {
+			ticker := time.NewTicker(configPollInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-poll:
+				st := statConfig(path)
+				if st == last {
+					continue
+				}
+				last = st
+				logger.Infow("config file changed", "path", path)
+			case sig := <-sigs:
+				if sig == syscall.SIGUSR1 {
+					select {
+					case resync <- struct{}{}:
+					default:
+					}
+					continue
+				}
+			}
+			cfg, err := load()
+			if err != nil {
+				logger.Errorw("reload failed, keeping the current configuration", "err", err)
+				continue
+			}
+			select {
+			case reload <- cfg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return reload, resync
+}
+
+// configPollInterval is how often the config file is checked for changes.
+var configPollInterval = 2 * time.Second
+
+type configStat struct {
+	exists  bool
+	size    int64
+	modTime int64
+}
+
+func statConfig(path string) configStat {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return configStat{}
+	}
+	return configStat{exists: true, size: fi.Size(), modTime: fi.ModTime().UnixNano()}
+}
+
 func init() {
 	rootCmd.AddCommand(daemonCmd)
 
+	daemonCmd.Flags().StringVarP(&flagConfig, "config", "c", defaultConfigPath,
+		"TOML config file, watched for changes; flags and CF_IP_GUARD_* variables override it (empty disables)")
 	daemonCmd.Flags().DurationVarP(&flagInterval, "interval", "i", 30*time.Minute,
-		"update interval, e.g. 10m, 1h")
+		"update interval, e.g. 10m, 1h; longer when the upstream caching headers say the lists stay fresh")
+	daemonCmd.Flags().StringVar(&flagSchedule, "schedule", "",
+		`cron-style schedule used instead of --interval, e.g. "*/30 * * * *" (minute hour day month weekday, local time)`)
+	daemonCmd.Flags().DurationVar(&flagJitter, "jitter", 2*time.Minute,
+		"random delay of up to this much added to every planned fetch, to spread load across hosts")
+	daemonCmd.Flags().StringVar(&flagBackend, "backend", "ipset",
+		"firewall backend: ipset, netlink, nft")
+	daemonCmd.Flags().StringVar(&flagNFTTable, "nft-table", "cf_ip_guard",
+		"nftables inet table holding the sets (nft backend only)")
+	daemonCmd.Flags().Float64Var(&flagDeltaRatio, "delta-ratio", 0.25,
+		"largest change, as a fraction of the list size, applied in place with add/del instead of a rebuild and swap")
 	daemonCmd.Flags().StringVar(&flagIPv4Set, "ipset4", "cloudflare4",
 		"ipset name for Cloudflare IPv4 ranges")
 	daemonCmd.Flags().StringVar(&flagIPv6Set, "ipset6", "cloudflare6",
 		"ipset name for Cloudflare IPv6 ranges")
+	daemonCmd.Flags().StringVar(&flagIPv4Options, "ipset4-options", "",
+		"ipset creation options for the IPv4 set, e.g. hashsize=4096,maxelem=131072,timeout=3600,counters,comment")
+	daemonCmd.Flags().StringVar(&flagIPv6Options, "ipset6-options", "",
+		"ipset creation options for the IPv6 set (see --ipset4-options)")
 	daemonCmd.Flags().StringVar(&flagCloudflare, "api-url",
 		"https://api.cloudflare.com/client/v4/ips",
-		"Cloudflare IP ranges API URL")
+		"Cloudflare IP ranges API URL, or a file:// URL of a local list")
+	daemonCmd.Flags().StringSliceVar(&flagSources, "source", nil,
+		"file:// URL of an extra list merged into the main sets: one CIDR per line with # comments, or Cloudflare JSON (repeatable)")
+	daemonCmd.Flags().StringSliceVar(&flagStaticCIDRs, "static-cidrs", nil,
+		"extra CIDRs always kept in the main sets, e.g. 192.0.2.0/24,2001:db8::/32")
+	daemonCmd.Flags().BoolVar(&flagAggregate, "aggregate", false,
+		"merge adjacent and overlapping prefixes into the fewest covering CIDRs before applying")
+	daemonCmd.Flags().IntVar(&flagGuardMinIPv4, "guard-min-ipv4", 1,
+		"refuse updates that leave fewer IPv4 entries in the main sets (0 disables)")
+	daemonCmd.Flags().IntVar(&flagGuardMinIPv6, "guard-min-ipv6", 1,
+		"refuse updates that leave fewer IPv6 entries in the main sets (0 disables)")
+	daemonCmd.Flags().Float64Var(&flagGuardMaxRemove, "guard-max-remove", 50,
+		"refuse updates that remove more than this percentage of a set's entries (0 disables)")
+	daemonCmd.Flags().StringSliceVar(&flagGuardAnchors, "guard-anchors", nil,
+		"prefixes the main sets must keep covering, e.g. 173.245.48.0/20,2400:cb00::/32")
+	daemonCmd.Flags().BoolVar(&flagGuardOverride, "guard-override", false,
+		"apply updates even when a guard refuses them")
+	daemonCmd.Flags().StringVar(&flagFallbackIPv4, "fallback-ipv4-url", cloudflare.DefaultIPv4TextURL,
+		"plain-text IPv4 list used when the API fails (empty disables the fallback)")
+	daemonCmd.Flags().StringVar(&flagFallbackIPv6, "fallback-ipv6-url", cloudflare.DefaultIPv6TextURL,
+		"plain-text IPv6 list used when the API fails (empty disables the fallback)")
 	daemonCmd.Flags().BoolVar(&flagOnce, "once", false,
 		"run only one fetch-and-update cycle and exit")
 	daemonCmd.Flags().StringVar(&flagLogLevel, "log-level", "info",
 		"log level: debug, info, warn, error")
 	daemonCmd.Flags().BoolVar(&flagPersistentSave, "persistent-save", true,
 		"save iptables/ipset state after updates (netfilter-persistent save)")
+	daemonCmd.Flags().BoolVar(&flagManageRules, "manage-rules", false,
+		"own an iptables/ip6tables chain that only admits the managed sets on --rule-ports")
+	daemonCmd.Flags().StringVar(&flagRuleChain, "rule-chain", "CF-IP-GUARD",
+		"chain name used by --manage-rules")
+	daemonCmd.Flags().IntSliceVar(&flagRulePorts, "rule-ports", []int{80, 443},
+		"protected TCP ports, used by --manage-rules and --flush-conntrack")
+	daemonCmd.Flags().BoolVar(&flagConntrack, "flush-conntrack", false,
+		"delete tracked connections from removed ranges to --rule-ports after an update (needs conntrack)")
+	daemonCmd.Flags().DurationVar(&flagDriftInterval, "drift-interval", 5*time.Minute,
+		"how often to read the sets back and re-apply the last list if they drifted (0 disables)")
+	daemonCmd.Flags().StringVar(&flagStateDir, "state-dir", "/var/lib/cf-ip-guard",
+		"directory for daemon state: provider versions, applied ranges, counters and the record of sets it created (empty disables state and ownership checks)")
+	daemonCmd.Flags().DurationVar(&flagRetryMin, "retry-min", 15*time.Second,
+		"first delay before a failed update is retried, doubled per attempt (0 waits for the next interval)")
+	daemonCmd.Flags().DurationVar(&flagRetryMax, "retry-max", 5*time.Minute,
+		"longest backoff between retries; a longer Retry-After from upstream is still honoured")
+	daemonCmd.Flags().StringArrayVar(&flagOnUpdate, "on-update", nil,
+		"shell command run after an update changed the sets, with the outcome in CF_IP_GUARD_* variables (repeatable)")
+	daemonCmd.Flags().StringArrayVar(&flagOnFailure, "on-failure", nil,
+		"shell command run after a failed update, with the error in CF_IP_GUARD_ERROR (repeatable)")
+	daemonCmd.Flags().DurationVar(&flagHookTimeout, "hook-timeout", 30*time.Second,
+		"how long a hook command may run before it is killed")
+	daemonCmd.Flags().BoolVar(&flagBootstrap, "bootstrap", true,
+		"fill the main sets from the newest saved or built-in snapshot when the first update fails")
+	daemonCmd.Flags().BoolVar(&flagAdoptSets, "adopt-sets", false,
+		"take over existing sets with the configured names even if cf-ip-guard did not create them")
+	daemonCmd.Flags().BoolVar(&flagJDCloud, "jdcloud", false,
+		"also fetch the Cloudflare China Network (JD Cloud) ranges")
+	daemonCmd.Flags().StringVar(&flagJDCloudIPv4Set, "jdcloud-ipset4", "",
+		"separate ipset for JD Cloud IPv4 ranges (default: add them to --ipset4)")
+	daemonCmd.Flags().StringVar(&flagJDCloudIPv6Set, "jdcloud-ipset6", "",
+		"separate ipset for JD Cloud IPv6 ranges (default: add them to --ipset6)")
+	daemonCmd.Flags().BoolVar(&flagAWS, "aws", false,
+		"also sync AWS ranges from ip-ranges.json")
+	daemonCmd.Flags().StringSliceVar(&flagAWSServices, "aws-services", []string{"CLOUDFRONT_ORIGIN_FACING"},
+		"AWS services to include (empty for all)")
+	daemonCmd.Flags().StringSliceVar(&flagAWSRegions, "aws-regions", nil,
+		"AWS regions to include, e.g. GLOBAL,us-east-1 (default all)")
+	daemonCmd.Flags().StringVar(&flagAWSIPv4Set, "aws-ipset4", "aws4",
+		"ipset for AWS IPv4 ranges (use the --ipset4 name to merge them)")
+	daemonCmd.Flags().StringVar(&flagAWSIPv6Set, "aws-ipset6", "aws6",
+		"ipset for AWS IPv6 ranges (use the --ipset6 name to merge them)")
+	daemonCmd.Flags().BoolVar(&flagGitHub, "github", false,
+		"also sync GitHub ranges from the /meta API")
+	daemonCmd.Flags().StringSliceVar(&flagGitHubKeys, "github-keys", []string{"hooks"},
+		"GitHub /meta keys to include, e.g. hooks,actions,api")
+	daemonCmd.Flags().StringVar(&flagGitHubIPv4Set, "github-ipset4", "github4",
+		"ipset for GitHub IPv4 ranges (use the --ipset4 name to merge them)")
+	daemonCmd.Flags().StringVar(&flagGitHubIPv6Set, "github-ipset6", "github6",
+		"ipset for GitHub IPv6 ranges (use the --ipset6 name to merge them)")
+	daemonCmd.Flags().BoolVar(&flagFastly, "fastly", false,
+		"also sync Fastly ranges from the public-ip-list API")
+	daemonCmd.Flags().StringVar(&flagFastlyIPv4Set, "fastly-ipset4", "fastly4",
+		"ipset for Fastly IPv4 ranges (use the --ipset4 name to merge them)")
+	daemonCmd.Flags().StringVar(&flagFastlyIPv6Set, "fastly-ipset6", "fastly6",
+		"ipset for Fastly IPv6 ranges (use the --ipset6 name to merge them)")
+	daemonCmd.Flags().BoolVar(&flagGoogle, "google", false,
+		"also sync Google ranges")
+	daemonCmd.Flags().StringVar(&flagGoogleURL, "google-url", google.CloudURL,
+		"Google prefix list: cloud.json for Google Cloud, goog.json for all Google ranges")
+	daemonCmd.Flags().StringSliceVar(&flagGoogleScopes, "google-scopes", nil,
+		"Google Cloud scopes to include, e.g. us-central1,global (default all)")
+	daemonCmd.Flags().StringVar(&flagGoogleIPv4Set, "google-ipset4", "google4",
+		"ipset for Google IPv4 ranges (use the --ipset4 name to merge them)")
+	daemonCmd.Flags().StringVar(&flagGoogleIPv6Set, "google-ipset6", "google6",
+		"ipset for Google IPv6 ranges (use the --ipset6 name to merge them)")
 }
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/daemon"
+	"github.com/Ringyuki/cf-ip-guard/internal/logging"
+)
+
+func TestWatchReloadsConfigFile(t *testing.T) {
+	orig := configPollInterval
+	configPollInterval = 10 * time.Millisecond
+	defer func() { configPollInterval = orig }()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(`interval = "10m"`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loads := make(chan string, 2)
+	load := func() (daemon.Config, error) {
+		data, _ := os.ReadFile(path)
+		loads <- string(data)
+		if string(data) == "broken" {
+			return daemon.Config{}, errors.New("broken")
+		}
+		return daemon.Config{Schedule: string(data)}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload, _ := watchReloads(ctx, logging.L(), load, path)
+
+	// A file that fails to load is reported and nothing is reloaded.
+	if err := os.WriteFile(path, []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-loads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config change not noticed")
+	}
+
+	if err := os.WriteFile(path, []byte(`interval = "20m"`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cfg := <-reload:
+		if cfg.Schedule != `interval = "20m"` {
+			t.Errorf("reloaded %q, want the edited file", cfg.Schedule)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("edited config not reloaded")
+	}
+}
@@ -17,10 +17,15 @@ sudo install -m 0755 "${OUT_BIN}" "/usr/local/bin/${BIN_NAME}"
 echo "[install] sudo install -m 0644 deploy/${BIN_NAME}.service /etc/systemd/system/${BIN_NAME}.service"
 sudo install -m 0644 "${REPO_ROOT}/deploy/${BIN_NAME}.service" "/etc/systemd/system/${BIN_NAME}.service"
 
+if [[ ! -f /etc/cf-ip-guard/config.toml ]]; then
+  echo "[init] create /etc/cf-ip-guard/config.toml (watched, edits apply without a restart)"
+  sudo install -D -m 0644 "${REPO_ROOT}/deploy/config.toml" /etc/cf-ip-guard/config.toml
+fi
+
 if [[ ! -f /etc/cf-ip-guard.env ]]; then
   echo "[init] create /etc/cf-ip-guard.env (editable flags)"
   sudo tee /etc/cf-ip-guard.env >/dev/null <<'EOF'
-# Additional CLI flags for cf-ip-guard daemon.
+# Additional CLI flags for cf-ip-guard daemon; they override /etc/cf-ip-guard/config.toml.
 # Example: CF_IP_GUARD_OPTS="--ipset4 cloudflare4 --ipset6 cloudflare6 --interval 30m --log-level info"
 CF_IP_GUARD_OPTS=""
 EOF
@@ -35,6 +40,6 @@ sudo systemctl enable cf-ip-guard
 echo "[systemd] start/restart cf-ip-guard now"
 sudo systemctl restart cf-ip-guard
 
-echo "done. adjust /etc/cf-ip-guard.env and restart with: sudo systemctl restart cf-ip-guard"
+echo "done. adjust /etc/cf-ip-guard/config.toml; changes apply without a restart"
 
 
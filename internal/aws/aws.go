@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+const DefaultURL = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+
+// Client reads AWS's ip-ranges.json, keeping the prefixes of the given
+// services and regions. Empty filters keep everything.
+type Client struct {
+	HTTPClient *http.Client
+	URL        string
+	// Services are matched against "service", e.g. CLOUDFRONT_ORIGIN_FACING.
+	Services []string
+	// Regions are matched against "region", e.g. us-east-1 or GLOBAL.
+	Regions []string
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+type ipRanges struct {
+	SyncToken string `json:"syncToken"`
+	Prefixes  []struct {
+		IPPrefix string `json:"ip_prefix"`
+		Region   string `json:"region"`
+		Service  string `json:"service"`
+	} `json:"prefixes"`
+	IPv6Prefixes []struct {
+		IPv6Prefix string `json:"ipv6_prefix"`
+		Region     string `json:"region"`
+		Service    string `json:"service"`
+	} `json:"ipv6_prefixes"`
+}
+
+func (c *Client) Name() string {
+	return "aws"
+}
+
+// Fetch downloads the document and reports it as unchanged when its
+// syncToken matches prevVersion.
+func (c *Client) Fetch(ctx context.Context, prevVersion string) (*provider.Result, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{}
+	}
+	if c.URL == "" {
+		c.URL = DefaultURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	fresh := provider.FreshUntil(resp.Header, time.Now())
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, provider.NewStatusError(resp)
+	}
+
+	var doc ipRanges
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	if doc.SyncToken == "" {
+		return nil, fmt.Errorf("ip-ranges.json without syncToken")
+	}
+
+	version := c.version(doc.SyncToken)
+	if version == prevVersion {
+		return &provider.Result{Version: version, FreshUntil: fresh, NotModified: true}, nil
+	}
+
+	// A prefix is listed once per service, e.g. as AMAZON and EC2.
+	seen := map[string]bool{}
+	keep := func(cidr, region, service string) bool {
+		if seen[cidr] || !matches(c.Services, service) || !matches(c.Regions, region) {
+			return false
+		}
+		seen[cidr] = true
+		return true
+	}
+	res := &provider.Result{Version: version, FreshUntil: fresh}
+	for _, p := range doc.Prefixes {
+		if keep(p.IPPrefix, p.Region, p.Service) {
+			res.AddIPv4(p.IPPrefix)
+		}
+	}
+	for _, p := range doc.IPv6Prefixes {
+		if keep(p.IPv6Prefix, p.Region, p.Service) {
+			res.AddIPv6(p.IPv6Prefix)
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("no prefixes match services %v and regions %v", c.Services, c.Regions)
+	}
+	return res, nil
+}
+
+// version ties the syncToken to the filters, so changing them is not
+// mistaken for an unchanged list.
+func (c *Client) version(syncToken string) string {
+	if len(c.Services) == 0 && len(c.Regions) == 0 {
+		return syncToken
+	}
+	return syncToken + ";" + strings.Join(c.Services, ",") + ";" + strings.Join(c.Regions, ",")
+}
+
+func matches(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if strings.EqualFold(f, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testRanges = `{
+	"syncToken": "1700000000",
+	"createDate": "2026-10-17-00-00-00",
+	"prefixes": [
+		{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON"},
+		{"ip_prefix": "13.32.0.0/15", "region": "GLOBAL", "service": "AMAZON"},
+		{"ip_prefix": "13.32.0.0/15", "region": "GLOBAL", "service": "CLOUDFRONT"},
+		{"ip_prefix": "130.176.0.0/18", "region": "GLOBAL", "service": "CLOUDFRONT_ORIGIN_FACING"},
+		{"ip_prefix": "15.158.0.0/16", "region": "us-east-1", "service": "CLOUDFRONT_ORIGIN_FACING"}
+	],
+	"ipv6_prefixes": [
+		{"ipv6_prefix": "2600:9000:1000::/36", "region": "GLOBAL", "service": "CLOUDFRONT"},
+		{"ipv6_prefix": "2600:9000:2000::/36", "region": "GLOBAL", "service": "CLOUDFRONT_ORIGIN_FACING"}
+	]
+}`
+
+func newServer(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testRanges))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestFetchFiltersServiceAndRegion(t *testing.T) {
+	ts := newServer(t)
+
+	c := &Client{URL: ts.URL, Services: []string{"cloudfront_origin_facing"}}
+	res, err := c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 2 || len(res.IPv6) != 1 || res.IPv6[0].String() != "2600:9000:2000::/36" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	c.Regions = []string{"GLOBAL"}
+	res, err = c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 1 || res.IPv4[0].String() != "130.176.0.0/18" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestFetchDedupesAndSkipsUnchanged(t *testing.T) {
+	ts := newServer(t)
+
+	c := &Client{URL: ts.URL}
+	res, err := c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 4 || len(res.IPv6) != 2 || res.Version != "1700000000" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	again, err := c.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if !again.NotModified {
+		t.Fatalf("same syncToken should be not modified")
+	}
+
+	// A different filter is a different list, even with the same token.
+	c.Services = []string{"CLOUDFRONT"}
+	changed, err := c.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if changed.NotModified {
+		t.Fatalf("filter change should not be reported as not modified")
+	}
+}
+
+func TestFetchNoMatch(t *testing.T) {
+	ts := newServer(t)
+
+	c := &Client{URL: ts.URL, Regions: []string{"eu-west-1"}}
+	if _, err := c.Fetch(context.Background(), ""); err == nil {
+		t.Fatalf("expected error when nothing matches")
+	}
+}
@@ -2,26 +2,128 @@ package cloudflare
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
 )
 
+// NetworkJDCloud selects the Cloudflare China Network ranges operated by
+// JD Cloud.
+const NetworkJDCloud = "jdcloud"
+
 type Client struct {
 	HTTPClient *http.Client
 	APIURL     string
+	// Networks are extra networks requested with ?networks=.
+	Networks []string
+	// NetworksOnly makes Fetch return only the ranges of Networks, for a
+	// separate set pair.
+	NetworksOnly bool
+	// IPv4TextURL and IPv6TextURL are plain-text lists tried when the API
+	// fails. Leaving either empty disables the fallback, as do Networks,
+	// whose ranges the lists do not carry.
+	IPv4TextURL string
+	IPv6TextURL string
+
+	textDocs map[string]*textDoc
+}
+
+const (
+	SourceAPI  = "api"
+	SourceText = "text"
+)
+
+// IPs is one response of the /ips endpoint.
+type IPs struct {
+	IPv4 []string
+	IPv6 []string
+	// JDCloudIPv4 and JDCloudIPv6 are only filled when NetworkJDCloud was
+	// requested.
+	JDCloudIPv4 []string
+	JDCloudIPv6 []string
+	// ETag identifies the whole response. With extra networks it also
+	// covers their ranges, which the API etag does not.
+	ETag        string
+	NotModified bool
+	// Source is SourceAPI or SourceText.
+	Source string
+	// FreshUntil is when the caching headers allow the ranges to change.
+	FreshUntil time.Time
 }
 
 type ipResponse struct {
 	Success bool `json:"success"`
 	Result  struct {
-		IPv4Cidrs []string `json:"ipv4_cidrs"`
-		IPv6Cidrs []string `json:"ipv6_cidrs"`
-		Etag      string   `json:"etag"`
+		IPv4Cidrs    []string `json:"ipv4_cidrs"`
+		IPv6Cidrs    []string `json:"ipv6_cidrs"`
+		JDCloudCidrs []string `json:"jdcloud_cidrs"`
+		Etag         string   `json:"etag"`
 	} `json:"result"`
 }
 
 func (c *Client) FetchIPs(ctx context.Context, prevETag string) (ipv4, ipv6 []string, etag string, notModified bool, err error) {
+	ips, err := c.FetchRanges(ctx, prevETag)
+	if err != nil {
+		return nil, nil, "", false, err
+	}
+	return ips.IPv4, ips.IPv6, ips.ETag, ips.NotModified, nil
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+func (c *Client) Name() string {
+	if c.NetworksOnly {
+		return "cloudflare-" + strings.Join(c.Networks, "-")
+	}
+	return "cloudflare"
+}
+
+// Fetch implements provider.Provider.
+func (c *Client) Fetch(ctx context.Context, prevVersion string) (*provider.Result, error) {
+	ips, err := c.FetchRanges(ctx, prevVersion)
+	if err != nil {
+		return nil, err
+	}
+	res := &provider.Result{Version: ips.ETag, NotModified: ips.NotModified, Source: ips.Source, FreshUntil: ips.FreshUntil}
+	if ips.NotModified {
+		return res, nil
+	}
+	res.Add(ips.JDCloudIPv4...)
+	res.Add(ips.JDCloudIPv6...)
+	if !c.NetworksOnly {
+		res.AddIPv4(ips.IPv4...)
+		res.AddIPv6(ips.IPv6...)
+	}
+	return res, nil
+}
+
+// FetchRanges downloads the ranges unless they are unchanged since
+// prevETag, falling back to the plain-text lists when the API fails.
+func (c *Client) FetchRanges(ctx context.Context, prevETag string) (*IPs, error) {
+	ips, err := c.fetchAPI(ctx, prevETag)
+	if err == nil || !c.textFallback() || ctx.Err() != nil {
+		return ips, err
+	}
+	ips, textErr := c.fetchText(ctx, prevETag)
+	if textErr != nil {
+		return nil, fmt.Errorf("%w; text fallback: %v", err, textErr)
+	}
+	return ips, nil
+}
+
+func (c *Client) textFallback() bool {
+	return c.IPv4TextURL != "" && c.IPv6TextURL != "" && len(c.Networks) == 0
+}
+
+func (c *Client) fetchAPI(ctx context.Context, prevETag string) (*IPs, error) {
 	if c.HTTPClient == nil {
 		c.HTTPClient = &http.Client{}
 	}
@@ -29,36 +131,86 @@ func (c *Client) FetchIPs(ctx context.Context, prevETag string) (ipv4, ipv6 []st
 		c.APIURL = "https://api.cloudflare.com/client/v4/ips"
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.APIURL, nil)
+	u, err := c.requestURL()
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
-		return nil, nil, "", false, fmt.Errorf("build request: %w", err)
+		return nil, fmt.Errorf("build request: %w", err)
 	}
-	if prevETag != "" {
+	// The API etag does not cover extra networks, so a 304 against it
+	// could hide a change in their ranges.
+	if prevETag != "" && len(c.Networks) == 0 {
 		req.Header.Set("If-None-Match", prevETag)
 	}
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return nil, nil, "", false, fmt.Errorf("do request: %w", err)
+		return nil, fmt.Errorf("do request: %w", err)
 	}
 	defer resp.Body.Close()
+	fresh := provider.FreshUntil(resp.Header, time.Now())
 
 	if resp.StatusCode == http.StatusNotModified {
-		return nil, nil, prevETag, true, nil
+		return &IPs{ETag: prevETag, NotModified: true, Source: SourceAPI, FreshUntil: fresh}, nil
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, nil, "", false, fmt.Errorf("unexpected status: %s", resp.Status)
+		return nil, provider.NewStatusError(resp)
 	}
 
 	var ipResp ipResponse
 	if err := json.NewDecoder(resp.Body).Decode(&ipResp); err != nil {
-		return nil, nil, "", false, fmt.Errorf("decode json: %w", err)
+		return nil, fmt.Errorf("decode json: %w", err)
 	}
 
 	if !ipResp.Success {
-		return nil, nil, "", false, fmt.Errorf("cloudflare api returned success=false")
+		return nil, fmt.Errorf("cloudflare api returned success=false")
 	}
 
-	return ipResp.Result.IPv4Cidrs, ipResp.Result.IPv6Cidrs, ipResp.Result.Etag, false, nil
+	ips := &IPs{
+		IPv4:       ipResp.Result.IPv4Cidrs,
+		IPv6:       ipResp.Result.IPv6Cidrs,
+		ETag:       ipResp.Result.Etag,
+		Source:     SourceAPI,
+		FreshUntil: fresh,
+	}
+	if len(c.Networks) > 0 {
+		for _, cidr := range ipResp.Result.JDCloudCidrs {
+			if strings.Contains(cidr, ":") {
+				ips.JDCloudIPv6 = append(ips.JDCloudIPv6, cidr)
+			} else {
+				ips.JDCloudIPv4 = append(ips.JDCloudIPv4, cidr)
+			}
+		}
+		ips.ETag = networksETag(ips.ETag, c.Networks, ipResp.Result.JDCloudCidrs)
+		if ips.ETag == prevETag {
+			return &IPs{ETag: prevETag, NotModified: true, Source: SourceAPI, FreshUntil: fresh}, nil
+		}
+	}
+	return ips, nil
+}
+
+func (c *Client) requestURL() (string, error) {
+	if len(c.Networks) == 0 {
+		return c.APIURL, nil
+	}
+	u, err := url.Parse(c.APIURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("networks", strings.Join(c.Networks, ","))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// networksETag qualifies the API etag with the requested networks and a
+// hash of their ranges.
+func networksETag(etag string, networks, cidrs []string) string {
+	sorted := append([]string(nil), cidrs...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return etag + "+" + strings.Join(networks, ",") + ":" + hex.EncodeToString(sum[:8])
 }
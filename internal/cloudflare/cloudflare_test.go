@@ -4,7 +4,11 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
 )
 
 func TestFetchIPsSuccess(t *testing.T) {
@@ -77,3 +81,101 @@ func TestFetchIPsNon200(t *testing.T) {
 		t.Fatalf("expected error on non-200")
 	}
 }
+
+func TestFetchIPsRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "90")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	c := &Client{APIURL: ts.URL}
+	_, err := c.Fetch(context.Background(), "")
+	if got := provider.RetryAfter(err); got != 90*time.Second {
+		t.Fatalf("RetryAfter = %s, want 90s (err %v)", got, err)
+	}
+}
+
+func TestFetchJDCloud(t *testing.T) {
+	jd := `["1.2.3.0/24", "2400:cb00::/32"]`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("networks"); got != "jdcloud" {
+			t.Fatalf("expected networks=jdcloud, got %q", got)
+		}
+		if got := r.Header.Get("If-None-Match"); got != "" {
+			t.Fatalf("If-None-Match should not be sent with extra networks, got %q", got)
+		}
+		_, _ = w.Write([]byte(`{
+			"success": true,
+			"result": {
+				"ipv4_cidrs": ["1.1.1.0/24"],
+				"ipv6_cidrs": ["2606:4700::/32"],
+				"jdcloud_cidrs": ` + jd + `,
+				"etag": "etag-123"
+			}
+		}`))
+	}))
+	defer ts.Close()
+
+	c := &Client{APIURL: ts.URL, Networks: []string{NetworkJDCloud}}
+	ips, err := c.FetchRanges(context.Background(), "")
+	if err != nil {
+		t.Fatalf("FetchRanges error: %v", err)
+	}
+	if len(ips.JDCloudIPv4) != 1 || ips.JDCloudIPv4[0] != "1.2.3.0/24" {
+		t.Fatalf("unexpected jdcloud ipv4: %v", ips.JDCloudIPv4)
+	}
+	if len(ips.JDCloudIPv6) != 1 || ips.JDCloudIPv6[0] != "2400:cb00::/32" {
+		t.Fatalf("unexpected jdcloud ipv6: %v", ips.JDCloudIPv6)
+	}
+	if ips.ETag == "etag-123" || !strings.HasPrefix(ips.ETag, "etag-123+jdcloud:") {
+		t.Fatalf("etag should cover jdcloud ranges: %s", ips.ETag)
+	}
+
+	again, err := c.FetchRanges(context.Background(), ips.ETag)
+	if err != nil {
+		t.Fatalf("FetchRanges error: %v", err)
+	}
+	if !again.NotModified {
+		t.Fatalf("unchanged response should be reported as not modified")
+	}
+
+	// A JD Cloud change under the same API etag is still a change.
+	jd = `["1.2.4.0/24"]`
+	changed, err := c.FetchRanges(context.Background(), ips.ETag)
+	if err != nil {
+		t.Fatalf("FetchRanges error: %v", err)
+	}
+	if changed.NotModified || changed.ETag == ips.ETag {
+		t.Fatalf("jdcloud change not detected: %+v", changed)
+	}
+}
+
+func TestClientProvider(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"success": true, "result": {
+			"ipv4_cidrs": ["1.1.1.0/24"],
+			"ipv6_cidrs": ["2606:4700::/32"],
+			"jdcloud_cidrs": ["1.2.3.0/24"],
+			"etag": "e"}}`))
+	}))
+	defer ts.Close()
+
+	all := &Client{APIURL: ts.URL, Networks: []string{NetworkJDCloud}}
+	res, err := all.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if all.Name() != "cloudflare" || len(res.IPv4) != 2 || len(res.IPv6) != 1 || res.Source != SourceAPI {
+		t.Fatalf("unexpected result from %s: %+v", all.Name(), res)
+	}
+
+	only := &Client{APIURL: ts.URL, Networks: []string{NetworkJDCloud}, NetworksOnly: true}
+	res, err = only.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if only.Name() != "cloudflare-jdcloud" || len(res.IPv4) != 1 || res.IPv4[0].String() != "1.2.3.0/24" || len(res.IPv6) != 0 {
+		t.Fatalf("unexpected result from %s: %+v", only.Name(), res)
+	}
+}
@@ -0,0 +1,115 @@
+package cloudflare
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+const (
+	DefaultIPv4TextURL = "https://www.cloudflare.com/ips-v4"
+	DefaultIPv6TextURL = "https://www.cloudflare.com/ips-v6"
+)
+
+// textDoc is the last copy of a plain-text list and its HTTP validators.
+type textDoc struct {
+	etag         string
+	lastModified string
+	freshUntil   time.Time
+	cidrs        []string
+}
+
+// fetchText reads both plain-text lists. Their version is a hash of the
+// contents, so a list served again without validators is still recognised
+// as unchanged.
+func (c *Client) fetchText(ctx context.Context, prevETag string) (*IPs, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{}
+	}
+	if c.textDocs == nil {
+		c.textDocs = map[string]*textDoc{}
+	}
+
+	v4, err := c.fetchTextDoc(ctx, c.IPv4TextURL)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := c.fetchTextDoc(ctx, c.IPv6TextURL)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(strings.Join(v4.cidrs, "\n")))
+	h.Write([]byte("\n\n"))
+	h.Write([]byte(strings.Join(v6.cidrs, "\n")))
+	version := "text:" + hex.EncodeToString(h.Sum(nil)[:8])
+	fresh := provider.Earliest(v4.freshUntil, v6.freshUntil)
+	if version == prevETag {
+		return &IPs{ETag: version, NotModified: true, Source: SourceText, FreshUntil: fresh}, nil
+	}
+	return &IPs{IPv4: v4.cidrs, IPv6: v6.cidrs, ETag: version, Source: SourceText, FreshUntil: fresh}, nil
+}
+
+func (c *Client) fetchTextDoc(ctx context.Context, url string) (*textDoc, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	prev := c.textDocs[url]
+	if prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		prev.freshUntil = provider.FreshUntil(resp.Header, time.Now())
+		return prev, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %w", url, provider.NewStatusError(resp))
+	}
+
+	doc := &textDoc{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		freshUntil:   provider.FreshUntil(resp.Header, time.Now()),
+	}
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := netip.ParsePrefix(line); err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		doc.cidrs = append(doc.cidrs, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: read body: %w", url, err)
+	}
+	if len(doc.cidrs) == 0 {
+		return nil, fmt.Errorf("%s: empty list", url)
+	}
+	c.textDocs[url] = doc
+	return doc, nil
+}
@@ -0,0 +1,73 @@
+package cloudflare
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchFallsBackToText(t *testing.T) {
+	var conditional int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"success": false}`))
+	})
+	serveList := func(etag, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == etag {
+				conditional++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			_, _ = w.Write([]byte(body))
+		}
+	}
+	mux.HandleFunc("/ips-v4", serveList(`"v4"`, "173.245.48.0/20\n103.21.244.0/22\n"))
+	mux.HandleFunc("/ips-v6", serveList(`"v6"`, "2400:cb00::/32\n"))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &Client{APIURL: ts.URL + "/api", IPv4TextURL: ts.URL + "/ips-v4", IPv6TextURL: ts.URL + "/ips-v6"}
+	ips, err := c.FetchRanges(context.Background(), "")
+	if err != nil {
+		t.Fatalf("FetchRanges error: %v", err)
+	}
+	if ips.Source != SourceText || ips.NotModified {
+		t.Fatalf("expected fresh text result, got %+v", ips)
+	}
+	if len(ips.IPv4) != 2 || len(ips.IPv6) != 1 || !strings.HasPrefix(ips.ETag, "text:") {
+		t.Fatalf("unexpected text result: %+v", ips)
+	}
+
+	again, err := c.FetchRanges(context.Background(), ips.ETag)
+	if err != nil {
+		t.Fatalf("FetchRanges error: %v", err)
+	}
+	if !again.NotModified || again.ETag != ips.ETag {
+		t.Fatalf("expected not modified, got %+v", again)
+	}
+	if conditional != 2 {
+		t.Fatalf("expected conditional requests for both lists, got %d", conditional)
+	}
+}
+
+func TestFetchTextRejectsGarbage(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/ips-v4", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>maintenance</html>\n"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &Client{APIURL: ts.URL + "/api", IPv4TextURL: ts.URL + "/ips-v4", IPv6TextURL: ts.URL + "/ips-v6"}
+	_, err := c.FetchRanges(context.Background(), "")
+	if err == nil || !strings.Contains(err.Error(), "text fallback") {
+		t.Fatalf("expected api and fallback error, got %v", err)
+	}
+}
@@ -0,0 +1,366 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// File is a parsed configuration file in a TOML subset: [tables], bare and
+// dotted keys, strings, integers, floats, booleans and single-line or
+// multi-line arrays of those. Durations are strings such as "30m". Quoted
+// keys, inline tables, arrays of tables, nested arrays, multi-line strings
+// and dates are rejected with the line they appear on.
+type File struct {
+	Path   string
+	Values []Value
+}
+
+// Value is one key of the file. Scalars are kept as their string form, the
+// way they would be written on the command line.
+type Value struct {
+	// Key is the full dotted key, e.g. "guard.min_ipv4".
+	Key   string
+	Line  int
+	List  bool
+	Items []string
+}
+
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &File{Path: path, Values: values}, nil
+}
+
+func Parse(data []byte) ([]Value, error) {
+	p := &parser{data: data, line: 1, seen: map[string]bool{}}
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return p.values, nil
+		}
+		var err error
+		if p.peek() == '[' {
+			err = p.header()
+		} else {
+			err = p.keyValue()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+	}
+}
+
+type parser struct {
+	data   []byte
+	pos    int
+	line   int
+	table  string
+	seen   map[string]bool
+	values []Value
+}
+
+func (p *parser) eof() bool  { return p.pos >= len(p.data) }
+func (p *parser) peek() byte { return p.data[p.pos] }
+
+// skipSpace skips blanks and comments, and line breaks too if newlines is
+// set.
+func (p *parser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) endOfLine() error {
+	p.skipSpace(false)
+	if !p.eof() && p.peek() != '\n' {
+		return fmt.Errorf("unexpected %q after value", p.peek())
+	}
+	return nil
+}
+
+func (p *parser) header() error {
+	p.pos++
+	if !p.eof() && p.peek() == '[' {
+		return errors.New("arrays of tables are not supported")
+	}
+	p.skipSpace(false)
+	name, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	if p.eof() || p.peek() != ']' {
+		return fmt.Errorf("table [%s] is not closed", name)
+	}
+	p.pos++
+	if p.seen["["+name+"]"] {
+		return fmt.Errorf("table [%s] defined twice", name)
+	}
+	p.seen["["+name+"]"] = true
+	p.table = name
+	return p.endOfLine()
+}
+
+func (p *parser) keyValue() error {
+	line := p.line
+	key, err := p.key()
+	if err != nil {
+		return err
+	}
+	if p.table != "" {
+		key = p.table + "." + key
+	}
+	p.skipSpace(false)
+	if p.eof() || p.peek() != '=' {
+		return fmt.Errorf("expected = after %s", key)
+	}
+	p.pos++
+	p.skipSpace(false)
+	v := Value{Key: key, Line: line}
+	if !p.eof() && p.peek() == '[' {
+		v.List = true
+		v.Items, err = p.array()
+	} else {
+		var s string
+		s, err = p.scalar()
+		v.Items = []string{s}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if p.seen[key] {
+		return fmt.Errorf("%s defined twice", key)
+	}
+	p.seen[key] = true
+	p.values = append(p.values, v)
+	return p.endOfLine()
+}
+
+// key reads a bare or dotted key.
+func (p *parser) key() (string, error) {
+	var parts []string
+	for {
+		start := p.pos
+		for !p.eof() && isKeyChar(p.peek()) {
+			p.pos++
+		}
+		if p.pos == start {
+			switch {
+			case p.eof() || p.peek() == '\n':
+				return "", errors.New("expected a key")
+			case p.peek() == '"' || p.peek() == '\'':
+				return "", errors.New("quoted keys are not supported")
+			}
+			return "", fmt.Errorf("unexpected %q in key", p.peek())
+		}
+		parts = append(parts, string(p.data[start:p.pos]))
+		p.skipSpace(false)
+		if p.eof() || p.peek() != '.' {
+			return strings.Join(parts, "."), nil
+		}
+		p.pos++
+		p.skipSpace(false)
+	}
+}
+
+func isKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *parser) array() ([]string, error) {
+	p.pos++
+	items := []string{}
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return nil, errors.New("array is not closed")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return items, nil
+		}
+		if p.peek() == '[' {
+			return nil, errors.New("nested arrays are not supported")
+		}
+		s, err := p.scalar()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+		p.skipSpace(true)
+		switch {
+		case p.eof():
+			return nil, errors.New("array is not closed")
+		case p.peek() == ',':
+			p.pos++
+		case p.peek() != ']':
+			return nil, fmt.Errorf("expected , or ] in array, got %q", p.peek())
+		}
+	}
+}
+
+// dateRe matches the start of a TOML date or time.
+var dateRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}|\d{2}:\d{2})`)
+
+func (p *parser) scalar() (string, error) {
+	if p.eof() || p.peek() == '\n' {
+		return "", errors.New("missing value")
+	}
+	switch p.peek() {
+	case '"':
+		return p.quoted('"')
+	case '\'':
+		return p.quoted('\'')
+	case '{':
+		return "", errors.New("inline tables are not supported, use a [table] section")
+	}
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]#", rune(p.peek())) {
+		p.pos++
+	}
+	tok := string(p.data[start:p.pos])
+	if dateRe.MatchString(tok) {
+		return "", fmt.Errorf("dates and times are not supported, quote %q as a string", tok)
+	}
+	if tok == "true" || tok == "false" {
+		return tok, nil
+	}
+	return number(tok)
+}
+
+var (
+	decimalRe  = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+	prefixedRe = regexp.MustCompile(`^0(x[0-9a-fA-F](_?[0-9a-fA-F])*|o[0-7](_?[0-7])*|b[01](_?[01])*)$`)
+	floatRe    = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)(\.[0-9](_?[0-9])*)?([eE][+-]?[0-9](_?[0-9])*)?$|^[+-]?(inf|nan)$`)
+)
+
+// number reads a TOML integer or float. Go's own parsers accept forms TOML
+// does not, such as a leading zero taken as octal, so the token is matched
+// against the TOML grammar first. Integers are returned in decimal.
+func number(tok string) (string, error) {
+	num := strings.ReplaceAll(tok, "_", "")
+	var n int64
+	var err error
+	switch {
+	case decimalRe.MatchString(tok):
+		n, err = strconv.ParseInt(num, 10, 64)
+	case prefixedRe.MatchString(tok):
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[num[1]]
+		n, err = strconv.ParseInt(num[2:], base, 64)
+	case floatRe.MatchString(tok):
+		return strings.TrimPrefix(num, "+"), nil
+	default:
+		return "", fmt.Errorf("invalid value %q (strings need quotes)", tok)
+	}
+	if err != nil {
+		return "", fmt.Errorf("integer %s out of range", tok)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// quoted reads a basic ("...") or literal ('...') string on one line.
+func (p *parser) quoted(q byte) (string, error) {
+	if strings.HasPrefix(string(p.data[p.pos:]), strings.Repeat(string(q), 3)) {
+		return "", errors.New("multi-line strings are not supported")
+	}
+	start := p.pos
+	p.pos++
+	for !p.eof() && p.peek() != q && p.peek() != '\n' {
+		if q == '"' && p.peek() == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.eof() || p.peek() != q {
+		return "", errors.New("string is not closed")
+	}
+	p.pos++
+	raw := string(p.data[start+1 : p.pos-1])
+	if q == '\'' {
+		return raw, checkControl(raw)
+	}
+	return unescape(raw)
+}
+
+// checkControl rejects the control characters TOML does not allow in
+// strings; only tab may appear unescaped.
+func checkControl(s string) error {
+	for _, r := range s {
+		if r < 0x20 && r != '\t' || r == 0x7f {
+			return fmt.Errorf("control character %U in string must be escaped", r)
+		}
+	}
+	return nil
+}
+
+// unescape resolves the escapes of a TOML basic string. These differ from
+// Go's: there is no \a, \v, \x or octal, and \u and \U must name a
+// valid code point.
+func unescape(s string) (string, error) {
+	if err := checkControl(s); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", errors.New("string ends in an escape")
+		}
+		i++
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\\':
+			b.WriteByte(c)
+		case 'u', 'U':
+			size := 4
+			if c == 'U' {
+				size = 8
+			}
+			hex := s[i+1 : min(i+1+size, len(s))]
+			r, err := strconv.ParseUint(hex, 16, 32)
+			if len(hex) != size || err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("invalid escape \\%c%s", c, hex)
+			}
+			b.WriteRune(rune(r))
+			i += size
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", c)
+		}
+	}
+	return b.String(), nil
+}
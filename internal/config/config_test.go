@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := `# cf-ip-guard
+interval = "30m"   # comment after a value
+once = false
+delta_ratio = 0.25
+
+[guard]
+min_ipv4 = 1_000
+anchors = [
+  "173.245.48.0/20", # Cloudflare
+  '2400:cb00::/32',
+]
+
+[ hooks ]
+on_update = ["systemctl reload nginx, haproxy", "echo \"done\""]
+rules.ports = [80, 443]
+`
+	got, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	want := []Value{
+		{Key: "interval", Line: 2, Items: []string{"30m"}},
+		{Key: "once", Line: 3, Items: []string{"false"}},
+		{Key: "delta_ratio", Line: 4, Items: []string{"0.25"}},
+		{Key: "guard.min_ipv4", Line: 7, Items: []string{"1000"}},
+		{Key: "guard.anchors", Line: 8, List: true, Items: []string{"173.245.48.0/20", "2400:cb00::/32"}},
+		{Key: "hooks.on_update", Line: 14, List: true, Items: []string{"systemctl reload nginx, haproxy", `echo "done"`}},
+		{Key: "hooks.rules.ports", Line: 15, List: true, Items: []string{"80", "443"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseMultiLineArrays(t *testing.T) {
+	data := `ports = [
+  80,   # http
+  443,
+]
+anchors = ["192.0.2.0/24",
+           "2001:db8::/32"]
+once = true
+`
+	got, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	want := []Value{
+		{Key: "ports", Line: 1, List: true, Items: []string{"80", "443"}},
+		{Key: "anchors", Line: 5, List: true, Items: []string{"192.0.2.0/24", "2001:db8::/32"}},
+		{Key: "once", Line: 7, Items: []string{"true"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseTOMLValues(t *testing.T) {
+	data := `a = 0
+b = -17
+c = 1_000
+d = 0x1F
+e = 0o17
+f = 0b101
+g = 1e3
+h = -0.5
+i = "tab\t\"q\" \\ \u00e9 \U0001F600"
+j = 'C:\path'
+`
+	got, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(got) != 10 {
+		t.Fatalf("Parse = %+v, want 10 values", got)
+	}
+	want := []string{"0", "-17", "1000", "31", "15", "5", "1e3", "-0.5", "tab\t\"q\" \\ \u00e9 \U0001F600", `C:\path`}
+	for i, v := range got {
+		if v.Items[0] != want[i] {
+			t.Errorf("%s = %q, want %q", v.Key, v.Items[0], want[i])
+		}
+	}
+}
+
+func TestParseEmptyArray(t *testing.T) {
+	got, err := Parse([]byte("sources.files = []\n"))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(got) != 1 || !got[0].List || len(got[0].Items) != 0 {
+		t.Errorf("Parse = %+v, want one empty list", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		data, want string
+	}{
+		{"interval = 30m", `line 1: interval: invalid value "30m"`},
+		{"a = 1\na = 2", "line 2: a defined twice"},
+		{"[guard]\n[guard]", "line 2: table [guard] defined twice"},
+		{"[[sets]]", "arrays of tables are not supported"},
+		{"[guard", "not closed"},
+		{"a = \"open", "string is not closed"},
+		{"a = [1, 2", "array is not closed"},
+		{"a = [[1]]", "nested arrays"},
+		{"a = 1 b = 2", "unexpected 'b' after value"},
+		{"a =", "missing value"},
+		{"= 1", "unexpected '='"},
+		{"a = '''x'''", "multi-line strings"},
+		{"[guard]\nanchors = { v4 = \"192.0.2.0/24\" }", "line 2: guard.anchors: inline tables are not supported"},
+		{"a = [\n  1,\n  { b = 2 },\n]", "line 3: a: inline tables"},
+		{"a = [\n  \"x\",\n  y,\n]", `line 3: a: invalid value "y"`},
+		{"a = 1979-05-27", "line 1: a: dates and times are not supported"},
+		{"a = 07:32:00", "dates and times"},
+		{"\"a.b\" = 1", "line 1: quoted keys are not supported"},
+		{"a = \"\"\"\nx\"\"\"", "multi-line strings"},
+		{"a = 010", `invalid value "010"`},
+		{"a = +0x10", `invalid value "+0x10"`},
+		{"a = 0X10", `invalid value "0X10"`},
+		{"a = 1__0", `invalid value "1__0"`},
+		{"a = 0x1p-2", `invalid value "0x1p-2"`},
+		{"a = 99999999999999999999", "integer 99999999999999999999 out of range"},
+		{`a = "\x41"`, `invalid escape \x`},
+		{`a = "\a"`, `invalid escape \a`},
+		{`a = "\uD800"`, `invalid escape \uD800`},
+		{`a = "\u41"`, `invalid escape \u41`},
+		{"a = `raw`", "invalid value \"`raw`\""},
+		{"a = \"tab\x01\"", "control character U+0001"},
+	}
+	for _, tc := range cases {
+		_, err := Parse([]byte(tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parse(%q) error = %v, want %q", tc.data, err, tc.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[retry]\nmax = 1\nmax = 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+": line 3:") {
+		t.Errorf("Load error = %v, want it to name the file and line", err)
+	}
+}
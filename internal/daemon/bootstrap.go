@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/local"
+	"github.com/Ringyuki/cf-ip-guard/internal/logging"
+	"github.com/Ringyuki/cf-ip-guard/internal/snapshot"
+)
+
+// snapshotFile in the state directory holds the main sets of the last
+// successful update.
+const snapshotFile = "snapshot.json"
+
+// bootstrap fills the main sets from the newest snapshot when the first
+// update failed, so that rules referencing the sets can load. The next
+// successful fetch replaces it.
+func bootstrap(ctx context.Context, logger logging.Logger, cfg Config) (firewall.UpdateConfig, bool) {
+	var snaps []*snapshot.Snapshot
+	if cfg.StateDir != "" {
+		s, err := snapshot.Load(filepath.Join(cfg.StateDir, snapshotFile))
+		if err != nil {
+			logger.Warnw("saved snapshot unreadable", "err", err)
+		}
+		snaps = append(snaps, s)
+	}
+	// The embedded ranges are Cloudflare's, which a local main list is not.
+	if !local.IsFileURL(cfg.CloudflareAPI) {
+		s, err := snapshot.Embedded()
+		if err != nil {
+			logger.Warnw("embedded snapshot unreadable", "err", err)
+		}
+		snaps = append(snaps, s)
+	}
+	s := snapshot.Newest(snaps...)
+	if s == nil {
+		logger.Warnw("no snapshot to bootstrap the sets from")
+		return firewall.UpdateConfig{}, false
+	}
+
+	fwCfg := targetConfig(cfg, mainTarget(cfg))
+	fwCfg.IPv4CIDRs = s.IPv4
+	fwCfg.IPv6CIDRs = s.IPv6
+	fwCfg.Comment = "stale snapshot " + s.Taken.Format(time.DateOnly)
+	if _, err := updateIPSetsFunc(context.WithoutCancel(ctx), fwCfg); err != nil {
+		logger.Errorw("bootstrap from snapshot failed", "source", s.Source, "err", err)
+		return firewall.UpdateConfig{}, false
+	}
+	logger.Warnw("sets bootstrapped from a stale snapshot until a fetch succeeds",
+		"source", s.Source,
+		"taken", s.Taken.Format(time.DateOnly),
+		"age", time.Since(s.Taken).Round(time.Hour),
+		"ipv4", len(s.IPv4),
+		"ipv6", len(s.IPv6))
+	return fwCfg, true
+}
+
+// saveSnapshot records what a live update put into the main sets.
+func saveSnapshot(logger logging.Logger, cfg Config, applied firewall.UpdateConfig) {
+	if cfg.StateDir == "" {
+		return
+	}
+	s := &snapshot.Snapshot{IPv4: applied.IPv4CIDRs, IPv6: applied.IPv6CIDRs, Taken: time.Now().UTC()}
+	if err := snapshot.Save(filepath.Join(cfg.StateDir, snapshotFile), s); err != nil {
+		logger.Warnw("saving snapshot failed", "err", err)
+	}
+}
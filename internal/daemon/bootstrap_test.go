@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/snapshot"
+	"go.uber.org/zap"
+)
+
+func TestBootstrap(t *testing.T) {
+	var got []firewall.UpdateConfig
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		got = append(got, cfg)
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		StateDir:    t.TempDir(),
+		Logger:      zap.NewNop().Sugar(),
+	}
+
+	// Without a saved snapshot the built-in one is used.
+	applied, ok := bootstrap(context.Background(), cfg.Logger, cfg)
+	embedded, _ := snapshot.Embedded()
+	if !ok || len(got) != 1 || len(applied.IPv4CIDRs) != len(embedded.IPv4) || applied.IPv4SetName != "v4" {
+		t.Fatalf("embedded bootstrap: ok=%v %+v", ok, got)
+	}
+	if !strings.HasPrefix(applied.Comment, "stale snapshot") {
+		t.Fatalf("bootstrap should be labelled stale: %q", applied.Comment)
+	}
+
+	// A snapshot saved after a live update is newer.
+	saveSnapshot(cfg.Logger, cfg, firewall.UpdateConfig{IPv4CIDRs: []string{"192.0.2.0/24"}})
+	applied, ok = bootstrap(context.Background(), cfg.Logger, cfg)
+	if !ok || len(applied.IPv4CIDRs) != 1 || applied.IPv4CIDRs[0] != "192.0.2.0/24" {
+		t.Fatalf("saved snapshot not preferred: %+v", applied)
+	}
+}
+
+func TestBootstrapLocalList(t *testing.T) {
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		t.Fatalf("nothing should be applied")
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + filepath.Join(t.TempDir(), "missing.txt"),
+		Logger:        zap.NewNop().Sugar(),
+	}
+	if _, ok := bootstrap(context.Background(), cfg.Logger, cfg); ok {
+		t.Fatalf("Cloudflare snapshot applied to a local main list")
+	}
+}
@@ -2,35 +2,157 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/Ringyuki/cf-ip-guard/internal/aws"
 	"github.com/Ringyuki/cf-ip-guard/internal/cloudflare"
+	"github.com/Ringyuki/cf-ip-guard/internal/fastly"
 	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/github"
+	"github.com/Ringyuki/cf-ip-guard/internal/google"
+	"github.com/Ringyuki/cf-ip-guard/internal/local"
 	"github.com/Ringyuki/cf-ip-guard/internal/logging"
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+	"github.com/Ringyuki/cf-ip-guard/internal/schedule"
 )
 
-var updateIPSetsFunc = firewall.UpdateIPSets
+var (
+	updateIPSetsFunc   = firewall.UpdateIPSets
+	ensureRulesFunc    = firewall.EnsureRules
+	removeRulesFunc    = firewall.RemoveRules
+	flushConntrackFunc = firewall.FlushConntrack
+	checkDriftFunc     = firewall.CheckDrift
+	checkBackendFunc   = firewall.CheckBackend
+)
 
 type Config struct {
-	Interval       time.Duration
-	IPv4SetName    string
-	IPv6SetName    string
-	CloudflareAPI  string
-	Once           bool
-	PersistentSave bool
-	Logger         logging.Logger
+	Interval    time.Duration
+	Backend     string
+	NFTTable    string
+	DeltaRatio  float64
+	IPv4SetName string
+	IPv6SetName string
+	IPv4Options firewall.SetOptions
+	IPv6Options firewall.SetOptions
+	// CloudflareAPI may also be a file:// URL of a local list.
+	CloudflareAPI string
+	// FallbackIPv4URL and FallbackIPv6URL are plain-text lists used when
+	// the API fails. Empty disables the fallback.
+	FallbackIPv4URL string
+	FallbackIPv6URL string
+	Once            bool
+	PersistentSave  bool
+	// ManageRules makes the daemon own an iptables/ip6tables chain that
+	// only lets the managed sets reach RulePorts.
+	ManageRules bool
+	RuleChain   string
+	RulePorts   []int
+	// FlushConntrack deletes tracked connections from removed ranges to
+	// RulePorts after each update.
+	FlushConntrack bool
+	// DriftInterval is how often the live sets are read back and compared
+	// with the last applied lists. Zero disables drift checks.
+	DriftInterval time.Duration
+	// StateDir holds the record of sets the daemon created. Empty disables
+	// ownership checks.
+	StateDir string
+	// AdoptSets takes over existing sets that the daemon did not create.
+	AdoptSets bool
+	// JDCloud also requests the Cloudflare China Network ranges. They go
+	// into the JDCloud set pair when it is named, else into the main sets.
+	JDCloud            bool
+	JDCloudIPv4SetName string
+	JDCloudIPv6SetName string
+	// Sources are file:// lists and StaticCIDRs fixed ranges, both merged
+	// into the main sets.
+	Sources     []string
+	StaticCIDRs []string
+	// Aggregate merges adjacent and covered prefixes before they are
+	// applied. Lists are always sorted and deduped.
+	Aggregate bool
+	// Schedule is a cron expression (minute hour day month weekday) that
+	// replaces Interval when set.
+	Schedule string
+	// Jitter adds up to this much random delay to every planned fetch.
+	Jitter time.Duration
+	// RetryMin is the first delay before a failed cycle is retried; it
+	// doubles per attempt up to RetryMax. Zero waits for the next tick.
+	RetryMin time.Duration
+	RetryMax time.Duration
+	// Guard refuses updates that look like a broken list.
+	Guard GuardConfig
+	// Bootstrap fills the main sets from a snapshot when the first update
+	// fails.
+	Bootstrap bool
+	// Hooks run shell commands after updates and failures.
+	Hooks  HookConfig
+	AWS    AWSConfig
+	GitHub GitHubConfig
+	Fastly FastlyConfig
+	Google GoogleConfig
+	// Reload delivers a configuration to switch to, e.g. on SIGHUP. The
+	// backend and the state directory only change with a restart.
+	Reload <-chan Config
+	// Resync asks for an immediate cycle that ignores cached versions.
+	Resync <-chan struct{}
+	Logger logging.Logger
+}
+
+// AWSConfig enables the AWS ip-ranges.json provider. Its set pair may be
+// the main pair, to merge the ranges into it.
+type AWSConfig struct {
+	Enabled     bool
+	URL         string
+	Services    []string
+	Regions     []string
+	IPv4SetName string
+	IPv6SetName string
+}
+
+// GitHubConfig enables the GitHub /meta provider for the ranges under Keys.
+type GitHubConfig struct {
+	Enabled     bool
+	URL         string
+	Keys        []string
+	IPv4SetName string
+	IPv6SetName string
+}
+
+// FastlyConfig enables the Fastly public-ip-list provider.
+type FastlyConfig struct {
+	Enabled     bool
+	URL         string
+	IPv4SetName string
+	IPv6SetName string
+}
+
+// GoogleConfig enables a Google prefix list provider, cloud.json by
+// default, keeping the prefixes of Scopes.
+type GoogleConfig struct {
+	Enabled     bool
+	URL         string
+	Scopes      []string
+	IPv4SetName string
+	IPv6SetName string
 }
 
 type updateStats struct {
-	Success         uint64
-	Fail            uint64
-	ConsecutiveFail uint64
-	LastDuration    time.Duration
-	LastETag        string
-	LastUpdate      time.Time
+	Success         uint64        `json:"success"`
+	Fail            uint64        `json:"fail"`
+	ConsecutiveFail uint64        `json:"consecutive_fail"`
+	LastDuration    time.Duration `json:"last_duration"`
+	LastVersion     string        `json:"last_version"`
+	LastUpdate      time.Time     `json:"last_update"`
+	Drift           uint64        `json:"drift"`
+	Retries         uint64        `json:"retries"`
+	// Stale is set while the main sets hold a bootstrap snapshot.
+	Stale bool `json:"stale"`
 }
 
 func Run(ctx context.Context, cfg Config) error {
@@ -39,94 +161,228 @@ func Run(ctx context.Context, cfg Config) error {
 	}
 	logger := cfg.Logger
 
-	if cfg.Interval <= 0 {
-		cfg.Interval = 30 * time.Minute
-	}
-	if cfg.IPv4SetName == "" {
-		cfg.IPv4SetName = "cloudflare4"
-	}
-	if cfg.IPv6SetName == "" {
-		cfg.IPv6SetName = "cloudflare6"
-	}
-	if cfg.CloudflareAPI == "" {
-		cfg.CloudflareAPI = "https://api.cloudflare.com/client/v4/ips"
+	sched, err := prepare(&cfg)
+	if err != nil {
+		return err
 	}
-
-	if err := firewall.CheckEnv(ctx); err != nil {
+	reg := newRegistry(cfg)
+	if err := checkBackendFunc(ctx, cfg.Backend); err != nil {
 		logger.Errorw("preflight check failed", "err", err)
 		return err
 	}
 	firewall.SetLogger(logger.Named("firewall"))
 
-	client := &cloudflare.Client{
-		HTTPClient: &http.Client{Timeout: 10 * time.Second},
-		APIURL:     cfg.CloudflareAPI,
+	if cfg.StateDir != "" {
+		setReg, err := firewall.LoadRegistry(filepath.Join(cfg.StateDir, "sets"))
+		if err != nil {
+			return fmt.Errorf("load set registry: %w", err)
+		}
+		firewall.SetRegistry(setReg)
+	}
+	for _, sc := range setConfigs(cfg) {
+		if removed, err := firewall.RemoveOrphans(ctx, sc); err != nil {
+			logger.Warnw("orphaned set cleanup failed", "err", err)
+		} else if len(removed) > 0 {
+			logger.Infow("removed orphaned sets", "sets", removed)
+		}
 	}
 
 	logger.Infow("cf-ip-guard daemon starting",
 		"interval", cfg.Interval,
+		"schedule", cfg.Schedule,
+		"backend", cfg.Backend,
 		"ipset4", cfg.IPv4SetName,
 		"ipset6", cfg.IPv6SetName,
 		"api", cfg.CloudflareAPI,
-		"once", cfg.Once)
+		"once", cfg.Once,
+		"jdcloud", cfg.JDCloud,
+		"aws", cfg.AWS.Enabled,
+		"github", cfg.GitHub.Enabled,
+		"fastly", cfg.Fastly.Enabled,
+		"google", cfg.Google.Enabled,
+		"manage_rules", cfg.ManageRules)
 
-	stats := &updateStats{}
-	var lastETag string
+	// Only a chain recorded in the registry is removed, so without a state
+	// directory there is no telling it from one an admin made.
+	if !cfg.ManageRules && cfg.StateDir != "" && cfg.Backend != firewall.BackendNFT {
+		if err := removeRulesFunc(ctx, ruleConfig(cfg)); err != nil {
+			logger.Debugw("managed rules cleanup skipped", "err", err)
+		}
+	}
 
-	if res, err := updateOnce(ctx, logger, client, cfg, lastETag); err != nil {
-		markFailure(stats, logger, err)
-		logger.Errorw("initial update failed", "err", err)
-	} else {
-		markSuccess(stats, logger, res)
-		if !res.NotModified && res.ETag != "" {
-			lastETag = res.ETag
+	restored, saved := loadState(logger, cfg, reg)
+	stats := &saved
+	lastApplied := map[provider.Target]firewall.UpdateConfig{}
+	// The sets may not have survived a reboot, so restored content is
+	// checked against them before the first fetch trusts it.
+	for _, applied := range restored {
+		lastApplied[targetOf(applied)] = applied
+		healDrift(ctx, logger, stats, applied)
+	}
+
+	cycle := func(failMsg string) (time.Time, error) {
+		cycleCfg := cfg
+		if takeOverride(cfg.StateDir) {
+			logger.Warnw("guard override requested, the next update is applied unchecked")
+			cycleCfg.Guard.Override = true
 		}
-		if cfg.PersistentSave && !res.NotModified {
-			if err := persistState(ctx, logger); err != nil {
+		res, err := updateOnce(ctx, logger, reg, cycleCfg)
+		for _, applied := range res.Applied {
+			lastApplied[targetOf(applied)] = applied
+			if targetOf(applied) == mainTarget(cfg) {
+				stats.Stale = false
+				saveSnapshot(logger, cfg, applied)
+			}
+		}
+		if ctx.Err() == nil {
+			refreshTimeouts(ctx, logger, cfg, lastApplied, res.Applied)
+		}
+		// A shutdown cancels ctx and cuts the cycle short; that is not a
+		// failure. A reload waits for the cycle to finish.
+		interrupted := errors.Is(err, context.Canceled)
+		switch {
+		case interrupted:
+			logger.Infow("update interrupted", "err", err)
+		case err != nil:
+			markFailure(stats, logger, err)
+			logger.Errorw(failMsg, "err", err)
+		default:
+			markSuccess(stats, logger, res)
+		}
+		if cfg.PersistentSave && len(res.Applied) > 0 {
+			if err := persistState(context.WithoutCancel(ctx), logger); err != nil {
 				logger.Warnw("persistent save failed", "err", err)
 			}
 		}
+		reconcileRules(ctx, logger, cfg, lastApplied)
+		saveState(logger, cfg, reg, lastApplied, stats)
+		if len(res.Applied) > 0 {
+			runHooks(ctx, logger, cfg.Hooks, "update", cfg.Hooks.OnUpdate, updateHookEnv(res))
+		}
+		if err != nil && !interrupted {
+			runHooks(ctx, logger, cfg.Hooks, "failure", cfg.Hooks.OnFailure, failureHookEnv(stats, err))
+		}
+		return res.FreshUntil, err
+	}
+
+	initialFresh, initialErr := cycle("initial update failed")
+	if _, ok := lastApplied[mainTarget(cfg)]; !ok && cfg.Bootstrap {
+		if applied, ok := bootstrap(ctx, logger, cfg); ok {
+			lastApplied[mainTarget(cfg)] = applied
+			stats.Stale = true
+			reconcileRules(ctx, logger, cfg, lastApplied)
+			saveState(logger, cfg, reg, lastApplied, stats)
+		}
 	}
 
 	if cfg.Once {
 		logger.Infow("daemon once mode finished",
 			"success", stats.Success,
 			"fail", stats.Fail,
-			"last_etag", stats.LastETag,
+			"last_version", stats.LastVersion,
+			"stale", stats.Stale,
 			"consecutive_fail", stats.ConsecutiveFail)
 		return nil
 	}
 
-	ticker := time.NewTicker(cfg.Interval)
-	defer ticker.Stop()
+	var driftC <-chan time.Time
+	if cfg.DriftInterval > 0 {
+		driftTicker := time.NewTicker(cfg.DriftInterval)
+		defer driftTicker.Stop()
+		driftC = driftTicker.C
+	}
+	// Sets with a timeout are refreshed on a ticker of their own, because
+	// cycles may be further apart than the timeout.
+	var refreshC <-chan time.Time
+	var refreshTicker *time.Ticker
+	resetRefresh := func() {
+		if refreshTicker != nil {
+			refreshTicker.Stop()
+			refreshTicker, refreshC = nil, nil
+		}
+		if d := timeoutRefresh(cfg); d > 0 {
+			refreshTicker = time.NewTicker(d)
+			refreshC = refreshTicker.C
+		}
+	}
+	resetRefresh()
+	defer func() {
+		if refreshTicker != nil {
+			refreshTicker.Stop()
+		}
+	}()
+
+	// One timer drives regular cycles and retries of failed ones, so a
+	// pending retry is never overtaken by a regular cycle.
+	timer := time.NewTimer(cfg.Interval)
+	defer timer.Stop()
+	attempt := 0
+	plan := func(fresh time.Time, err error) {
+		now := time.Now()
+		var next time.Time
+		if err != nil && cfg.RetryMin > 0 {
+			attempt++
+			next = now.Add(retryDelay(attempt, cfg.RetryMin, cfg.RetryMax))
+		} else {
+			attempt = 0
+			next = nextFetch(cfg, sched, now, fresh)
+		}
+		timer.Reset(next.Sub(now))
+		logger.Infow("next fetch planned",
+			"at", next.Format(time.RFC3339),
+			"in", next.Sub(now).Round(time.Second),
+			"retry_attempt", attempt)
+	}
+	plan(initialFresh, initialErr)
 
 	for {
 		select {
 		case <-ctx.Done():
 			logger.Infow("daemon stopped", "err", ctx.Err())
 			return ctx.Err()
-		case <-ticker.C:
-			if res, err := updateOnce(ctx, logger, client, cfg, lastETag); err != nil {
-				markFailure(stats, logger, err)
-				logger.Errorw("update failed", "err", err)
-			} else {
-				markSuccess(stats, logger, res)
-				if !res.NotModified && res.ETag != "" {
-					lastETag = res.ETag
+		case <-driftC:
+			for _, applied := range lastApplied {
+				healDrift(ctx, logger, stats, applied)
+			}
+		case <-refreshC:
+			refreshTimeouts(ctx, logger, cfg, lastApplied, nil)
+		case <-timer.C:
+			failMsg := "update failed"
+			if attempt > 0 {
+				stats.Retries++
+				failMsg = "retry failed"
+			}
+			plan(cycle(failMsg))
+			logStats(logger, stats, attempt)
+		case next := <-cfg.Reload:
+			newCfg, newSched, err := reload(cfg, next)
+			if err != nil {
+				logger.Errorw("reload failed, keeping the current configuration", "err", err)
+				continue
+			}
+			if cfg.ManageRules && (!newCfg.ManageRules || newCfg.RuleChain != cfg.RuleChain) {
+				if err := removeRulesFunc(ctx, ruleConfig(cfg)); err != nil {
+					logger.Warnw("managed rules cleanup failed", "err", err)
 				}
-				if cfg.PersistentSave && !res.NotModified {
-					if err := persistState(ctx, logger); err != nil {
-						logger.Warnw("persistent save failed", "err", err)
-					}
+			}
+			cfg, sched = newCfg, newSched
+			newReg := newRegistry(cfg)
+			carryStates(logger, reg, newReg)
+			reg = newReg
+			for t := range lastApplied {
+				if !hasTarget(reg, t) {
+					delete(lastApplied, t)
 				}
 			}
-			logger.Infow("stats",
-				"success", stats.Success,
-				"fail", stats.Fail,
-				"last_duration", stats.LastDuration,
-				"last_etag", stats.LastETag,
-				"last_update", stats.LastUpdate.Format(time.RFC3339),
-				"consecutive_fail", stats.ConsecutiveFail)
+			resetRefresh()
+			logger.Infow("configuration reloaded", "targets", len(reg.Targets()))
+			attempt = 0
+			plan(cycle("update after reload failed"))
+		case <-cfg.Resync:
+			logger.Infow("forced resync requested")
+			reg.Invalidate()
+			attempt = 0
+			plan(cycle("forced resync failed"))
 		}
 	}
 }
@@ -134,68 +390,405 @@ func Run(ctx context.Context, cfg Config) error {
 type updateResult struct {
 	IPv4Count   int
 	IPv6Count   int
-	ETag        string
+	Added       int
+	Removed     int
+	Swapped     bool
+	FlowsKilled int
+	Version     string
 	Duration    time.Duration
 	NotModified bool
+	// Applied is what was written to the sets, kept for drift checks.
+	Applied []firewall.UpdateConfig
+	// FreshUntil is the earliest time any fetched list may change.
+	FreshUntil time.Time
 }
 
-func updateOnce(ctx context.Context, logger logging.Logger, client *cloudflare.Client, cfg Config, prevETag string) (updateResult, error) {
-	start := time.Now()
+// prepare fills in defaults and rejects configurations that cannot work.
+// It returns the parsed schedule, if any.
+func prepare(cfg *Config) (*schedule.Cron, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Minute
+	}
+	if cfg.IPv4SetName == "" {
+		cfg.IPv4SetName = "cloudflare4"
+	}
+	if cfg.IPv6SetName == "" {
+		cfg.IPv6SetName = "cloudflare6"
+	}
+	if cfg.CloudflareAPI == "" {
+		cfg.CloudflareAPI = "https://api.cloudflare.com/client/v4/ips"
+	}
+	if cfg.AWS.IPv4SetName == "" {
+		cfg.AWS.IPv4SetName = "aws4"
+	}
+	if cfg.AWS.IPv6SetName == "" {
+		cfg.AWS.IPv6SetName = "aws6"
+	}
+	if len(cfg.GitHub.Keys) == 0 {
+		cfg.GitHub.Keys = []string{"hooks"}
+	}
+	if cfg.GitHub.IPv4SetName == "" {
+		cfg.GitHub.IPv4SetName = "github4"
+	}
+	if cfg.GitHub.IPv6SetName == "" {
+		cfg.GitHub.IPv6SetName = "github6"
+	}
+	if cfg.Fastly.IPv4SetName == "" {
+		cfg.Fastly.IPv4SetName = "fastly4"
+	}
+	if cfg.Fastly.IPv6SetName == "" {
+		cfg.Fastly.IPv6SetName = "fastly6"
+	}
+	if cfg.Google.IPv4SetName == "" {
+		cfg.Google.IPv4SetName = "google4"
+	}
+	if cfg.Google.IPv6SetName == "" {
+		cfg.Google.IPv6SetName = "google6"
+	}
+
+	if cfg.RetryMax < cfg.RetryMin {
+		cfg.RetryMax = cfg.RetryMin
+	}
+	if cfg.Jitter < 0 {
+		return nil, fmt.Errorf("jitter must not be negative, got %s", cfg.Jitter)
+	}
+	var sched *schedule.Cron
+	if cfg.Schedule != "" {
+		var err error
+		if sched, err = schedule.Parse(cfg.Schedule); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Backend == "" {
+		cfg.Backend = firewall.BackendIPSet
+	}
+	if cfg.ManageRules && cfg.Backend == firewall.BackendNFT {
+		return nil, fmt.Errorf("managed iptables rules are not supported with the %s backend", cfg.Backend)
+	}
+
+	if local.IsFileURL(cfg.CloudflareAPI) {
+		if cfg.JDCloud {
+			return nil, fmt.Errorf("JD Cloud ranges need an HTTP API URL, not %s", cfg.CloudflareAPI)
+		}
+		if _, err := local.FromURL(cfg.CloudflareAPI); err != nil {
+			return nil, err
+		}
+	}
+	for _, src := range cfg.Sources {
+		if _, err := local.FromURL(src); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := provider.ParsePrefixes(cfg.StaticCIDRs); err != nil {
+		return nil, fmt.Errorf("static CIDRs: %w", err)
+	}
+	if _, _, err := provider.ParsePrefixes(cfg.Guard.Anchors); err != nil {
+		return nil, fmt.Errorf("guard anchors: %w", err)
+	}
+	for _, sc := range setConfigs(*cfg) {
+		if err := sc.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return sched, nil
+}
 
-	ipv4, ipv6, etag, notModified, err := client.FetchIPs(ctx, prevETag)
+// reload checks next as a replacement for the running configuration cur.
+func reload(cur, next Config) (Config, *schedule.Cron, error) {
+	next.Logger = cur.Logger
+	next.Reload, next.Resync = cur.Reload, cur.Resync
+	sched, err := prepare(&next)
 	if err != nil {
-		return updateResult{}, err
+		return cur, nil, err
+	}
+	if next.Backend != cur.Backend || next.NFTTable != cur.NFTTable || next.StateDir != cur.StateDir {
+		return cur, nil, fmt.Errorf("backend, nft table and state directory only change with a restart")
+	}
+	return next, sched, nil
+}
+
+// updateOnce fetches every provider and updates the targets whose ranges
+// changed. Targets that were updated are reported in Applied even when
+// another target failed.
+func updateOnce(ctx context.Context, logger logging.Logger, reg *provider.Registry, cfg Config) (updateResult, error) {
+	start := time.Now()
+	c := reg.Fetch(ctx)
+
+	var errs []error
+	for _, f := range c.Fetched {
+		switch {
+		case f.Err != nil:
+			logger.Warnw("fetch failed", "provider", f.Provider, "err", f.Err)
+		case !f.Result.NotModified:
+			if n := len(f.Result.Rejected); n > 0 {
+				logger.Warnw("rejected entries",
+					"provider", f.Provider,
+					"count", n,
+					"entries", f.Result.Rejected)
+			}
+			logger.Infow("fetched ranges",
+				"provider", f.Provider,
+				"ipv4", len(f.Result.IPv4),
+				"ipv6", len(f.Result.IPv6),
+				"version", f.Result.Version,
+				"source", f.Result.Source)
+		}
+	}
+
+	res := updateResult{NotModified: true, FreshUntil: freshUntil(c.Fetched)}
+	var removed []string
+	for _, u := range c.Updates {
+		if u.Err != nil {
+			errs = append(errs, u.Err)
+			continue
+		}
+		if !u.Changed {
+			continue
+		}
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		if err := checkGuard(guardFor(cfg, u), u.Target == mainTarget(cfg), u); err != nil {
+			if !cfg.Guard.Override {
+				logger.Errorw("update refused, sets keep their current content",
+					"ipset4", u.Target.IPv4Set,
+					"ipset6", u.Target.IPv6Set,
+					"err", err)
+				errs = append(errs, err)
+				continue
+			}
+			logger.Warnw("guard overridden", "err", err)
+		}
+		res.NotModified = false
+
+		fwCfg := targetConfig(cfg, u.Target)
+		fwCfg.IPv4CIDRs = provider.Strings(provider.Normalize(u.IPv4, cfg.Aggregate))
+		fwCfg.IPv6CIDRs = provider.Strings(provider.Normalize(u.IPv6, cfg.Aggregate))
+		fwCfg.Comment = strings.Join(u.Providers, ",") + " " + start.UTC().Format(time.RFC3339)
+		// An apply that has started runs to the end even on shutdown, so
+		// the sets are never left half-written.
+		fwRes, err := updateIPSetsFunc(context.WithoutCancel(ctx), fwCfg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		reg.Commit(u)
+
+		res.IPv4Count += len(fwCfg.IPv4CIDRs)
+		res.IPv6Count += len(fwCfg.IPv6CIDRs)
+		res.Added += fwRes.Added
+		res.Removed += fwRes.Removed
+		res.Swapped = res.Swapped || fwRes.Swapped
+		res.Applied = append(res.Applied, fwCfg)
+		removed = append(removed, fwRes.RemovedCIDRs...)
+	}
+	// A failed fetch is a failed cycle even if the target could still be
+	// built from earlier ranges.
+	for _, f := range c.Fetched {
+		if f.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Provider, f.Err))
+		}
 	}
 
-	if notModified {
-		return updateResult{
-			ETag:        etag,
-			NotModified: true,
-			Duration:    time.Since(start),
-		}, nil
+	if cfg.FlushConntrack && len(removed) > 0 {
+		killed, err := flushConntrackFunc(context.WithoutCancel(ctx), removed, protectedPorts(cfg))
+		if err != nil {
+			logger.Warnw("conntrack flush failed", "err", err)
+		}
+		res.FlowsKilled = killed
 	}
 
-	logger.Infow("fetched Cloudflare IPs", "ipv4", len(ipv4), "ipv6", len(ipv6), "etag", etag)
+	res.Version = reg.Version()
+	res.Duration = time.Since(start)
+	return res, errors.Join(errs...)
+}
+
+// newRegistry sets up the providers feeding each target.
+func newRegistry(cfg Config) *provider.Registry {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	reg := provider.NewRegistry()
+
+	cf := &cloudflare.Client{
+		HTTPClient:  httpClient,
+		APIURL:      cfg.CloudflareAPI,
+		IPv4TextURL: cfg.FallbackIPv4URL,
+		IPv6TextURL: cfg.FallbackIPv6URL,
+	}
+	jd, separate := jdcloudTarget(cfg)
+	if cfg.JDCloud && !separate {
+		cf.Networks = []string{cloudflare.NetworkJDCloud}
+	}
+	if f, err := local.FromURL(cfg.CloudflareAPI); err == nil {
+		reg.Add(mainTarget(cfg), f)
+	} else {
+		reg.Add(mainTarget(cfg), cf)
+	}
+	// Sources were checked by Run.
+	for _, src := range cfg.Sources {
+		if f, err := local.FromURL(src); err == nil {
+			reg.Add(mainTarget(cfg), f)
+		}
+	}
+	if len(cfg.StaticCIDRs) > 0 {
+		reg.Add(mainTarget(cfg), &local.Static{CIDRs: cfg.StaticCIDRs})
+	}
+	if separate {
+		reg.Add(jd, &cloudflare.Client{
+			HTTPClient:   httpClient,
+			APIURL:       cfg.CloudflareAPI,
+			Networks:     []string{cloudflare.NetworkJDCloud},
+			NetworksOnly: true,
+		})
+	}
+	if cfg.AWS.Enabled {
+		reg.Add(provider.Target{IPv4Set: cfg.AWS.IPv4SetName, IPv6Set: cfg.AWS.IPv6SetName}, &aws.Client{
+			HTTPClient: httpClient,
+			URL:        cfg.AWS.URL,
+			Services:   cfg.AWS.Services,
+			Regions:    cfg.AWS.Regions,
+		})
+	}
+	if cfg.GitHub.Enabled {
+		reg.Add(provider.Target{IPv4Set: cfg.GitHub.IPv4SetName, IPv6Set: cfg.GitHub.IPv6SetName}, &github.Client{
+			HTTPClient: httpClient,
+			URL:        cfg.GitHub.URL,
+			Keys:       cfg.GitHub.Keys,
+		})
+	}
+	if cfg.Fastly.Enabled {
+		reg.Add(provider.Target{IPv4Set: cfg.Fastly.IPv4SetName, IPv6Set: cfg.Fastly.IPv6SetName}, &fastly.Client{
+			HTTPClient: httpClient,
+			URL:        cfg.Fastly.URL,
+		})
+	}
+	if cfg.Google.Enabled {
+		reg.Add(provider.Target{IPv4Set: cfg.Google.IPv4SetName, IPv6Set: cfg.Google.IPv6SetName}, &google.Client{
+			HTTPClient: httpClient,
+			URL:        cfg.Google.URL,
+			Scopes:     cfg.Google.Scopes,
+		})
+	}
+	return reg
+}
 
-	fwCfg := firewall.UpdateConfig{
-		IPv4CIDRs:   ipv4,
-		IPv6CIDRs:   ipv6,
+// setConfig is the part of the firewall update that does not depend on the
+// fetched lists.
+func setConfig(cfg Config) firewall.UpdateConfig {
+	return firewall.UpdateConfig{
+		Backend:     cfg.Backend,
+		NFTTable:    cfg.NFTTable,
+		DeltaRatio:  cfg.DeltaRatio,
 		IPv4SetName: cfg.IPv4SetName,
 		IPv6SetName: cfg.IPv6SetName,
+		IPv4Options: cfg.IPv4Options,
+		IPv6Options: cfg.IPv6Options,
+		AdoptSets:   cfg.AdoptSets,
 	}
+}
 
-	if err := updateIPSetsFunc(ctx, fwCfg); err != nil {
-		return updateResult{}, err
+func targetConfig(cfg Config, t provider.Target) firewall.UpdateConfig {
+	c := setConfig(cfg)
+	c.IPv4SetName, c.IPv6SetName = t.IPv4Set, t.IPv6Set
+	return c
+}
+
+func targetOf(c firewall.UpdateConfig) provider.Target {
+	return provider.Target{IPv4Set: c.IPv4SetName, IPv6Set: c.IPv6SetName}
+}
+
+func mainTarget(cfg Config) provider.Target {
+	return provider.Target{IPv4Set: cfg.IPv4SetName, IPv6Set: cfg.IPv6SetName}
+}
+
+// targets lists every set pair the daemon feeds, the main pair first.
+func targets(cfg Config) []provider.Target {
+	return newRegistry(cfg).Targets()
+}
+
+func setConfigs(cfg Config) []firewall.UpdateConfig {
+	var configs []firewall.UpdateConfig
+	for _, t := range targets(cfg) {
+		configs = append(configs, targetConfig(cfg, t))
 	}
+	return configs
+}
 
-	return updateResult{
-		IPv4Count: len(ipv4),
-		IPv6Count: len(ipv6),
-		ETag:      etag,
-		Duration:  time.Since(start),
-	}, nil
+// jdcloudTarget is the separate JD Cloud set pair, if one is named.
+func jdcloudTarget(cfg Config) (provider.Target, bool) {
+	if !cfg.JDCloud || cfg.JDCloudIPv4SetName == "" && cfg.JDCloudIPv6SetName == "" {
+		return provider.Target{}, false
+	}
+	return provider.Target{IPv4Set: cfg.JDCloudIPv4SetName, IPv6Set: cfg.JDCloudIPv6SetName}, true
 }
 
 func markSuccess(stats *updateStats, logger logging.Logger, res updateResult) {
 	stats.LastDuration = res.Duration
-	if res.ETag != "" {
-		stats.LastETag = res.ETag
+	if res.Version != "" {
+		stats.LastVersion = res.Version
 	}
 	stats.LastUpdate = time.Now()
 	stats.Success++
 	stats.ConsecutiveFail = 0
 
 	if res.NotModified {
-		logger.Infow("ipsets unchanged", "etag", res.ETag, "duration", res.Duration)
+		logger.Infow("ipsets unchanged", "version", res.Version, "duration", res.Duration)
 	} else {
 		logger.Infow("ipsets updated successfully",
 			"ipv4", res.IPv4Count,
 			"ipv6", res.IPv6Count,
-			"etag", res.ETag,
+			"added", res.Added,
+			"removed", res.Removed,
+			"swapped", res.Swapped,
+			"flows_killed", res.FlowsKilled,
+			"version", res.Version,
 			"duration", res.Duration)
 	}
 }
 
+// healDrift re-applies the last applied lists when the live sets no longer
+// hold exactly them, e.g. after a manual ipset flush or a restore from an
+// old save file.
+func healDrift(ctx context.Context, logger logging.Logger, stats *updateStats, applied firewall.UpdateConfig) {
+	d, err := checkDriftFunc(ctx, applied)
+	switch {
+	case err != nil:
+		logger.Warnw("set drift detected, sets unreadable", "err", err)
+	case d.InSync():
+		logger.Debugw("sets in sync")
+		return
+	default:
+		logger.Warnw("set drift detected", "set", applied.IPv4SetName, "missing", d.Missing, "extra", d.Extra)
+	}
+	stats.Drift++
+
+	res, err := updateIPSetsFunc(context.WithoutCancel(ctx), applied)
+	if err != nil {
+		markFailure(stats, logger, err)
+		return
+	}
+	logger.Infow("set drift repaired",
+		"added", res.Added,
+		"removed", res.Removed,
+		"swapped", res.Swapped,
+		"drift", stats.Drift)
+}
+
+func logStats(logger logging.Logger, stats *updateStats, attempt int) {
+	logger.Infow("stats",
+		"success", stats.Success,
+		"fail", stats.Fail,
+		"drift", stats.Drift,
+		"retries", stats.Retries,
+		"retry_attempt", attempt,
+		"last_duration", stats.LastDuration,
+		"last_version", stats.LastVersion,
+		"stale", stats.Stale,
+		"last_update", stats.LastUpdate.Format(time.RFC3339),
+		"consecutive_fail", stats.ConsecutiveFail)
+}
+
 func markFailure(stats *updateStats, logger logging.Logger, err error) {
 	stats.Fail++
 	stats.ConsecutiveFail++
@@ -204,6 +797,53 @@ func markFailure(stats *updateStats, logger logging.Logger, err error) {
 		"err", err)
 }
 
+func protectedPorts(cfg Config) []int {
+	if len(cfg.RulePorts) == 0 {
+		return []int{80, 443}
+	}
+	return cfg.RulePorts
+}
+
+func ruleConfig(cfg Config) firewall.RuleConfig {
+	rc := firewall.RuleConfig{
+		Chain:       cfg.RuleChain,
+		Ports:       protectedPorts(cfg),
+		IPv4SetName: cfg.IPv4SetName,
+		IPv6SetName: cfg.IPv6SetName,
+	}
+	for _, t := range targets(cfg)[1:] {
+		rc.ExtraSets = append(rc.ExtraSets, firewall.SetPair{IPv4: t.IPv4Set, IPv6: t.IPv6Set})
+	}
+	return rc
+}
+
+// reconcileRules admits only the extra set pairs in applied. A pair that was
+// never applied may not exist, and a rule naming it would fail the whole
+// chain, DROP included.
+func reconcileRules(ctx context.Context, logger logging.Logger, cfg Config, applied map[provider.Target]firewall.UpdateConfig) {
+	if !cfg.ManageRules {
+		return
+	}
+	rc := ruleConfig(cfg)
+	var extra []firewall.SetPair
+	for _, p := range rc.ExtraSets {
+		if _, ok := applied[provider.Target{IPv4Set: p.IPv4, IPv6Set: p.IPv6}]; !ok {
+			logger.Debugw("set pair not applied yet, leaving it out of the chain", "ipset4", p.IPv4)
+			continue
+		}
+		extra = append(extra, p)
+	}
+	rc.ExtraSets = extra
+	changed, err := ensureRulesFunc(ctx, rc)
+	if err != nil {
+		logger.Warnw("managed rules reconcile failed", "err", err)
+		return
+	}
+	if changed {
+		logger.Infow("managed rules reconciled", "chain", ruleConfig(cfg).Chain)
+	}
+}
+
 func persistState(ctx context.Context, logger logging.Logger) error {
 	if err := runCmd(ctx, "netfilter-persistent", "save"); err != nil {
 		logger.Warnw("iptables and ipset (netfilter-persistent) save failed", "err", err)
@@ -2,13 +2,17 @@ package daemon
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
-	"github.com/Ringyuki/cf-ip-guard/internal/cloudflare"
 	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
 	"go.uber.org/zap"
 )
 
@@ -30,33 +34,36 @@ func TestUpdateOnceSuccess(t *testing.T) {
 	called := false
 	var gotCfg firewall.UpdateConfig
 	orig := updateIPSetsFunc
-	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) error {
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
 		called = true
 		gotCfg = cfg
-		return nil
+		return firewall.UpdateResult{Added: 2, Removed: 1}, nil
 	}
 	defer func() { updateIPSetsFunc = orig }()
 
-	client := &cloudflare.Client{APIURL: ts.URL}
 	cfg := Config{
-		IPv4SetName: "v4",
-		IPv6SetName: "v6",
-		Logger:      zap.NewNop().Sugar(),
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: ts.URL,
+		Logger:        zap.NewNop().Sugar(),
 	}
 
-	res, err := updateOnce(context.Background(), cfg.Logger, client, cfg, "")
+	res, err := updateOnce(context.Background(), cfg.Logger, newRegistry(cfg), cfg)
 	if err != nil {
 		t.Fatalf("updateOnce error: %v", err)
 	}
 	if res.NotModified {
 		t.Fatalf("expected NotModified=false")
 	}
-	if res.ETag != "etag-123" {
-		t.Fatalf("unexpected etag: %s", res.ETag)
+	if res.Version != "cloudflare=etag-123" {
+		t.Fatalf("unexpected version: %s", res.Version)
 	}
 	if res.IPv4Count != 2 || res.IPv6Count != 1 {
 		t.Fatalf("unexpected counts: v4=%d v6=%d", res.IPv4Count, res.IPv6Count)
 	}
+	if res.Added != 2 || res.Removed != 1 {
+		t.Fatalf("unexpected delta: added=%d removed=%d", res.Added, res.Removed)
+	}
 	if !called {
 		t.Fatalf("expected updateIPSetsFunc to be called")
 	}
@@ -72,41 +79,453 @@ func TestUpdateOnceSuccess(t *testing.T) {
 }
 
 func TestUpdateOnceNotModified(t *testing.T) {
-	const prevETag = "etag-prev"
+	const etag = "etag-prev"
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if got := r.Header.Get("If-None-Match"); got != prevETag {
-			t.Fatalf("expected If-None-Match %q, got %q", prevETag, got)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
-		w.WriteHeader(http.StatusNotModified)
+		_, _ = w.Write([]byte(`{"success": true, "result": {"ipv4_cidrs": ["1.1.1.0/24"], "ipv6_cidrs": [], "etag": "` + etag + `"}}`))
 	}))
 	defer ts.Close()
 
-	called := false
+	calls := 0
 	orig := updateIPSetsFunc
-	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) error {
-		called = true
-		return nil
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		calls++
+		return firewall.UpdateResult{}, nil
 	}
 	defer func() { updateIPSetsFunc = orig }()
 
-	client := &cloudflare.Client{APIURL: ts.URL}
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: ts.URL,
+		Logger:        zap.NewNop().Sugar(),
+	}
+	reg := newRegistry(cfg)
+
+	if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	res, err := updateOnce(context.Background(), cfg.Logger, reg, cfg)
+	if err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	if !res.NotModified {
+		t.Fatalf("expected NotModified=true")
+	}
+	if res.Version != "cloudflare="+etag {
+		t.Fatalf("version should carry the applied etag: %s", res.Version)
+	}
+	if calls != 1 {
+		t.Fatalf("updateIPSetsFunc should not be called on 304, got %d calls", calls)
+	}
+}
+
+func TestUpdateOnceRetriesFailedApply(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			t.Fatalf("version should not advance after a failed update")
+		}
+		_, _ = w.Write([]byte(`{"success": true, "result": {"ipv4_cidrs": ["1.1.1.0/24"], "ipv6_cidrs": [], "etag": "e"}}`))
+	}))
+	defer ts.Close()
+
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		return firewall.UpdateResult{}, errors.New("ipset restore failed")
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{IPv4SetName: "v4", IPv6SetName: "v6", CloudflareAPI: ts.URL, Logger: zap.NewNop().Sugar()}
+	reg := newRegistry(cfg)
+	for i := 0; i < 2; i++ {
+		if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); err == nil {
+			t.Fatalf("expected update error")
+		}
+	}
+}
+
+func TestReconcileRules(t *testing.T) {
+	var got []firewall.RuleConfig
+	orig := ensureRulesFunc
+	ensureRulesFunc = func(ctx context.Context, cfg firewall.RuleConfig) (bool, error) {
+		got = append(got, cfg)
+		return true, nil
+	}
+	defer func() { ensureRulesFunc = orig }()
+
 	cfg := Config{
 		IPv4SetName: "v4",
 		IPv6SetName: "v6",
+		RulePorts:   []int{443},
 		Logger:      zap.NewNop().Sugar(),
 	}
 
-	res, err := updateOnce(context.Background(), cfg.Logger, client, cfg, prevETag)
+	reconcileRules(context.Background(), cfg.Logger, cfg, nil)
+	if len(got) != 0 {
+		t.Fatalf("rules should not be touched without ManageRules")
+	}
+
+	cfg.ManageRules = true
+	reconcileRules(context.Background(), cfg.Logger, cfg, nil)
+	if len(got) != 1 {
+		t.Fatalf("expected one reconcile, got %d", len(got))
+	}
+	if got[0].IPv4SetName != "v4" || got[0].IPv6SetName != "v6" || len(got[0].Ports) != 1 || got[0].Ports[0] != 443 {
+		t.Fatalf("unexpected rule config: %+v", got[0])
+	}
+
+	// A pair whose sets may not exist yet is left out, so the chain and its
+	// DROP still go in; it is admitted once applied.
+	cfg.AWS = AWSConfig{Enabled: true, IPv4SetName: "aws4", IPv6SetName: "aws6"}
+	applied := map[provider.Target]firewall.UpdateConfig{mainTarget(cfg): {}}
+	reconcileRules(context.Background(), cfg.Logger, cfg, applied)
+	if len(got) != 2 || len(got[1].ExtraSets) != 0 {
+		t.Fatalf("unapplied set pair admitted: %+v", got[1:])
+	}
+	applied[provider.Target{IPv4Set: "aws4", IPv6Set: "aws6"}] = firewall.UpdateConfig{}
+	reconcileRules(context.Background(), cfg.Logger, cfg, applied)
+	if len(got) != 3 || len(got[2].ExtraSets) != 1 || got[2].ExtraSets[0].IPv4 != "aws4" {
+		t.Fatalf("applied set pair not admitted: %+v", got[2:])
+	}
+}
+
+func TestUpdateOnceFlushesConntrack(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"success": true, "result": {"ipv4_cidrs": ["1.1.1.0/24"], "ipv6_cidrs": [], "etag": "e"}}`))
+	}))
+	defer ts.Close()
+
+	origUpdate := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		return firewall.UpdateResult{Removed: 1, RemovedCIDRs: []string{"1.0.0.0/24"}}, nil
+	}
+	defer func() { updateIPSetsFunc = origUpdate }()
+
+	var gotRemoved []string
+	var gotPorts []int
+	origFlush := flushConntrackFunc
+	flushConntrackFunc = func(ctx context.Context, removed []string, ports []int) (int, error) {
+		gotRemoved, gotPorts = removed, ports
+		return 4, nil
+	}
+	defer func() { flushConntrackFunc = origFlush }()
+
+	cfg := Config{
+		IPv4SetName:    "v4",
+		IPv6SetName:    "v6",
+		CloudflareAPI:  ts.URL,
+		FlushConntrack: true,
+		Logger:         zap.NewNop().Sugar(),
+	}
+
+	res, err := updateOnce(context.Background(), cfg.Logger, newRegistry(cfg), cfg)
 	if err != nil {
 		t.Fatalf("updateOnce error: %v", err)
 	}
-	if !res.NotModified {
-		t.Fatalf("expected NotModified=true")
+	if res.FlowsKilled != 4 {
+		t.Fatalf("unexpected flows killed: %d", res.FlowsKilled)
+	}
+	if len(gotRemoved) != 1 || gotRemoved[0] != "1.0.0.0/24" {
+		t.Fatalf("unexpected removed prefixes: %v", gotRemoved)
+	}
+	if len(gotPorts) != 2 || gotPorts[0] != 80 || gotPorts[1] != 443 {
+		t.Fatalf("unexpected ports: %v", gotPorts)
+	}
+}
+
+func TestHealDrift(t *testing.T) {
+	drift := firewall.Drift{}
+	origDrift := checkDriftFunc
+	checkDriftFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.Drift, error) {
+		return drift, nil
+	}
+	defer func() { checkDriftFunc = origDrift }()
+
+	var applied []firewall.UpdateConfig
+	origUpdate := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		applied = append(applied, cfg)
+		return firewall.UpdateResult{Added: 1}, nil
+	}
+	defer func() { updateIPSetsFunc = origUpdate }()
+
+	logger := zap.NewNop().Sugar()
+	stats := &updateStats{}
+	last := firewall.UpdateConfig{IPv4SetName: "v4", IPv4CIDRs: []string{"1.1.1.0/24"}}
+
+	healDrift(context.Background(), logger, stats, last)
+	if len(applied) != 0 || stats.Drift != 0 {
+		t.Fatalf("sets in sync should not be re-applied")
+	}
+
+	drift = firewall.Drift{Missing: 1}
+	healDrift(context.Background(), logger, stats, last)
+	if len(applied) != 1 || stats.Drift != 1 {
+		t.Fatalf("expected one re-apply and drift event, got %d applies, drift=%d", len(applied), stats.Drift)
+	}
+	if applied[0].IPv4SetName != "v4" || len(applied[0].IPv4CIDRs) != 1 {
+		t.Fatalf("unexpected re-applied config: %+v", applied[0])
+	}
+}
+
+func TestUpdateOnceJDCloudSets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"success": true, "result": {
+			"ipv4_cidrs": ["1.1.1.0/24"],
+			"ipv6_cidrs": ["2606:4700::/32"],
+			"jdcloud_cidrs": ["1.2.3.0/24", "2400:cb00::/32"],
+			"etag": "e"}}`))
+	}))
+	defer ts.Close()
+
+	var got []firewall.UpdateConfig
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		got = append(got, cfg)
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: ts.URL,
+		JDCloud:       true,
+		Logger:        zap.NewNop().Sugar(),
+	}
+
+	if _, err := updateOnce(context.Background(), cfg.Logger, newRegistry(cfg), cfg); err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	if len(got) != 1 || len(got[0].IPv4CIDRs) != 2 || len(got[0].IPv6CIDRs) != 2 {
+		t.Fatalf("jdcloud ranges should be merged into the main sets: %+v", got)
+	}
+
+	got = nil
+	cfg.JDCloudIPv4SetName, cfg.JDCloudIPv6SetName = "jd4", "jd6"
+	res, err := updateOnce(context.Background(), cfg.Logger, newRegistry(cfg), cfg)
+	if err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	if len(got) != 2 || len(res.Applied) != 2 {
+		t.Fatalf("expected two set pairs, got %d", len(got))
+	}
+	if len(got[0].IPv4CIDRs) != 1 || got[1].IPv4SetName != "jd4" || got[1].IPv4CIDRs[0] != "1.2.3.0/24" || got[1].IPv6CIDRs[0] != "2400:cb00::/32" {
+		t.Fatalf("unexpected set pairs: %+v", got)
+	}
+	if rc := ruleConfig(cfg); len(rc.ExtraSets) != 1 || rc.ExtraSets[0].IPv4 != "jd4" {
+		t.Fatalf("rules should admit the jdcloud sets: %+v", rc)
+	}
+}
+
+func TestTargetsAWS(t *testing.T) {
+	cfg := Config{
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		AWS:         AWSConfig{Enabled: true, IPv4SetName: "aws4", IPv6SetName: "aws6"},
+	}
+	if ts := targets(cfg); len(ts) != 2 || ts[1].IPv4Set != "aws4" {
+		t.Fatalf("expected a separate aws pair: %+v", ts)
+	}
+	if rc := ruleConfig(cfg); len(rc.ExtraSets) != 1 || rc.ExtraSets[0].IPv6 != "aws6" {
+		t.Fatalf("rules should admit the aws sets: %+v", rc)
 	}
-	if res.ETag != prevETag {
-		t.Fatalf("etag should carry prev: %s", res.ETag)
+
+	cfg.AWS.IPv4SetName, cfg.AWS.IPv6SetName = "v4", "v6"
+	if ts := targets(cfg); len(ts) != 1 {
+		t.Fatalf("aws ranges should merge into the main pair: %+v", ts)
+	}
+}
+
+func TestTargetsPerProvider(t *testing.T) {
+	cfg := Config{
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		Fastly:      FastlyConfig{Enabled: true, IPv4SetName: "fastly4", IPv6SetName: "fastly6"},
+		Google:      GoogleConfig{Enabled: true, IPv4SetName: "google4", IPv6SetName: "google6"},
+	}
+	ts := targets(cfg)
+	if len(ts) != 3 || ts[1].IPv4Set != "fastly4" || ts[2].IPv6Set != "google6" {
+		t.Fatalf("expected one pair per provider: %+v", ts)
+	}
+}
+
+func TestUpdateOnceLocalSources(t *testing.T) {
+	dir := t.TempDir()
+	api := filepath.Join(dir, "ips.json")
+	extra := filepath.Join(dir, "extra.txt")
+	if err := os.WriteFile(api, []byte(`{"success": true, "result": {"ipv4_cidrs": ["1.1.1.0/24"], "ipv6_cidrs": []}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(extra, []byte("# monitoring\n198.51.100.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []firewall.UpdateConfig
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		got = append(got, cfg)
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + api,
+		Sources:       []string{"file://" + extra},
+		StaticCIDRs:   []string{"192.0.2.10/32", "2001:db8::/32"},
+		Logger:        zap.NewNop().Sugar(),
+	}
+	reg := newRegistry(cfg)
+	if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	if len(got) != 1 || len(got[0].IPv4CIDRs) != 3 || len(got[0].IPv6CIDRs) != 1 {
+		t.Fatalf("local sources should merge into the main sets: %+v", got)
+	}
+
+	res, err := updateOnce(context.Background(), cfg.Logger, reg, cfg)
+	if err != nil || !res.NotModified || len(got) != 1 {
+		t.Fatalf("unchanged files should not be re-applied: %+v err=%v", res, err)
+	}
+}
+
+func TestUpdateOnceNormalizes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	text := "10.0.1.0/24\n10.0.0.0/24\nbogus\n10.0.0.0/24\n192.0.2.1\n"
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []firewall.UpdateConfig
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		got = append(got, cfg)
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + path,
+		Logger:        zap.NewNop().Sugar(),
+	}
+	if _, err := updateOnce(context.Background(), cfg.Logger, newRegistry(cfg), cfg); err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].IPv4CIDRs, []string{"10.0.0.0/24", "10.0.1.0/24", "192.0.2.1/32"}) {
+		t.Fatalf("unexpected sets: %+v", got)
+	}
+
+	cfg.Aggregate = true
+	got = nil
+	if _, err := updateOnce(context.Background(), cfg.Logger, newRegistry(cfg), cfg); err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].IPv4CIDRs, []string{"10.0.0.0/23", "192.0.2.1/32"}) {
+		t.Fatalf("unexpected aggregated sets: %+v", got)
+	}
+}
+
+func TestRunReloadResyncShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/24\n2001:db8::/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(chan firewall.UpdateConfig)
+	origUpdate, origCheck := updateIPSetsFunc, checkBackendFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		if ctx.Err() != nil {
+			t.Errorf("apply started with a cancelled context")
+		}
+		applied <- cfg
+		return firewall.UpdateResult{}, nil
+	}
+	checkBackendFunc = func(ctx context.Context, backend string) error { return nil }
+	defer func() { updateIPSetsFunc, checkBackendFunc = origUpdate, origCheck }()
+
+	reload := make(chan Config)
+	resync := make(chan struct{})
+	cfg := Config{
+		Interval:      time.Hour,
+		Backend:       firewall.BackendNFT,
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + path,
+		Reload:        reload,
+		Resync:        resync,
+		Logger:        zap.NewNop().Sugar(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Run(ctx, cfg) }()
+
+	if got := <-applied; len(got.IPv4CIDRs) != 1 {
+		t.Fatalf("unexpected initial apply: %+v", got)
+	}
+
+	// The file is unchanged, so only a forced resync applies it again.
+	resync <- struct{}{}
+	if got := <-applied; len(got.IPv4CIDRs) != 1 {
+		t.Fatalf("unexpected resync apply: %+v", got)
+	}
+
+	next := cfg
+	next.StaticCIDRs = []string{"192.0.2.0/24"}
+	reload <- next
+	if got := <-applied; len(got.IPv4CIDRs) != 2 {
+		t.Fatalf("reloaded configuration not applied: %+v", got)
+	}
+
+	next.Backend = firewall.BackendIPSet
+	reload <- next
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned %v, want context.Canceled", err)
+	}
+}
+
+func TestReloadRejectsRestartOnlySettings(t *testing.T) {
+	cur := Config{IPv4SetName: "v4", IPv6SetName: "v6", StateDir: "/var/lib/a"}
+	if _, err := prepare(&cur); err != nil {
+		t.Fatal(err)
+	}
+	next := cur
+	next.StateDir = "/var/lib/b"
+	if _, _, err := reload(cur, next); err == nil {
+		t.Fatalf("expected error for a new state directory")
+	}
+	next = cur
+	next.Schedule = "bogus"
+	if _, _, err := reload(cur, next); err == nil {
+		t.Fatalf("expected error for an invalid schedule")
+	}
+	next = cur
+	next.Jitter = -time.Second
+	if _, _, err := reload(cur, next); err == nil {
+		t.Fatalf("expected error for a negative jitter")
+	}
+	next = cur
+	next.Interval = time.Minute
+	got, _, err := reload(cur, next)
+	if err != nil || got.Interval != time.Minute {
+		t.Fatalf("reload = %+v, %v", got, err)
+	}
+}
+
+func TestPrepareRejectsNegativeJitter(t *testing.T) {
+	cfg := Config{Jitter: -time.Second}
+	if _, err := prepare(&cfg); err == nil {
+		t.Fatal("expected error for a negative jitter")
 	}
-	if called {
-		t.Fatalf("updateIPSetsFunc should not be called on 304")
+	cfg = Config{}
+	if _, err := prepare(&cfg); err != nil {
+		t.Fatalf("zero jitter rejected: %v", err)
 	}
 }
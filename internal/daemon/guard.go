@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/local"
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+// GuardConfig holds the checks an update must pass before it is applied,
+// so that an empty or truncated list never replaces a good one. Zero
+// values disable a check.
+type GuardConfig struct {
+	// MinIPv4 and MinIPv6 are the fewest entries the main sets may hold,
+	// for the families their sources are expected to serve (see guardFor).
+	MinIPv4 int
+	MinIPv6 int
+	// MaxRemovePercent caps the share of a set's entries that one update
+	// may remove. It applies to every set.
+	MaxRemovePercent float64
+	// Anchors are prefixes the main sets must keep covering.
+	Anchors []string
+	// Override applies refused updates anyway.
+	Override bool
+}
+
+// overrideFile in the state directory lets the next refused update through.
+const overrideFile = "guard-override"
+
+var errRefused = errors.New("update refused by guard")
+
+// guardFor returns the guard for update u. The Cloudflare API serves both
+// families; a local main list may hold only one, so there a family's
+// minimum only applies once the sets held that family or a static range
+// of it is configured.
+func guardFor(cfg Config, u *provider.Update) GuardConfig {
+	g := cfg.Guard
+	if !local.IsFileURL(cfg.CloudflareAPI) {
+		return g
+	}
+	static4, static6, _ := provider.ParsePrefixes(cfg.StaticCIDRs)
+	if len(u.PrevIPv4) == 0 && len(static4) == 0 {
+		g.MinIPv4 = 0
+	}
+	if len(u.PrevIPv6) == 0 && len(static6) == 0 {
+		g.MinIPv6 = 0
+	}
+	return g
+}
+
+// checkGuard returns why applying u would be unsafe, or nil. Anchors and
+// minimum counts only apply to the main sets.
+func checkGuard(g GuardConfig, main bool, u *provider.Update) error {
+	ipv4 := provider.Normalize(u.IPv4, false)
+	ipv6 := provider.Normalize(u.IPv6, false)
+
+	var problems []string
+	if main {
+		if len(ipv4) < g.MinIPv4 {
+			problems = append(problems, fmt.Sprintf("%d IPv4 entries, want at least %d", len(ipv4), g.MinIPv4))
+		}
+		if len(ipv6) < g.MinIPv6 {
+			problems = append(problems, fmt.Sprintf("%d IPv6 entries, want at least %d", len(ipv6), g.MinIPv6))
+		}
+		for _, a := range g.Anchors {
+			anchor, err := netip.ParsePrefix(a)
+			if err != nil {
+				return fmt.Errorf("guard anchor %q: %w", a, err)
+			}
+			list := ipv4
+			if anchor.Addr().Is6() {
+				list = ipv6
+			}
+			if !covers(list, anchor.Masked()) {
+				problems = append(problems, "anchor "+a+" missing")
+			}
+		}
+	}
+	if g.MaxRemovePercent > 0 {
+		for _, fam := range []struct {
+			name      string
+			prev, cur []netip.Prefix
+		}{
+			{"IPv4", u.PrevIPv4, ipv4},
+			{"IPv6", u.PrevIPv6, ipv6},
+		} {
+			prev := provider.Normalize(fam.prev, false)
+			if len(prev) == 0 {
+				continue
+			}
+			pct := float64(removedCount(prev, fam.cur)) * 100 / float64(len(prev))
+			if pct > g.MaxRemovePercent {
+				problems = append(problems, fmt.Sprintf("%.0f%% of %s entries removed, at most %.0f%% allowed", pct, fam.name, g.MaxRemovePercent))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w for %s/%s: %s", errRefused, u.Target.IPv4Set, u.Target.IPv6Set, strings.Join(problems, "; "))
+}
+
+func covers(list []netip.Prefix, p netip.Prefix) bool {
+	for _, q := range list {
+		if q.Bits() <= p.Bits() && q.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// removedCount counts the entries of prev that cur no longer has. Both
+// lists are normalized.
+func removedCount(prev, cur []netip.Prefix) int {
+	keep := make(map[netip.Prefix]bool, len(cur))
+	for _, p := range cur {
+		keep[p] = true
+	}
+	n := 0
+	for _, p := range prev {
+		if !keep[p] {
+			n++
+		}
+	}
+	return n
+}
+
+// takeOverride reports whether an operator asked to let the next refused
+// update through, and clears the request.
+func takeOverride(stateDir string) bool {
+	if stateDir == "" {
+		return false
+	}
+	return os.Remove(filepath.Join(stateDir, overrideFile)) == nil
+}
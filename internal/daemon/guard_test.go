@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+	"go.uber.org/zap"
+)
+
+func prefixes(cidrs ...string) []netip.Prefix {
+	out := make([]netip.Prefix, len(cidrs))
+	for i, c := range cidrs {
+		out[i] = netip.MustParsePrefix(c)
+	}
+	return out
+}
+
+func TestCheckGuard(t *testing.T) {
+	prev4 := prefixes("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24")
+	prev6 := prefixes("2001:db8::/32")
+
+	cases := []struct {
+		name  string
+		g     GuardConfig
+		main  bool
+		ipv4  []netip.Prefix
+		ipv6  []netip.Prefix
+		fails string
+	}{
+		{"ok", GuardConfig{MinIPv4: 1, MinIPv6: 1, MaxRemovePercent: 50}, true, prev4, prev6, ""},
+		{"empty ipv4", GuardConfig{MinIPv4: 1}, true, nil, prev6, "0 IPv4 entries"},
+		{"min only on main", GuardConfig{MinIPv4: 1}, false, nil, prev6, ""},
+		{"shrunk", GuardConfig{MaxRemovePercent: 50}, false, prev4[:1], prev6, "75% of IPv4"},
+		{"half removed", GuardConfig{MaxRemovePercent: 50}, true, prev4[2:], prev6, ""},
+		{"ipv6 emptied", GuardConfig{MaxRemovePercent: 50}, true, prev4, nil, "100% of IPv6"},
+		{"anchor covered", GuardConfig{Anchors: []string{"10.0.1.128/25"}}, true, prefixes("10.0.0.0/16"), nil, ""},
+		{"anchor missing", GuardConfig{Anchors: []string{"2001:db8::/32"}}, true, prev4, nil, "anchor 2001:db8::/32 missing"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &provider.Update{
+				Target:   provider.Target{IPv4Set: "v4", IPv6Set: "v6"},
+				IPv4:     tc.ipv4,
+				IPv6:     tc.ipv6,
+				PrevIPv4: prev4,
+				PrevIPv6: prev6,
+			}
+			err := checkGuard(tc.g, tc.main, u)
+			switch {
+			case tc.fails == "" && err != nil:
+				t.Fatalf("unexpected refusal: %v", err)
+			case tc.fails != "" && (!errors.Is(err, errRefused) || !strings.Contains(err.Error(), tc.fails)):
+				t.Fatalf("err = %v, want refusal with %q", err, tc.fails)
+			}
+		})
+	}
+}
+
+func TestCheckGuardFirstUpdate(t *testing.T) {
+	u := &provider.Update{IPv4: prefixes("10.0.0.0/24")}
+	if err := checkGuard(GuardConfig{MaxRemovePercent: 1}, true, u); err != nil {
+		t.Fatalf("nothing can be removed before the first commit: %v", err)
+	}
+}
+
+func TestGuardFor(t *testing.T) {
+	g := GuardConfig{MinIPv4: 1, MinIPv6: 1}
+	cases := []struct {
+		name       string
+		api        string
+		static     []string
+		prev4      []netip.Prefix
+		prev6      []netip.Prefix
+		min4, min6 int
+	}{
+		{"cloudflare api", "https://api.cloudflare.com/client/v4/ips", nil, nil, nil, 1, 1},
+		{"local list", "file:///etc/ranges.txt", nil, nil, nil, 0, 0},
+		{"local list held ipv4", "file:///etc/ranges.txt", nil, prefixes("10.0.0.0/24"), nil, 1, 0},
+		{"static ipv6", "file:///etc/ranges.txt", []string{"2001:db8::/32"}, nil, nil, 0, 1},
+	}
+	for _, tc := range cases {
+		cfg := Config{CloudflareAPI: tc.api, StaticCIDRs: tc.static, Guard: g}
+		got := guardFor(cfg, &provider.Update{PrevIPv4: tc.prev4, PrevIPv6: tc.prev6})
+		if got.MinIPv4 != tc.min4 || got.MinIPv6 != tc.min6 {
+			t.Errorf("%s: minimums %d/%d, want %d/%d", tc.name, got.MinIPv4, got.MinIPv6, tc.min4, tc.min6)
+		}
+	}
+}
+
+// An IPv4-only local list passes the default minimums.
+func TestUpdateOnceGuardLocalSingleFamily(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + path,
+		Guard:         GuardConfig{MinIPv4: 1, MinIPv6: 1},
+		Logger:        zap.NewNop().Sugar(),
+	}
+	res, err := updateOnce(context.Background(), cfg.Logger, newRegistry(cfg), cfg)
+	if err != nil || len(res.Applied) != 1 {
+		t.Fatalf("IPv4-only list refused: %+v, %v", res, err)
+	}
+}
+
+func TestUpdateOnceGuardRefuses(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ranges.txt")
+	write := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("10.0.0.0/24\n10.0.1.0/24\n2001:db8::/32\n")
+
+	var got []firewall.UpdateConfig
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		got = append(got, cfg)
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + path,
+		Guard:         GuardConfig{MinIPv4: 1, MinIPv6: 1},
+		Logger:        zap.NewNop().Sugar(),
+	}
+	reg := newRegistry(cfg)
+	if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+
+	// The size changes, so the file is read again even within one mtime tick.
+	write("10.0.0.0/24\n")
+	if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); !errors.Is(err, errRefused) {
+		t.Fatalf("expected refusal, got %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("refused update was applied: %+v", got)
+	}
+
+	cfg.Guard.Override = true
+	if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); err != nil {
+		t.Fatalf("override should apply the update: %v", err)
+	}
+	if len(got) != 2 || len(got[1].IPv6CIDRs) != 0 {
+		t.Fatalf("overridden update not applied: %+v", got)
+	}
+}
+
+func TestTakeOverride(t *testing.T) {
+	dir := t.TempDir()
+	if takeOverride(dir) || takeOverride("") {
+		t.Fatalf("no override was requested")
+	}
+	if err := os.WriteFile(filepath.Join(dir, overrideFile), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !takeOverride(dir) {
+		t.Fatalf("override file not honoured")
+	}
+	if takeOverride(dir) {
+		t.Fatalf("override should only apply once")
+	}
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/logging"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// HookConfig names shell commands run after update cycles. They get the
+// outcome in CF_IP_GUARD_* environment variables.
+type HookConfig struct {
+	// OnUpdate runs after a cycle that changed at least one set pair.
+	OnUpdate []string
+	// OnFailure runs after a failed cycle.
+	OnFailure []string
+	Timeout   time.Duration
+}
+
+var runHookFunc = runHook
+
+func runHook(ctx context.Context, command string, env []string) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	// Children left behind by a killed hook must not hold up the daemon.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runHooks runs commands one after another. A failing hook is logged and
+// does not stop the others, and a shutdown does not cut one short.
+func runHooks(ctx context.Context, logger logging.Logger, hc HookConfig, event string, commands, env []string) {
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	env = append([]string{"CF_IP_GUARD_EVENT=" + event}, env...)
+	for _, c := range commands {
+		hookCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		err := runHookFunc(hookCtx, c, env)
+		cancel()
+		if err != nil {
+			logger.Warnw("hook failed", "event", event, "command", c, "err", err)
+			continue
+		}
+		logger.Debugw("hook finished", "event", event, "command", c)
+	}
+}
+
+func updateHookEnv(res updateResult) []string {
+	var sets []string
+	for _, a := range res.Applied {
+		for _, name := range []string{a.IPv4SetName, a.IPv6SetName} {
+			if name != "" {
+				sets = append(sets, name)
+			}
+		}
+	}
+	return []string{
+		"CF_IP_GUARD_SETS=" + strings.Join(sets, ","),
+		"CF_IP_GUARD_VERSION=" + res.Version,
+		"CF_IP_GUARD_ADDED=" + strconv.Itoa(res.Added),
+		"CF_IP_GUARD_REMOVED=" + strconv.Itoa(res.Removed),
+	}
+}
+
+func failureHookEnv(stats *updateStats, err error) []string {
+	return []string{
+		"CF_IP_GUARD_ERROR=" + err.Error(),
+		"CF_IP_GUARD_CONSECUTIVE_FAIL=" + strconv.FormatUint(stats.ConsecutiveFail, 10),
+	}
+}
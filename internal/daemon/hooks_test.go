@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/logging"
+	"go.uber.org/zap"
+)
+
+func TestRunHooks(t *testing.T) {
+	type call struct {
+		command string
+		env     []string
+	}
+	var calls []call
+	orig := runHookFunc
+	runHookFunc = func(ctx context.Context, command string, env []string) error {
+		if ctx.Err() != nil {
+			t.Errorf("hook %q started with a done context", command)
+		}
+		calls = append(calls, call{command, env})
+		if command == "false" {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+	defer func() { runHookFunc = orig }()
+
+	// A shutdown in progress does not cancel hooks.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := updateResult{
+		Version: "v2",
+		Added:   3,
+		Removed: 1,
+		Applied: []firewall.UpdateConfig{
+			{IPv4SetName: "cloudflare4", IPv6SetName: "cloudflare6"},
+			{IPv4SetName: "aws4"},
+		},
+	}
+	runHooks(ctx, logging.L(), HookConfig{}, "update", []string{"false", "true"}, updateHookEnv(res))
+
+	wantEnv := []string{
+		"CF_IP_GUARD_EVENT=update",
+		"CF_IP_GUARD_SETS=cloudflare4,cloudflare6,aws4",
+		"CF_IP_GUARD_VERSION=v2",
+		"CF_IP_GUARD_ADDED=3",
+		"CF_IP_GUARD_REMOVED=1",
+	}
+	want := []call{{"false", wantEnv}, {"true", wantEnv}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %+v, want %+v", calls, want)
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	err := runHook(context.Background(), `printf %s "$CF_IP_GUARD_EVENT" > "$OUT"`,
+		[]string{"CF_IP_GUARD_EVENT=failure", "OUT=" + out})
+	if err != nil {
+		t.Fatalf("runHook error: %v", err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "failure" {
+		t.Errorf("hook saw event %q, want failure", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := runHook(ctx, "sleep 5", nil); err == nil {
+		t.Error("runHook ignored its timeout")
+	}
+}
+
+// An update cut short by a shutdown is neither a failure nor a reason to
+// run the failure hooks.
+func TestRunSkipsFailureHooksWhenCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/24\n2001:db8::/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var hooks []string
+	origUpdate, origCheck, origHook := updateIPSetsFunc, checkBackendFunc, runHookFunc
+	updateIPSetsFunc = func(context.Context, firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		cancel()
+		return firewall.UpdateResult{}, fmt.Errorf("apply: %w", context.Canceled)
+	}
+	checkBackendFunc = func(context.Context, string) error { return nil }
+	runHookFunc = func(ctx context.Context, command string, env []string) error {
+		hooks = append(hooks, command)
+		return nil
+	}
+	defer func() { updateIPSetsFunc, checkBackendFunc, runHookFunc = origUpdate, origCheck, origHook }()
+
+	stateDir := t.TempDir()
+	cfg := Config{
+		Once:          true,
+		Backend:       firewall.BackendNFT,
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + path,
+		StateDir:      stateDir,
+		Hooks:         HookConfig{OnFailure: []string{"notify"}},
+		Logger:        zap.NewNop().Sugar(),
+	}
+	if err := Run(ctx, cfg); err != nil {
+		t.Fatalf("Run error: %v", err)
+	}
+	if len(hooks) != 0 {
+		t.Errorf("hooks ran after a cancelled update: %v", hooks)
+	}
+	var st struct{ Stats updateStats }
+	if b, err := os.ReadFile(filepath.Join(stateDir, stateFile)); err == nil {
+		if err := json.Unmarshal(b, &st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st.Stats.Fail != 0 || st.Stats.ConsecutiveFail != 0 {
+		t.Errorf("cancelled update counted as a failure: %+v", st.Stats)
+	}
+}
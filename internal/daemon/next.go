@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+	"github.com/Ringyuki/cf-ip-guard/internal/schedule"
+)
+
+// maxCacheWait bounds how far caching headers can push the next fetch out.
+const maxCacheWait = 24 * time.Hour
+
+// nextFetch plans the next regular cycle: at the next cron time when sched
+// is set, else one interval from now, but not before freshUntil, when the
+// caching headers of the last answers allow a change. Random jitter spreads
+// hosts that started together.
+func nextFetch(cfg Config, sched *schedule.Cron, now, freshUntil time.Time) time.Time {
+	if limit := now.Add(maxCacheWait); freshUntil.After(limit) {
+		freshUntil = limit
+	}
+	from := now
+	if freshUntil.After(from) {
+		from = freshUntil
+	}
+
+	var next time.Time
+	switch {
+	case sched != nil:
+		next = sched.Next(from)
+		if next.IsZero() {
+			next = from.Add(cfg.Interval)
+		}
+	case freshUntil.After(now.Add(cfg.Interval)):
+		next = freshUntil
+	default:
+		next = now.Add(cfg.Interval)
+	}
+	return next.Add(jitter(cfg.Jitter))
+}
+
+// freshUntil is when the first of the fetched lists may change. A provider
+// that failed or sent no caching headers has to be asked on schedule, so
+// the result is zero then.
+func freshUntil(fetched []provider.Fetched) time.Time {
+	var out time.Time
+	for _, f := range fetched {
+		if f.Err != nil || f.Result.FreshUntil.IsZero() {
+			return time.Time{}
+		}
+		out = provider.Earliest(out, f.Result.FreshUntil)
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+	"github.com/Ringyuki/cf-ip-guard/internal/schedule"
+)
+
+func TestNextFetch(t *testing.T) {
+	orig := jitter
+	jitter = func(d time.Duration) time.Duration { return d }
+	defer func() { jitter = orig }()
+
+	now := time.Date(2026, 10, 17, 10, 7, 0, 0, time.UTC)
+	cfg := Config{Interval: 30 * time.Minute, Jitter: time.Minute}
+	cron, err := schedule.Parse("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		sched *schedule.Cron
+		fresh time.Time
+		want  time.Time
+	}{
+		{"interval", nil, time.Time{}, now.Add(31 * time.Minute)},
+		{"fresh sooner than interval", nil, now.Add(5 * time.Minute), now.Add(31 * time.Minute)},
+		{"fresh later than interval", nil, now.Add(2 * time.Hour), now.Add(2*time.Hour + time.Minute)},
+		{"fresh capped", nil, now.Add(72 * time.Hour), now.Add(maxCacheWait + time.Minute)},
+		{"cron", cron, time.Time{}, time.Date(2026, 10, 17, 11, 1, 0, 0, time.UTC)},
+		{"cron after fresh", cron, now.Add(2 * time.Hour), time.Date(2026, 10, 17, 13, 1, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		if got := nextFetch(cfg, tc.sched, now, tc.fresh); !got.Equal(tc.want) {
+			t.Errorf("%s: nextFetch = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFreshUntil(t *testing.T) {
+	soon := time.Unix(100, 0)
+	later := time.Unix(200, 0)
+	fetched := []provider.Fetched{
+		{Result: &provider.Result{FreshUntil: later}},
+		{Result: &provider.Result{FreshUntil: soon}},
+	}
+	if got := freshUntil(fetched); !got.Equal(soon) {
+		t.Fatalf("freshUntil = %s, want %s", got, soon)
+	}
+
+	fetched = append(fetched, provider.Fetched{Result: &provider.Result{}})
+	if got := freshUntil(fetched); !got.IsZero() {
+		t.Fatalf("a provider without caching headers should keep the schedule: %s", got)
+	}
+	fetched[2] = provider.Fetched{Err: errors.New("down")}
+	if got := freshUntil(fetched); !got.IsZero() {
+		t.Fatalf("a failed provider should keep the schedule: %s", got)
+	}
+}
@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/logging"
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+// timeoutRefresh is how often sets created with a timeout must have their
+// entries re-added so that none expire: half the shortest timeout. Zero
+// means no set has one.
+func timeoutRefresh(cfg Config) time.Duration {
+	if cfg.Backend == firewall.BackendNFT {
+		return 0
+	}
+	var shortest int
+	for _, t := range []int{cfg.IPv4Options.Timeout, cfg.IPv6Options.Timeout} {
+		if t > 0 && (shortest == 0 || t < shortest) {
+			shortest = t
+		}
+	}
+	if shortest == 0 {
+		return 0
+	}
+	return max(time.Duration(shortest)*time.Second/2, time.Second)
+}
+
+// refreshTimeouts re-applies the last lists of targets not in skip, which
+// re-adds every entry of a set with a timeout. Without it an unchanged list
+// would let the entries expire and empty the sets.
+func refreshTimeouts(ctx context.Context, logger logging.Logger, cfg Config, lastApplied map[provider.Target]firewall.UpdateConfig, skip []firewall.UpdateConfig) {
+	if timeoutRefresh(cfg) == 0 {
+		return
+	}
+	done := map[provider.Target]bool{}
+	for _, applied := range skip {
+		done[targetOf(applied)] = true
+	}
+	for t, applied := range lastApplied {
+		if done[t] {
+			continue
+		}
+		if _, err := updateIPSetsFunc(context.WithoutCancel(ctx), applied); err != nil {
+			logger.Warnw("refreshing set timeouts failed", "set", applied.IPv4SetName, "err", err)
+			continue
+		}
+		logger.Debugw("set timeouts refreshed", "set", applied.IPv4SetName)
+	}
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"go.uber.org/zap"
+)
+
+func TestTimeoutRefresh(t *testing.T) {
+	cases := []struct {
+		backend    string
+		ipv4, ipv6 int
+		want       time.Duration
+	}{
+		{firewall.BackendIPSet, 0, 0, 0},
+		{firewall.BackendIPSet, 600, 0, 5 * time.Minute},
+		{firewall.BackendNetlink, 600, 120, time.Minute},
+		{firewall.BackendIPSet, 1, 0, time.Second},
+		{firewall.BackendNFT, 600, 600, 0},
+	}
+	for _, tc := range cases {
+		cfg := Config{
+			Backend:     tc.backend,
+			IPv4Options: firewall.SetOptions{Timeout: tc.ipv4},
+			IPv6Options: firewall.SetOptions{Timeout: tc.ipv6},
+		}
+		if got := timeoutRefresh(cfg); got != tc.want {
+			t.Errorf("timeoutRefresh(%s, %d, %d) = %s, want %s", tc.backend, tc.ipv4, tc.ipv6, got, tc.want)
+		}
+	}
+}
+
+// An unchanged list is still re-applied every cycle, so entries of sets with
+// a timeout are re-added before they expire.
+func TestRunRefreshesTimeoutSets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/24\n2001:db8::/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := make(chan firewall.UpdateConfig, 1)
+	origUpdate, origCheck := updateIPSetsFunc, checkBackendFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		applied <- cfg
+		return firewall.UpdateResult{}, nil
+	}
+	checkBackendFunc = func(ctx context.Context, backend string) error { return nil }
+	defer func() { updateIPSetsFunc, checkBackendFunc = origUpdate, origCheck }()
+
+	opts := firewall.SetOptions{Timeout: 3600}
+	cfg := Config{
+		Interval:      10 * time.Millisecond,
+		Backend:       firewall.BackendIPSet,
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		IPv4Options:   opts,
+		IPv6Options:   opts,
+		CloudflareAPI: "file://" + path,
+		Logger:        zap.NewNop().Sugar(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Run(ctx, cfg) }()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case got := <-applied:
+			if len(got.IPv4CIDRs) != 1 || got.IPv4Options.Timeout != 3600 {
+				t.Fatalf("apply %d: unexpected config %+v", i, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("apply %d: timeout sets not refreshed", i)
+		}
+	}
+	cancel()
+	for {
+		select {
+		case <-applied:
+			continue
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Run returned %v, want context.Canceled", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package daemon
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+var jitter = func(d time.Duration) time.Duration {
+	return time.Duration(rand.Int64N(int64(d) + 1))
+}
+
+// retryDelay is the wait before retry attempt n, counted from 1: base
+// doubled per attempt and capped at limit, of which the upper half is random
+// so that many hosts do not retry in step. A Retry-After from a server is
+// honoured by the provider registry for that provider alone.
+func retryDelay(n int, base, limit time.Duration) time.Duration {
+	d := base
+	for i := 1; i < n && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d/2 + jitter(d/2)
+}
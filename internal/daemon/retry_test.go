@@ -0,0 +1,41 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	orig := jitter
+	defer func() { jitter = orig }()
+
+	base, limit := 10*time.Second, 60*time.Second
+	cases := []struct {
+		n      int
+		lo, hi time.Duration
+	}{
+		{1, 5 * time.Second, 10 * time.Second},
+		{2, 10 * time.Second, 20 * time.Second},
+		{3, 20 * time.Second, 40 * time.Second},
+		{4, 30 * time.Second, 60 * time.Second},
+		{50, 30 * time.Second, 60 * time.Second},
+	}
+	for _, tc := range cases {
+		jitter = func(d time.Duration) time.Duration { return 0 }
+		if got := retryDelay(tc.n, base, limit); got != tc.lo {
+			t.Errorf("attempt %d, no jitter: %s, want %s", tc.n, got, tc.lo)
+		}
+		jitter = func(d time.Duration) time.Duration { return d }
+		if got := retryDelay(tc.n, base, limit); got != tc.hi {
+			t.Errorf("attempt %d, full jitter: %s, want %s", tc.n, got, tc.hi)
+		}
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if j := jitter(time.Second); j < 0 || j > time.Second {
+			t.Fatalf("jitter out of range: %s", j)
+		}
+	}
+}
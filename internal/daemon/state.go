@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/atomicfile"
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/logging"
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+// stateFile in the state directory lets a restart pick up where the last
+// run stopped instead of fetching and rewriting everything.
+const stateFile = "state.json"
+
+type savedState struct {
+	Saved     time.Time        `json:"saved"`
+	Providers []provider.State `json:"providers"`
+	Sets      []savedSet       `json:"sets"`
+	Stats     updateStats      `json:"stats"`
+}
+
+// savedSet is the content of one set pair as it was applied.
+type savedSet struct {
+	IPv4Set string   `json:"ipv4_set"`
+	IPv6Set string   `json:"ipv6_set"`
+	IPv4    []string `json:"ipv4"`
+	IPv6    []string `json:"ipv6"`
+	Hash    string   `json:"hash"`
+}
+
+func contentHash(ipv4, ipv6 []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(ipv4, "\n") + "\n\n" + strings.Join(ipv6, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func saveState(logger logging.Logger, cfg Config, reg *provider.Registry, applied map[provider.Target]firewall.UpdateConfig, stats *updateStats) {
+	if cfg.StateDir == "" {
+		return
+	}
+	st := savedState{Saved: time.Now().UTC(), Providers: reg.States(), Stats: *stats}
+	for _, t := range reg.Targets() {
+		if a, ok := applied[t]; ok {
+			st.Sets = append(st.Sets, savedSet{
+				IPv4Set: t.IPv4Set,
+				IPv6Set: t.IPv6Set,
+				IPv4:    a.IPv4CIDRs,
+				IPv6:    a.IPv6CIDRs,
+				Hash:    contentHash(a.IPv4CIDRs, a.IPv6CIDRs),
+			})
+		}
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		err = atomicfile.WriteFile(filepath.Join(cfg.StateDir, stateFile), b)
+	}
+	if err != nil {
+		logger.Warnw("saving state failed", "err", err)
+	}
+}
+
+// loadState restores the saved provider versions into reg and returns the
+// set contents they stand for, along with the saved counters. A set pair is
+// only restored when the current configuration still builds exactly the
+// saved content from the saved provider results; otherwise it is fetched
+// and written in full.
+func loadState(logger logging.Logger, cfg Config, reg *provider.Registry) ([]firewall.UpdateConfig, updateStats) {
+	if cfg.StateDir == "" {
+		return nil, updateStats{}
+	}
+	b, err := os.ReadFile(filepath.Join(cfg.StateDir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, updateStats{}
+	}
+	var st savedState
+	if err == nil {
+		err = json.Unmarshal(b, &st)
+	}
+	if err != nil {
+		logger.Warnw("state unreadable, starting afresh", "err", err)
+		return nil, updateStats{}
+	}
+
+	var restored []firewall.UpdateConfig
+	for _, set := range st.Sets {
+		t := provider.Target{IPv4Set: set.IPv4Set, IPv6Set: set.IPv6Set}
+		var states []provider.State
+		var ipv4, ipv6 []string
+		for _, s := range st.Providers {
+			if s.Target == t {
+				states = append(states, s)
+				ipv4 = append(ipv4, s.IPv4...)
+				ipv6 = append(ipv6, s.IPv6...)
+			}
+		}
+		if len(states) == 0 || !hasTarget(reg, t) {
+			continue
+		}
+		v4, v6, err := provider.ParsePrefixes(append(ipv4, ipv6...))
+		if err != nil {
+			logger.Warnw("saved state invalid", "ipset4", t.IPv4Set, "err", err)
+			continue
+		}
+		fwCfg := targetConfig(cfg, t)
+		fwCfg.IPv4CIDRs = provider.Strings(provider.Normalize(v4, cfg.Aggregate))
+		fwCfg.IPv6CIDRs = provider.Strings(provider.Normalize(v6, cfg.Aggregate))
+		if contentHash(fwCfg.IPv4CIDRs, fwCfg.IPv6CIDRs) != set.Hash {
+			logger.Infow("saved state does not match the configuration, refetching", "ipset4", t.IPv4Set)
+			continue
+		}
+		if err := reg.Restore(states); err != nil {
+			logger.Infow("saved state does not match the configuration, refetching", "ipset4", t.IPv4Set, "err", err)
+			continue
+		}
+		restored = append(restored, fwCfg)
+	}
+	logger.Infow("state loaded",
+		"saved", st.Saved.Format(time.RFC3339),
+		"sets", len(restored),
+		"version", reg.Version())
+	return restored, st.Stats
+}
+
+// carryStates hands the committed ranges of from to the targets of to that
+// are fed by the same providers, so the guards still see what is in the
+// sets after a reload. The next fetch still asks for full lists, since the
+// new configuration may build different set contents from them.
+func carryStates(logger logging.Logger, from, to *provider.Registry) {
+	byTarget := map[provider.Target][]provider.State{}
+	for _, s := range from.States() {
+		byTarget[s.Target] = append(byTarget[s.Target], s)
+	}
+	for _, t := range to.Targets() {
+		if len(byTarget[t]) == 0 {
+			continue
+		}
+		if err := to.Restore(byTarget[t]); err != nil {
+			logger.Debugw("providers changed, not carrying over committed ranges", "ipset4", t.IPv4Set, "err", err)
+		}
+	}
+	to.Invalidate()
+}
+
+func hasTarget(reg *provider.Registry, t provider.Target) bool {
+	for _, rt := range reg.Targets() {
+		if rt == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/firewall"
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+	"go.uber.org/zap"
+)
+
+func TestStateRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ranges.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/24\n10.0.1.0/24\n2001:db8::/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []firewall.UpdateConfig
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		got = append(got, cfg)
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + path,
+		StateDir:      filepath.Join(dir, "state"),
+		Logger:        zap.NewNop().Sugar(),
+	}
+	reg := newRegistry(cfg)
+	res, err := updateOnce(context.Background(), cfg.Logger, reg, cfg)
+	if err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+	stats := &updateStats{Success: 3, LastVersion: reg.Version()}
+	saveState(cfg.Logger, cfg, reg, map[provider.Target]firewall.UpdateConfig{mainTarget(cfg): res.Applied[0]}, stats)
+
+	// A restart against the same file restores everything and applies nothing.
+	reg = newRegistry(cfg)
+	restored, saved := loadState(cfg.Logger, cfg, reg)
+	if len(restored) != 1 || len(restored[0].IPv4CIDRs) != 2 || saved.Success != 3 || saved.LastVersion != stats.LastVersion {
+		t.Fatalf("unexpected restore: %+v %+v", restored, saved)
+	}
+	res, err = updateOnce(context.Background(), cfg.Logger, reg, cfg)
+	if err != nil || !res.NotModified || len(got) != 1 {
+		t.Fatalf("restart should be a no-op: %+v err=%v applied=%d", res, err, len(got))
+	}
+
+	// Aggregation changes the content of the sets, so the state is stale.
+	cfg.Aggregate = true
+	reg = newRegistry(cfg)
+	if restored, _ := loadState(cfg.Logger, cfg, reg); len(restored) != 0 {
+		t.Fatalf("state restored for a changed configuration: %+v", restored)
+	}
+	if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); err != nil || len(got) != 2 {
+		t.Fatalf("changed configuration should be applied: err=%v applied=%d", err, len(got))
+	}
+}
+
+func TestLoadStateMissing(t *testing.T) {
+	cfg := Config{IPv4SetName: "v4", IPv6SetName: "v6", StateDir: t.TempDir(), Logger: zap.NewNop().Sugar()}
+	if restored, stats := loadState(cfg.Logger, cfg, newRegistry(cfg)); len(restored) != 0 || stats.Success != 0 {
+		t.Fatalf("unexpected restore: %+v %+v", restored, stats)
+	}
+
+	if err := os.WriteFile(filepath.Join(cfg.StateDir, stateFile), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if restored, _ := loadState(cfg.Logger, cfg, newRegistry(cfg)); len(restored) != 0 {
+		t.Fatalf("corrupt state restored: %+v", restored)
+	}
+}
+
+// A reload keeps the committed ranges as the previous content of the sets,
+// so the max-remove guard still applies, but fetches full lists again.
+func TestCarryStates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.0/24\n10.0.1.0/24\n2001:db8::/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orig := updateIPSetsFunc
+	updateIPSetsFunc = func(ctx context.Context, cfg firewall.UpdateConfig) (firewall.UpdateResult, error) {
+		return firewall.UpdateResult{}, nil
+	}
+	defer func() { updateIPSetsFunc = orig }()
+
+	cfg := Config{
+		IPv4SetName:   "v4",
+		IPv6SetName:   "v6",
+		CloudflareAPI: "file://" + path,
+		Logger:        zap.NewNop().Sugar(),
+	}
+	reg := newRegistry(cfg)
+	if _, err := updateOnce(context.Background(), cfg.Logger, reg, cfg); err != nil {
+		t.Fatalf("updateOnce error: %v", err)
+	}
+
+	cfg.StaticCIDRs = []string{"192.0.2.0/24"}
+	next := newRegistry(cfg)
+	carryStates(cfg.Logger, reg, next)
+	u := next.Fetch(context.Background()).Updates[0]
+	if len(u.PrevIPv4) != 2 || len(u.PrevIPv6) != 1 {
+		t.Fatalf("committed ranges not carried over: %+v", u)
+	}
+	if !u.Changed || len(u.IPv4) != 3 {
+		t.Fatalf("reloaded registry did not fetch full lists: %+v", u)
+	}
+
+	// A target whose providers are gone starts afresh.
+	cfg.CloudflareAPI = "file://" + filepath.Join(t.TempDir(), "other.txt")
+	next = newRegistry(cfg)
+	carryStates(cfg.Logger, reg, next)
+	if states := next.States(); len(states) != 0 {
+		t.Fatalf("state carried to other providers: %+v", states)
+	}
+}
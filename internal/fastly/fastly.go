@@ -0,0 +1,92 @@
+package fastly
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+const DefaultURL = "https://api.fastly.com/public-ip-list"
+
+// Client reads Fastly's public-ip-list.
+type Client struct {
+	HTTPClient *http.Client
+	URL        string
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+type ipList struct {
+	Addresses     []string `json:"addresses"`
+	IPv6Addresses []string `json:"ipv6_addresses"`
+}
+
+func (c *Client) Name() string {
+	return "fastly"
+}
+
+// Fetch uses the response ETag as version, or a hash of the body when the
+// server sends none.
+func (c *Client) Fetch(ctx context.Context, prevVersion string) (*provider.Result, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{}
+	}
+	if c.URL == "" {
+		c.URL = DefaultURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	if prevVersion != "" {
+		req.Header.Set("If-None-Match", prevVersion)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	fresh := provider.FreshUntil(resp.Header, time.Now())
+
+	if resp.StatusCode == http.StatusNotModified {
+		return &provider.Result{Version: prevVersion, FreshUntil: fresh, NotModified: true}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, provider.NewStatusError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	var list ipList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	if len(list.Addresses)+len(list.IPv6Addresses) == 0 {
+		return nil, fmt.Errorf("empty public-ip-list")
+	}
+
+	version := resp.Header.Get("ETag")
+	if version == "" {
+		sum := sha256.Sum256(body)
+		version = "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	if version == prevVersion {
+		return &provider.Result{Version: version, FreshUntil: fresh, NotModified: true}, nil
+	}
+
+	res := &provider.Result{Version: version, FreshUntil: fresh}
+	res.AddIPv4(list.Addresses...)
+	res.AddIPv6(list.IPv6Addresses...)
+	return res, nil
+}
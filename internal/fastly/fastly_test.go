@@ -0,0 +1,67 @@
+package fastly
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testList = `{
+	"addresses": ["23.235.32.0/20", "151.101.0.0/16"],
+	"ipv6_addresses": ["2a04:4e40::/32"]
+}`
+
+func TestFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(testList))
+	}))
+	defer ts.Close()
+
+	c := &Client{URL: ts.URL}
+	res, err := c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 2 || len(res.IPv6) != 1 || res.Version != `"v1"` {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	again, err := c.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if !again.NotModified {
+		t.Fatalf("expected not modified")
+	}
+	if until := time.Until(again.FreshUntil); until < 59*time.Minute || until > time.Hour {
+		t.Fatalf("FreshUntil should follow max-age: %s", again.FreshUntil)
+	}
+}
+
+func TestFetchHashesWithoutETag(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testList))
+	}))
+	defer ts.Close()
+
+	c := &Client{URL: ts.URL}
+	res, err := c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	again, err := c.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if !again.NotModified {
+		t.Fatalf("same body should be not modified, version %q", res.Version)
+	}
+}
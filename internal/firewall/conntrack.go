@@ -0,0 +1,64 @@
+package firewall
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// FlushConntrack deletes tracked TCP connections whose source lies in one of
+// the removed prefixes and whose destination is one of ports, so flows that
+// were admitted before a range was dropped do not live on through
+// ESTABLISHED,RELATED rules. It returns the number of deleted flows.
+func FlushConntrack(ctx context.Context, removed []string, ports []int) (int, error) {
+	if len(removed) == 0 || len(ports) == 0 {
+		return 0, nil
+	}
+	or, ok := runner.(OutputRunner)
+	if !ok {
+		return 0, errors.New("conntrack flush: runner cannot capture output")
+	}
+
+	killed := 0
+	var errs []error
+	for _, cidr := range removed {
+		args, err := conntrackSourceArgs(cidr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, port := range ports {
+			out, err := or.Output(ctx, "conntrack", append(args, "-p", "tcp", "--dport", strconv.Itoa(port))...)
+			if err != nil {
+				// conntrack exits non-zero when nothing matched.
+				if strings.Contains(err.Error(), "0 flow entries") {
+					continue
+				}
+				errs = append(errs, fmt.Errorf("conntrack flush %s port %d: %w", cidr, port, err))
+				continue
+			}
+			killed += bytes.Count(out, []byte("\n"))
+		}
+	}
+	return killed, errors.Join(errs...)
+}
+
+func conntrackSourceArgs(cidr string) ([]string, error) {
+	p, err := netip.ParsePrefix(normalizeCIDR(cidr))
+	if err != nil {
+		return nil, fmt.Errorf("conntrack flush: invalid CIDR %q: %w", cidr, err)
+	}
+	p = p.Masked()
+
+	family := "ipv4"
+	if p.Addr().Is6() {
+		family = "ipv6"
+	}
+	mask := net.IP(net.CIDRMask(p.Bits(), p.Addr().BitLen())).String()
+	return []string{"-D", "-f", family, "-s", p.Addr().String(), "--mask-src", mask}, nil
+}
@@ -0,0 +1,59 @@
+package firewall
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFlushConntrack(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"conntrack -D -f ipv4 -s 1.0.0.0 --mask-src 255.255.255.0 -p tcp --dport 80":    "",
+			"conntrack -D -f ipv4 -s 1.0.0.0 --mask-src 255.255.255.0 -p tcp --dport 443":   "tcp 6 431999 ESTABLISHED src=1.0.0.7 dst=10.0.0.1 sport=51000 dport=443\ntcp 6 431999 ESTABLISHED src=1.0.0.9 dst=10.0.0.1 sport=51002 dport=443\n",
+			"conntrack -D -f ipv6 -s 2400:cb00:: --mask-src ffff:ffff:: -p tcp --dport 80":  "tcp 6 431999 ESTABLISHED src=2400:cb00::1 dst=2001:db8::1 sport=51000 dport=80\n",
+			"conntrack -D -f ipv6 -s 2400:cb00:: --mask-src ffff:ffff:: -p tcp --dport 443": "",
+		},
+	}
+	withRunner(t, fr)
+
+	killed, err := FlushConntrack(context.Background(), []string{"1.0.0.0/24", "2400:cb00::/32"}, []int{80, 443})
+	if err != nil {
+		t.Fatalf("FlushConntrack error: %v", err)
+	}
+	if killed != 3 {
+		t.Fatalf("expected 3 flows killed, got %d", killed)
+	}
+	if len(fr.calls) != 4 {
+		t.Fatalf("unexpected calls: %v", fr.calls)
+	}
+}
+
+func TestFlushConntrackKeepsGoingOnError(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"conntrack -D -f ipv4 -s 1.1.1.0 --mask-src 255.255.255.0 -p tcp --dport 443": "tcp 6 431999 ESTABLISHED src=1.1.1.1\n",
+		},
+	}
+	withRunner(t, fr)
+
+	killed, err := FlushConntrack(context.Background(), []string{"1.0.0.0/24", "1.1.1.0/24"}, []int{443})
+	if err == nil || !strings.Contains(err.Error(), "1.0.0.0/24") {
+		t.Fatalf("expected error naming the failed prefix, got %v", err)
+	}
+	if killed != 1 {
+		t.Fatalf("expected 1 flow killed, got %d", killed)
+	}
+}
+
+func TestFlushConntrackNothingRemoved(t *testing.T) {
+	fr := &fakeRunner{failAt: -1}
+	withRunner(t, fr)
+
+	killed, err := FlushConntrack(context.Background(), nil, []int{443})
+	if err != nil || killed != 0 || len(fr.calls) != 0 {
+		t.Fatalf("expected no-op, got killed=%d err=%v calls=%v", killed, err, fr.calls)
+	}
+}
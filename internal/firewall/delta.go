@@ -0,0 +1,153 @@
+package firewall
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+const defaultDeltaRatio = 0.25
+
+// UpdateResult reports what an update changed in the live sets.
+type UpdateResult struct {
+	Added   int
+	Removed int
+	// RemovedCIDRs lists the addresses the sets no longer cover, when the
+	// live sets could be read before the update.
+	RemovedCIDRs []string
+	// Swapped is true when the sets were rebuilt and swapped in rather than
+	// patched in place.
+	Swapped bool
+}
+
+type delta struct {
+	added   []string
+	removed []string
+}
+
+func (d delta) size() int {
+	return len(d.added) + len(d.removed)
+}
+
+// diffCIDRs compares the live members with the wanted CIDRs. Both sides are
+// normalized, so "10.0.0.1" and "10.0.0.1/32" are the same entry.
+func diffCIDRs(live, want []string) delta {
+	liveSet := make(map[string]bool, len(live))
+	for _, c := range live {
+		liveSet[normalizeCIDR(c)] = true
+	}
+	wantSet := make(map[string]bool, len(want))
+
+	var d delta
+	for _, c := range want {
+		n := normalizeCIDR(c)
+		if wantSet[n] {
+			continue
+		}
+		wantSet[n] = true
+		if !liveSet[n] {
+			d.added = append(d.added, n)
+		}
+	}
+	for c := range liveSet {
+		if !wantSet[c] {
+			d.removed = append(d.removed, c)
+		}
+	}
+	sort.Strings(d.removed)
+	return d
+}
+
+// deltaTooLarge reports whether patching would take more operations than
+// ratio of the wanted set size; a rebuild and swap is cheaper then.
+func deltaTooLarge(d delta, want int, ratio float64) bool {
+	if ratio <= 0 {
+		ratio = defaultDeltaRatio
+	}
+	limit := int(float64(want) * ratio)
+	if limit < 1 {
+		limit = 1
+	}
+	return d.size() > limit
+}
+
+// uncovered returns the addresses of a that b does not cover, as the fewest
+// prefixes. Unlike diffCIDRs it compares coverage rather than entries, so
+// ranges that are only split or joined differently, e.g. by nft
+// auto-merge, count as no change. Both lists hold one family.
+func uncovered(a, b []string) []string {
+	pa, pb := coverage(a), coverage(b)
+	var out []string
+	j := 0
+	for _, p := range pa {
+		lo, hi := p.Addr(), lastAddr(p)
+		for j < len(pb) && lastAddr(pb[j]).Less(lo) {
+			j++
+		}
+		for k := j; lo.IsValid() && lo.Compare(hi) <= 0; k++ {
+			if k >= len(pb) || hi.Less(pb[k].Addr()) {
+				out = append(out, provider.Strings(rangePrefixes(lo, hi))...)
+				break
+			}
+			if lo.Less(pb[k].Addr()) {
+				out = append(out, provider.Strings(rangePrefixes(lo, pb[k].Addr().Prev()))...)
+			}
+			if !lastAddr(pb[k]).Less(hi) {
+				break
+			}
+			lo = lastAddr(pb[k]).Next()
+		}
+	}
+	return out
+}
+
+// coverage is the smallest sorted prefix list covering the same addresses
+// as cidrs. Entries that do not parse are dropped.
+func coverage(cidrs []string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, c := range cidrs {
+		if p, err := netip.ParsePrefix(normalizeCIDR(c)); err == nil {
+			ps = append(ps, p)
+		}
+	}
+	return provider.Normalize(ps, true)
+}
+
+func normalizeCIDR(s string) string {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked().String()
+	}
+	if a, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(a, a.BitLen()).String()
+	}
+	return s
+}
+
+// Drift is how far the live sets are from what an UpdateConfig wants.
+type Drift struct {
+	Missing int
+	Extra   int
+}
+
+func (d Drift) InSync() bool {
+	return d.Missing == 0 && d.Extra == 0
+}
+
+// CheckDrift reads the live sets back and compares the addresses they
+// cover with cfg, as prefixes missing from and extra to the wanted lists.
+func CheckDrift(ctx context.Context, cfg UpdateConfig) (Drift, error) {
+	b, err := backendFor(cfg.Backend)
+	if err != nil {
+		return Drift{}, err
+	}
+	live4, live6, err := b.List(ctx, cfg)
+	if err != nil {
+		return Drift{}, err
+	}
+	return Drift{
+		Missing: len(uncovered(cfg.IPv4CIDRs, live4)) + len(uncovered(cfg.IPv6CIDRs, live6)),
+		Extra:   len(uncovered(live4, cfg.IPv4CIDRs)) + len(uncovered(live6, cfg.IPv6CIDRs)),
+	}, nil
+}
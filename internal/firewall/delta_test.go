@@ -0,0 +1,249 @@
+package firewall
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDiffCIDRs(t *testing.T) {
+	d := diffCIDRs(
+		[]string{"1.1.1.0/24", "10.0.0.1", "1.0.0.0/24"},
+		[]string{"1.1.1.0/24", "10.0.0.1/32", "1.1.2.0/24", "1.1.2.0/24"},
+	)
+	if strings.Join(d.added, ",") != "1.1.2.0/24" {
+		t.Fatalf("unexpected added: %v", d.added)
+	}
+	if strings.Join(d.removed, ",") != "1.0.0.0/24" {
+		t.Fatalf("unexpected removed: %v", d.removed)
+	}
+}
+
+func TestUncovered(t *testing.T) {
+	cases := []struct {
+		a, b []string
+		want string
+	}{
+		{[]string{"10.0.0.0/24", "10.0.1.0/24"}, []string{"10.0.0.0/23"}, ""},
+		{[]string{"10.0.0.0/23"}, []string{"10.0.0.0/24", "10.0.1.0/24"}, ""},
+		{[]string{"10.0.0.0/22"}, []string{"10.0.1.0/24"}, "10.0.0.0/24,10.0.2.0/23"},
+		{[]string{"10.0.0.0/24", "192.0.2.1"}, []string{"10.0.0.128/25", "10.0.0.0/26"}, "10.0.0.64/26,192.0.2.1/32"},
+		{[]string{"2001:db8::/32"}, nil, "2001:db8::/32"},
+		{nil, []string{"2001:db8::/32"}, ""},
+		{[]string{"255.255.255.0/24"}, []string{"255.255.255.128/25"}, "255.255.255.0/25"},
+	}
+	for _, tc := range cases {
+		if got := strings.Join(uncovered(tc.a, tc.b), ","); got != tc.want {
+			t.Errorf("uncovered(%v, %v) = %s, want %s", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateIPSetsAppliesDelta(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\nadd v4 1.1.1.0/24\nadd v4 1.1.2.0/24\nadd v4 1.1.3.0/24\nadd v4 1.1.4.0/24\nadd v4 1.0.0.0/24\n",
+			"ipset save v6": "create v6 hash:net family inet6 hashsize 1024 maxelem 65536\nadd v6 2606:4700::/32\n",
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24", "1.1.2.0/24", "1.1.3.0/24", "1.1.4.0/24", "1.1.5.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/32"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		DeltaRatio:  0.5,
+	}
+
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if res.Swapped || res.Added != 1 || res.Removed != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	assertCalls(t, fr.calls, []string{"ipset save v4", "ipset save v6", "ipset restore"})
+	want := "add v4 1.1.5.0/24 -exist\ndel v4 1.0.0.0/24 -exist\n"
+	if fr.inputs[0] != want {
+		t.Fatalf("unexpected restore script:\n%s", fr.inputs[0])
+	}
+}
+
+func TestUpdateIPSetsUnchanged(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\nadd v4 1.1.1.0/24\n",
+			"ipset save v6": "create v6 hash:net family inet6 hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if res.Added != 0 || res.Removed != 0 || res.Swapped {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	assertCalls(t, fr.calls, []string{"ipset save v4", "ipset save v6"})
+}
+
+func TestUpdateIPSetsLargeDeltaSwaps(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\nadd v4 10.0.0.0/8\n",
+			"ipset save v6": "create v6 hash:net family inet6 hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24", "1.1.2.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if !res.Swapped || res.Added != 2 || res.Removed != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if !strings.Contains(strings.Join(fr.inputs, ""), "swap v4 v4_tmp") {
+		t.Fatalf("expected swap script, got:\n%s", strings.Join(fr.inputs, ""))
+	}
+}
+
+// Splitting a prefix replaces entries but removes no addresses, so no flows
+// may be flushed for it.
+func TestUpdateIPSetsRemovedByCoverage(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\nadd v4 10.0.0.0/23\nadd v4 1.1.1.0/24\nadd v4 1.1.2.0/24\nadd v4 1.1.3.0/24\n",
+			"ipset save v6": "create v6 hash:net family inet6 hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"10.0.0.0/24", "10.0.1.0/24", "1.1.1.0/24", "1.1.2.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		DeltaRatio:  1,
+	}
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if res.Removed != 2 || strings.Join(res.RemovedCIDRs, ",") != "1.1.3.0/24" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\nadd v4 1.1.1.0/24\nadd v4 10.0.0.0/8\n",
+			"ipset save v6": "create v6 hash:net family inet6 hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/32"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	d, err := CheckDrift(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("CheckDrift error: %v", err)
+	}
+	if d.InSync() || d.Missing != 1 || d.Extra != 1 {
+		t.Fatalf("unexpected drift: %+v", d)
+	}
+
+	cfg.IPv4CIDRs = []string{"1.1.1.0/24", "10.0.0.0/8"}
+	cfg.IPv6CIDRs = nil
+	if d, err := CheckDrift(context.Background(), cfg); err != nil || !d.InSync() {
+		t.Fatalf("expected sets in sync, got %+v err=%v", d, err)
+	}
+}
+
+// nft auto-merge joins adjacent prefixes, which reads back as a different
+// list covering the same addresses.
+func TestCheckDriftNFTAutoMerge(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"nft -j list set inet cf_ip_guard v4": `{"nftables": [{"set": {"name": "v4", "elem": [{"prefix": {"addr": "10.0.0.0", "len": 23}}, {"range": ["192.0.2.0", "192.0.2.191"]}]}}]}`,
+			"nft -j list set inet cf_ip_guard v6": `{"nftables": [{"set": {"name": "v6"}}]}`,
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		Backend:     BackendNFT,
+		IPv4CIDRs:   []string{"10.0.0.0/24", "10.0.1.0/24", "192.0.2.0/25", "192.0.2.128/26", "192.0.2.160/27"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	d, err := CheckDrift(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("CheckDrift error: %v", err)
+	}
+	if !d.InSync() {
+		t.Fatalf("auto-merged sets reported as drifted: %+v", d)
+	}
+
+	cfg.IPv4CIDRs = []string{"10.0.0.0/24", "192.0.2.0/24"}
+	if d, err := CheckDrift(context.Background(), cfg); err != nil || d.Missing != 1 || d.Extra != 1 {
+		t.Fatalf("unexpected drift: %+v err=%v", d, err)
+	}
+}
+
+func TestUpdateIPSetsUnchangedRefreshesTimeout(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536 timeout 600\nadd v4 1.1.1.0/24 timeout 17\n",
+			"ipset save v6": "create v6 hash:net family inet6 hashsize 1024 maxelem 65536 timeout 600\n",
+		},
+	}
+	withRunner(t, fr)
+
+	opts := SetOptions{Timeout: 600}
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		IPv4Options: opts,
+		IPv6Options: opts,
+	}
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if res.Swapped || res.Added != 0 || res.Removed != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	// Nothing changed, but the entry is re-added so its timeout restarts.
+	assertCalls(t, fr.calls, []string{"ipset save v4", "ipset save v6", "ipset restore"})
+	if fr.inputs[0] != "add v4 1.1.1.0/24 -exist\n" {
+		t.Fatalf("unexpected restore script:\n%s", fr.inputs[0])
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"strconv"
+	"strings"
 
 	"github.com/Ringyuki/cf-ip-guard/internal/logging"
 	"go.uber.org/zap"
@@ -29,11 +31,56 @@ var (
 	logger *zap.SugaredLogger = logging.L().Named("firewall")
 )
 
+const (
+	BackendIPSet   = "ipset"
+	BackendNetlink = "netlink"
+	BackendNFT     = "nft"
+)
+
+// Backend applies an UpdateConfig to one kind of kernel set.
+type Backend interface {
+	Check(ctx context.Context) error
+	Update(ctx context.Context, cfg UpdateConfig) (UpdateResult, error)
+	// List returns the live members of the configured set pair.
+	List(ctx context.Context, cfg UpdateConfig) (ipv4, ipv6 []string, err error)
+}
+
+var backends = map[string]Backend{
+	BackendIPSet:   ipsetBackend{driver: execDriver{}},
+	BackendNetlink: ipsetBackend{driver: &netlinkDriver{dial: dialNetlink}},
+	BackendNFT:     nftBackend{},
+}
+
+func backendFor(name string) (Backend, error) {
+	if name == "" {
+		name = BackendIPSet
+	}
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported firewall backend: %s", name)
+	}
+	return b, nil
+}
+
 type UpdateConfig struct {
+	Backend     string
 	IPv4CIDRs   []string
 	IPv6CIDRs   []string
 	IPv4SetName string
 	IPv6SetName string
+	// IPv4Options and IPv6Options are the ipset creation parameters.
+	IPv4Options SetOptions
+	IPv6Options SetOptions
+	// Comment tags entries added to sets created with the comment option.
+	Comment string
+	// NFTTable is the inet table holding the sets when Backend is nft.
+	NFTTable string
+	// DeltaRatio caps an in-place add/del update at this fraction of the
+	// wanted entries; larger changes rebuild and swap. Zero means 0.25.
+	DeltaRatio float64
+	// AdoptSets takes over existing sets that are not in the registry
+	// instead of refusing to touch them.
+	AdoptSets bool
 }
 
 func SetLogger(l *zap.SugaredLogger) {
@@ -42,59 +89,288 @@ func SetLogger(l *zap.SugaredLogger) {
 	}
 }
 
-func UpdateIPSets(ctx context.Context, cfg UpdateConfig) error {
-	v4set := cfg.IPv4SetName
-	v6set := cfg.IPv6SetName
+func UpdateIPSets(ctx context.Context, cfg UpdateConfig) (UpdateResult, error) {
+	b, err := backendFor(cfg.Backend)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return UpdateResult{}, err
+	}
+	return b.Update(ctx, cfg)
+}
 
-	tmp4 := v4set + "_tmp"
-	tmp6 := v6set + "_tmp"
+// setDriver carries out ipset operations, either through the ipset binary
+// or by talking to the kernel directly.
+type setDriver interface {
+	Check(ctx context.Context) error
+	Apply(ctx context.Context, ops []setOp) error
+	List(ctx context.Context, set string) (*setInfo, error)
+}
 
-	// IPv4
-	if err := runner.Run(ctx, "ipset", "create", tmp4, "hash:net", "-exist"); err != nil {
-		return err
+type ipsetBackend struct {
+	driver setDriver
+}
+
+func (b ipsetBackend) Check(ctx context.Context) error {
+	return b.driver.Check(ctx)
+}
+
+// familyUpdate is one side of an update: a live set, what it should hold,
+// and what could be read back from it (nil when unreadable).
+type familyUpdate struct {
+	set      string
+	tmp      string
+	old      string
+	family   string
+	cidrs    []string
+	opts     SetOptions
+	comment  string
+	live     *setInfo
+	staleTmp bool
+}
+
+func familyUpdates(cfg UpdateConfig) []*familyUpdate {
+	comment := func(o SetOptions) string {
+		if o.Comment {
+			return cfg.Comment
+		}
+		return ""
 	}
-	if err := runner.Run(ctx, "ipset", "flush", tmp4); err != nil {
-		return err
+	return []*familyUpdate{
+		{
+			set:     cfg.IPv4SetName,
+			tmp:     auxSetName(cfg.IPv4SetName, "_tmp"),
+			old:     auxSetName(cfg.IPv4SetName, "_old"),
+			family:  familyInet,
+			cidrs:   cfg.IPv4CIDRs,
+			opts:    cfg.IPv4Options.sized(len(cfg.IPv4CIDRs)),
+			comment: comment(cfg.IPv4Options),
+		},
+		{
+			set:     cfg.IPv6SetName,
+			tmp:     auxSetName(cfg.IPv6SetName, "_tmp"),
+			old:     auxSetName(cfg.IPv6SetName, "_old"),
+			family:  familyInet6,
+			cidrs:   cfg.IPv6CIDRs,
+			opts:    cfg.IPv6Options.sized(len(cfg.IPv6CIDRs)),
+			comment: comment(cfg.IPv6Options),
+		},
 	}
-	for _, cidr := range cfg.IPv4CIDRs {
-		if err := runner.Run(ctx, "ipset", "add", tmp4, cidr, "-exist"); err != nil {
-			return err
+}
+
+// Update patches the live sets with add/del when it can read them, their
+// options match and the change is small. Otherwise it rebuilds both sets
+// and swaps them in, recreating live sets whose type or family is wrong.
+// Either way both families are updated or neither is. Existing sets that
+// cf-ip-guard did not create are left alone unless cfg.AdoptSets is set.
+func (b ipsetBackend) Update(ctx context.Context, cfg UpdateConfig) (UpdateResult, error) {
+	fams := familyUpdates(cfg)
+	res, err := b.update(ctx, cfg, fams)
+	if err != nil {
+		return res, err
+	}
+	if err := registry.Record(cfg.IPv4SetName, cfg.IPv6SetName); err != nil {
+		logger.Warnw("recording owned sets failed", "err", err)
+	}
+	return res, nil
+}
+
+func (b ipsetBackend) update(ctx context.Context, cfg UpdateConfig, fams []*familyUpdate) (UpdateResult, error) {
+	var res UpdateResult
+	readable := true
+	patchable := true
+	deltas := make([]delta, len(fams))
+	for i, f := range fams {
+		info, err := b.driver.List(ctx, f.set)
+		if err != nil {
+			logger.Debugw("live set unreadable, rebuilding", "set", f.set, "err", err)
+			readable, patchable = false, false
+			continue
+		}
+		if !cfg.owns(f.set) {
+			if !registry.adoptsLegacy(info, f.family) {
+				return UpdateResult{}, fmt.Errorf("set %s exists but was not created by cf-ip-guard, refusing to modify it", f.set)
+			}
+			logger.Infow("taking over set from an install without a set registry", "set", f.set)
+		}
+		f.live = info
+		deltas[i] = diffCIDRs(info.members, f.cidrs)
+		if !info.compatible(f.family, f.opts) {
+			logger.Infow("live set options differ, recreating", "set", f.set, "type", info.typ, "family", info.family)
+			patchable = false
+		}
+		if deltaTooLarge(deltas[i], len(f.cidrs), cfg.DeltaRatio) {
+			patchable = false
 		}
 	}
 
-	// IPv6
-	if err := runner.Run(ctx, "ipset", "create", tmp6, "hash:net", "family", "inet6", "-exist"); err != nil {
-		return err
+	if readable {
+		for i, d := range deltas {
+			res.Added += len(d.added)
+			res.Removed += len(d.removed)
+			// Only addresses no longer covered at all lose their flows.
+			res.RemovedCIDRs = append(res.RemovedCIDRs, uncovered(fams[i].live.members, fams[i].cidrs)...)
+		}
+	} else {
+		res.Added = len(cfg.IPv4CIDRs) + len(cfg.IPv6CIDRs)
 	}
-	if err := runner.Run(ctx, "ipset", "flush", tmp6); err != nil {
-		return err
+
+	if patchable {
+		tx := deltaTx(fams, deltas)
+		if len(tx.commit) == 0 {
+			return res, nil
+		}
+		return res, tx.run(ctx, b.driver)
 	}
-	for _, cidr := range cfg.IPv6CIDRs {
-		if err := runner.Run(ctx, "ipset", "add", tmp6, cidr, "-exist"); err != nil {
-			return err
+
+	for _, f := range fams {
+		// A leftover temp set may have been created with other options.
+		if _, err := b.driver.List(ctx, f.tmp); err == nil {
+			f.staleTmp = true
 		}
 	}
+	res.Swapped = true
+	return res, swapTx(fams).run(ctx, b.driver)
+}
 
-	if err := runner.Run(ctx, "ipset", "create", v4set, "hash:net", "-exist"); err != nil {
-		return err
+func (b ipsetBackend) List(ctx context.Context, cfg UpdateConfig) ([]string, []string, error) {
+	v4, err := b.driver.List(ctx, cfg.IPv4SetName)
+	if err != nil {
+		return nil, nil, err
 	}
-	if err := runner.Run(ctx, "ipset", "create", v6set, "hash:net", "family", "inet6", "-exist"); err != nil {
-		return err
+	v6, err := b.driver.List(ctx, cfg.IPv6SetName)
+	if err != nil {
+		return nil, nil, err
 	}
+	return v4.members, v6.members, nil
+}
+
+const (
+	familyInet  = "inet"
+	familyInet6 = "inet6"
+)
+
+// setOp is a single ipset command on hash:net sets.
+type setOp struct {
+	cmd     string // create, flush, add, del, swap, rename, destroy
+	set     string
+	arg     string // CIDR for add/del, second set for swap/rename
+	family  string // create only
+	opts    SetOptions
+	comment string // add only
+	excl    bool   // create only: fail if the set exists instead of -exist
+}
 
-	if err := runner.Run(ctx, "ipset", "swap", v4set, tmp4); err != nil {
-		return err
+// String renders the op as an "ipset restore" line.
+func (o setOp) String() string {
+	switch o.cmd {
+	case "create":
+		args := []string{"create", o.set, "hash:net"}
+		if o.family == familyInet6 {
+			args = append(args, "family", "inet6")
+		}
+		args = append(args, o.opts.args()...)
+		if !o.excl {
+			args = append(args, "-exist")
+		}
+		return strings.Join(args, " ")
+	case "add", "del":
+		if o.comment != "" {
+			return o.cmd + " " + o.set + " " + o.arg + " comment " + strconv.Quote(o.comment) + " -exist"
+		}
+		return o.cmd + " " + o.set + " " + o.arg + " -exist"
+	case "swap", "rename":
+		return o.cmd + " " + o.set + " " + o.arg
+	default:
+		return o.cmd + " " + o.set
 	}
-	if err := runner.Run(ctx, "ipset", "swap", v6set, tmp6); err != nil {
-		return err
+}
+
+// swapTx fills a temp set per family and swaps it in, so the previous
+// contents end up in the temp set until the update is complete. Live sets
+// that do not exist yet are created first; live sets of the wrong type or
+// family cannot be swapped, so they are renamed aside and replaced.
+func swapTx(fams []*familyUpdate) transaction {
+	var tx transaction
+	for _, f := range fams {
+		if f.staleTmp {
+			tx.prepare = append(tx.prepare, setOp{cmd: "destroy", set: f.tmp})
+		}
+		tx.prepare = append(tx.prepare,
+			setOp{cmd: "create", set: f.tmp, family: f.family, opts: f.opts},
+			setOp{cmd: "flush", set: f.tmp})
+		for _, cidr := range f.cidrs {
+			tx.prepare = append(tx.prepare, setOp{cmd: "add", set: f.tmp, arg: cidr, comment: f.comment})
+		}
+		tx.abort = append(tx.abort, setOp{cmd: "destroy", set: f.tmp})
 	}
 
-	if err := runner.Run(ctx, "ipset", "destroy", tmp4); err != nil {
-		logger.Warnw("destroy tmp set failed", "set", tmp4, "err", err)
+	for _, f := range fams {
+		if f.live == nil {
+			// The live set may only have been unreadable. Creating it
+			// without -exist fails then, so the undo can only ever
+			// destroy a set this update made.
+			tx.commit = append(tx.commit, step{
+				op:   setOp{cmd: "create", set: f.set, family: f.family, opts: f.opts, excl: true},
+				undo: []setOp{{cmd: "destroy", set: f.set}},
+			})
+		}
 	}
-	if err := runner.Run(ctx, "ipset", "destroy", tmp6); err != nil {
-		logger.Warnw("destroy tmp set failed", "set", tmp6, "err", err)
+	for _, f := range fams {
+		if f.live != nil && !f.live.swappable(f.family) {
+			old := f.old
+			tx.commit = append(tx.commit,
+				step{
+					op:   setOp{cmd: "rename", set: f.set, arg: old},
+					undo: []setOp{{cmd: "rename", set: old, arg: f.set}},
+				},
+				step{
+					op:   setOp{cmd: "rename", set: f.tmp, arg: f.set},
+					undo: []setOp{{cmd: "rename", set: f.set, arg: f.tmp}},
+				})
+			tx.cleanup = append(tx.cleanup, setOp{cmd: "destroy", set: old})
+			continue
+		}
+		swap := setOp{cmd: "swap", set: f.set, arg: f.tmp}
+		tx.commit = append(tx.commit, step{op: swap, undo: []setOp{swap}})
+		tx.cleanup = append(tx.cleanup, setOp{cmd: "destroy", set: f.tmp})
 	}
 
-	return nil
+	return tx
+}
+
+// deltaTx adds new entries before deleting stale ones, so nothing that stays
+// allowed is ever missing from the live set. Sets with a timeout get every
+// entry re-added to refresh it. Undoing an add deletes an entry the set did
+// not hold before and undoing a del re-adds one it did, so the undo ops are
+// safe to replay for ops that never ran.
+func deltaTx(fams []*familyUpdate, deltas []delta) transaction {
+	tx := transaction{replayable: true}
+	for i, f := range fams {
+		added := deltas[i].added
+		if f.opts.Timeout > 0 {
+			added = f.cidrs
+		}
+		isNew := make(map[string]bool, len(deltas[i].added))
+		for _, cidr := range deltas[i].added {
+			isNew[cidr] = true
+		}
+		for _, cidr := range added {
+			st := step{op: setOp{cmd: "add", set: f.set, arg: cidr, comment: f.comment}}
+			if isNew[cidr] {
+				st.undo = []setOp{{cmd: "del", set: f.set, arg: cidr}}
+			}
+			tx.commit = append(tx.commit, st)
+		}
+	}
+	for i, f := range fams {
+		for _, cidr := range deltas[i].removed {
+			tx.commit = append(tx.commit, step{
+				op:   setOp{cmd: "del", set: f.set, arg: cidr},
+				undo: []setOp{{cmd: "add", set: f.set, arg: cidr, comment: f.comment}},
+			})
+		}
+	}
+	return tx
 }
@@ -10,9 +10,13 @@ import (
 )
 
 type fakeRunner struct {
-	calls  []string
-	failAt int
-	err    error
+	calls   []string
+	inputs  []string
+	outputs map[string]string
+	failAt  int
+	err     error
+	// onRun, if set, sees every successful Run, e.g. to change outputs.
+	onRun func(call string)
 }
 
 func (f *fakeRunner) Run(ctx context.Context, name string, args ...string) error {
@@ -21,9 +25,36 @@ func (f *fakeRunner) Run(ctx context.Context, name string, args ...string) error
 		return f.err
 	}
 	f.calls = append(f.calls, call)
+	if f.onRun != nil {
+		f.onRun(call)
+	}
 	return nil
 }
 
+func (f *fakeRunner) RunInput(ctx context.Context, input string, name string, args ...string) error {
+	call := name + " " + strings.Join(args, " ")
+	if f.failAt >= 0 && len(f.calls) == f.failAt {
+		return f.err
+	}
+	f.calls = append(f.calls, call)
+	f.inputs = append(f.inputs, input)
+	return nil
+}
+
+// Output fails for calls without a canned output, like a missing chain or set.
+func (f *fakeRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	call := name + " " + strings.Join(args, " ")
+	if f.failAt >= 0 && len(f.calls) == f.failAt {
+		return nil, f.err
+	}
+	f.calls = append(f.calls, call)
+	out, ok := f.outputs[call]
+	if !ok {
+		return nil, errors.New("no output for " + call)
+	}
+	return []byte(out), nil
+}
+
 func TestUpdateIPSetsSuccess(t *testing.T) {
 	fr := &fakeRunner{failAt: -1}
 	orig := runner
@@ -38,40 +69,50 @@ func TestUpdateIPSetsSuccess(t *testing.T) {
 		IPv6SetName: "v6",
 	}
 
-	if err := UpdateIPSets(context.Background(), cfg); err != nil {
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
 		t.Fatalf("UpdateIPSets error: %v", err)
 	}
+	if !res.Swapped || res.Added != 3 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	// The sets do not exist yet, so listing fails and they are rebuilt.
+	assertCalls(t, fr.calls, []string{
+		"ipset save v4",
+		"ipset save v6",
+		"ipset save v4_tmp",
+		"ipset save v6_tmp",
+		"ipset restore", // prepare
+		"ipset restore", // commit
+		"ipset restore", // cleanup
+	})
 
 	expected := []string{
-		"ipset create v4_tmp hash:net -exist",
-		"ipset flush v4_tmp",
-		"ipset add v4_tmp 1.1.1.0/24 -exist",
-		"ipset add v4_tmp 1.1.2.0/24 -exist",
-		"ipset create v6_tmp hash:net family inet6 -exist",
-		"ipset flush v6_tmp",
-		"ipset add v6_tmp 2606:4700::/32 -exist",
-		"ipset create v4 hash:net -exist",
-		"ipset create v6 hash:net family inet6 -exist",
-		"ipset swap v4 v4_tmp",
-		"ipset swap v6 v6_tmp",
-		"ipset destroy v4_tmp",
-		"ipset destroy v6_tmp",
-	}
-
-	if len(fr.calls) != len(expected) {
-		t.Fatalf("unexpected call count: got %d want %d", len(fr.calls), len(expected))
-	}
-	for i, c := range expected {
-		if fr.calls[i] != c {
-			t.Fatalf("call %d mismatch: got %q want %q", i, fr.calls[i], c)
-		}
+		"create v4_tmp hash:net -exist",
+		"flush v4_tmp",
+		"add v4_tmp 1.1.1.0/24 -exist",
+		"add v4_tmp 1.1.2.0/24 -exist",
+		"create v6_tmp hash:net family inet6 -exist",
+		"flush v6_tmp",
+		"add v6_tmp 2606:4700::/32 -exist",
+		"create v4 hash:net",
+		"create v6 hash:net family inet6",
+		"swap v4 v4_tmp",
+		"swap v6 v6_tmp",
+		"destroy v4_tmp",
+		"destroy v6_tmp",
+	}
+
+	if got := strings.Join(fr.inputs, ""); got != strings.Join(expected, "\n")+"\n" {
+		t.Fatalf("unexpected restore script:\n%s", got)
 	}
 }
 
-func TestUpdateIPSetsStopsOnError(t *testing.T) {
+func TestUpdateIPSetsRestoreErrorLine(t *testing.T) {
 	fr := &fakeRunner{
-		failAt: 2, // fail on third command
-		err:    errors.New("boom"),
+		failAt: 4,
+		err:    errors.New("ipset [restore] failed: exit status 1 (output: ipset v7.15: Error in line 3: boom)"),
 	}
 	orig := runner
 	runner = fr
@@ -85,13 +126,65 @@ func TestUpdateIPSetsStopsOnError(t *testing.T) {
 		IPv6SetName: "v6",
 	}
 
-	err := UpdateIPSets(context.Background(), cfg)
+	_, err := UpdateIPSets(context.Background(), cfg)
 	if err == nil || !strings.Contains(err.Error(), "boom") {
 		t.Fatalf("expected boom error, got %v", err)
 	}
+	if !strings.Contains(err.Error(), "line 3 (add v4_tmp 1.1.1.0/24 -exist)") {
+		t.Fatalf("expected error mapped to the add line, got %v", err)
+	}
+}
+
+// A live set that could not be listed may still exist. Its create then
+// fails instead of passing with -exist, so the rollback never destroys it.
+func TestUpdateIPSetsUnreadableLiveSetNotDestroyed(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: 5,
+		err:    errors.New("ipset [restore] failed: exit status 1 (output: ipset v7.15: Error in line 1: Set cannot be created: set with the same name already exists)"),
+	}
+	withRunner(t, fr)
 
-	// Should stop at the failing command (no further calls)
-	if len(fr.calls) != fr.failAt {
-		t.Fatalf("expected %d calls before failure, got %d: %v", fr.failAt, len(fr.calls), fr.calls)
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	_, err := UpdateIPSets(context.Background(), cfg)
+	var ae *ApplyError
+	if !errors.As(err, &ae) || !ae.RolledBack || ae.Step != "create v4 hash:net" {
+		t.Fatalf("expected the create to fail, got %v", err)
+	}
+	for _, in := range fr.inputs {
+		if strings.Contains(in, "destroy v4\n") {
+			t.Fatalf("live set destroyed on rollback: %q", fr.inputs)
+		}
+	}
+}
+
+func TestUpdateIPSetsWithoutStdinRunner(t *testing.T) {
+	sr := &scriptRunner{}
+	orig := runner
+	runner = sr
+	defer func() { runner = orig }()
+	SetLogger(zap.NewNop().Sugar())
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+
+	if _, err := UpdateIPSets(context.Background(), cfg); err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+
+	ops := txOps(swapTx(familyUpdates(cfg)))
+	if len(sr.calls) != len(ops) {
+		t.Fatalf("unexpected call count: got %d want %d", len(sr.calls), len(ops))
+	}
+	for i, op := range ops {
+		if sr.calls[i] != "ipset "+op.String() {
+			t.Fatalf("call %d mismatch: got %q want %q", i, sr.calls[i], "ipset "+op.String())
+		}
 	}
 }
@@ -0,0 +1,551 @@
+package firewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// Constants from linux/netlink.h, linux/netfilter/nfnetlink.h and
+// linux/netfilter/ipset/ip_set.h.
+const (
+	nlmsgHdrLen = 16
+	nlaHdrLen   = 4
+
+	nlmsgError = 2
+	nlmsgDone  = 3
+
+	nlmFRequest = 0x1
+	nlmFMulti   = 0x2
+	nlmFAck     = 0x4
+	nlmFExcl    = 0x200
+	nlmFDump    = 0x300
+
+	nlaFNested       = 1 << 15
+	nlaFNetByteorder = 1 << 14
+	nlaTypeMask      = ^uint16(nlaFNested | nlaFNetByteorder)
+
+	nfnlSubsysIPSet = 6
+	nfnetlinkV0     = 0
+
+	nfprotoIPv4 = 2
+	nfprotoIPv6 = 10
+
+	ipsetProtocol = 6
+
+	ipsetCmdProtocol = 1
+	ipsetCmdCreate   = 2
+	ipsetCmdDestroy  = 3
+	ipsetCmdFlush    = 4
+	ipsetCmdRename   = 5
+	ipsetCmdSwap     = 6
+	ipsetCmdList     = 7
+	ipsetCmdAdd      = 9
+	ipsetCmdDel      = 10
+	ipsetCmdType     = 13
+
+	ipsetAttrProtocol = 1
+	ipsetAttrSetname  = 2
+	ipsetAttrTypename = 3
+	ipsetAttrSetname2 = ipsetAttrTypename
+	ipsetAttrRevision = 4
+	ipsetAttrFamily   = 5
+	ipsetAttrData     = 7
+	ipsetAttrADT      = 8
+
+	ipsetAttrIP        = 1
+	ipsetAttrCIDR      = 3
+	ipsetAttrTimeout   = 6
+	ipsetAttrCadtFlags = 8
+	ipsetAttrHashSize  = 18
+	ipsetAttrMaxElem   = 19
+	ipsetAttrComment   = 26
+
+	ipsetFlagWithCounters = 1 << 3
+	ipsetFlagWithComment  = 1 << 4
+
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+
+	ipsetErrPrivate = 4096
+)
+
+var ipsetErrors = map[int]string{
+	4097: "kernel protocol version mismatch",
+	4098: "set type not supported by the kernel",
+	4099: "maximum number of sets reached",
+	4100: "set is busy",
+	4101: "second set does not exist",
+	4102: "set types or families do not match",
+	4103: "set or element already exists",
+	4104: "invalid CIDR",
+	4105: "invalid netmask",
+	4106: "invalid family",
+	4107: "timeout not supported by the set",
+	4108: "set is referenced by a rule or another set",
+	4109: "invalid IPv4 address",
+	4110: "invalid IPv6 address",
+	4111: "counters not supported by the set",
+	4112: "comments not supported by the set",
+	4352: "set is full",
+}
+
+// nlConn exchanges one netlink request for its replies. Only the payloads
+// of data messages are returned; acks and NLMSG_DONE are consumed.
+type nlConn interface {
+	Execute(ctx context.Context, msgType, flags uint16, payload []byte) ([][]byte, error)
+	Close() error
+}
+
+// netlinkDriver speaks NFNL_SUBSYS_IPSET directly, so no ipset binary is
+// needed.
+type netlinkDriver struct {
+	dial func() (nlConn, error)
+}
+
+func (d *netlinkDriver) Check(ctx context.Context) error {
+	err := d.with(func(c nlConn) error {
+		_, err := c.Execute(ctx, ipsetMsgType(ipsetCmdProtocol), nlmFRequest, ipsetPayload(nfprotoIPv4))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("ipset netlink not available or permission denied: %w", err)
+	}
+	return nil
+}
+
+func (d *netlinkDriver) Apply(ctx context.Context, ops []setOp) error {
+	return d.with(func(c nlConn) error {
+		revisions := map[uint8]uint8{}
+		for i, op := range ops {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := d.apply(ctx, c, op, revisions); err != nil {
+				return &opError{what: "ipset netlink op", index: i, op: op, err: err}
+			}
+		}
+		return nil
+	})
+}
+
+func (d *netlinkDriver) List(ctx context.Context, set string) (*setInfo, error) {
+	info := &setInfo{family: familyInet}
+	err := d.with(func(c nlConn) error {
+		replies, err := c.Execute(ctx, ipsetMsgType(ipsetCmdList), nlmFRequest|nlmFDump,
+			ipsetPayload(nfprotoIPv4, attrString(ipsetAttrSetname, set)))
+		if err != nil {
+			return err
+		}
+		for _, r := range replies {
+			if err := parseListReply(r, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ipset netlink list %s: %w", set, err)
+	}
+	return info, nil
+}
+
+func (d *netlinkDriver) with(fn func(nlConn) error) error {
+	c, err := d.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return fn(c)
+}
+
+func (d *netlinkDriver) apply(ctx context.Context, c nlConn, op setOp, revisions map[uint8]uint8) error {
+	var (
+		cmd   uint16
+		attrs [][]byte
+	)
+	family := uint8(nfprotoIPv4)
+
+	switch op.cmd {
+	case "create":
+		if op.family == familyInet6 {
+			family = nfprotoIPv6
+		}
+		rev, ok := revisions[family]
+		if !ok {
+			var err error
+			if rev, err = typeRevision(ctx, c, family); err != nil {
+				return err
+			}
+			revisions[family] = rev
+		}
+		cmd = ipsetCmdCreate
+		attrs = [][]byte{
+			attrString(ipsetAttrSetname, op.set),
+			attrString(ipsetAttrTypename, "hash:net"),
+			attrU8(ipsetAttrRevision, rev),
+			attrU8(ipsetAttrFamily, family),
+			createData(op.opts),
+		}
+	case "flush", "destroy":
+		cmd = ipsetCmdFlush
+		if op.cmd == "destroy" {
+			cmd = ipsetCmdDestroy
+		}
+		attrs = [][]byte{attrString(ipsetAttrSetname, op.set)}
+	case "swap", "rename":
+		cmd = ipsetCmdSwap
+		if op.cmd == "rename" {
+			cmd = ipsetCmdRename
+		}
+		attrs = [][]byte{
+			attrString(ipsetAttrSetname, op.set),
+			attrString(ipsetAttrSetname2, op.arg),
+		}
+	case "add", "del":
+		cmd = ipsetCmdAdd
+		if op.cmd == "del" {
+			cmd = ipsetCmdDel
+		}
+		data, fam, err := prefixData(op.arg, op.comment)
+		if err != nil {
+			return err
+		}
+		family = fam
+		attrs = [][]byte{attrString(ipsetAttrSetname, op.set), data}
+	default:
+		return fmt.Errorf("unsupported ipset command %q", op.cmd)
+	}
+
+	// Without NLM_F_EXCL the kernel treats the request as "-exist".
+	flags := uint16(nlmFRequest | nlmFAck)
+	if op.excl {
+		flags |= nlmFExcl
+	}
+	_, err := c.Execute(ctx, ipsetMsgType(cmd), flags, ipsetPayload(family, attrs...))
+	return err
+}
+
+// typeRevision asks the kernel for the newest hash:net revision it supports.
+func typeRevision(ctx context.Context, c nlConn, family uint8) (uint8, error) {
+	replies, err := c.Execute(ctx, ipsetMsgType(ipsetCmdType), nlmFRequest,
+		ipsetPayload(family, attrString(ipsetAttrTypename, "hash:net"), attrU8(ipsetAttrFamily, family)))
+	if err != nil {
+		return 0, fmt.Errorf("query hash:net revision: %w", err)
+	}
+	for _, r := range replies {
+		if len(r) < 4 {
+			continue
+		}
+		attrs, err := parseAttrs(r[4:])
+		if err != nil {
+			return 0, err
+		}
+		for _, a := range attrs {
+			if a.typ == ipsetAttrRevision && len(a.data) >= 1 {
+				return a.data[0], nil
+			}
+		}
+	}
+	return 0, errors.New("query hash:net revision: no revision in reply")
+}
+
+func ipsetMsgType(cmd uint16) uint16 {
+	return nfnlSubsysIPSet<<8 | cmd
+}
+
+// ipsetPayload prepends the nfgenmsg header and the protocol attribute that
+// every ipset request carries.
+func ipsetPayload(family uint8, attrs ...[]byte) []byte {
+	b := []byte{family, nfnetlinkV0, 0, 0}
+	b = append(b, attrU8(ipsetAttrProtocol, ipsetProtocol)...)
+	for _, a := range attrs {
+		b = append(b, a...)
+	}
+	return b
+}
+
+func createData(o SetOptions) []byte {
+	var children [][]byte
+	if o.HashSize > 0 {
+		children = append(children, attrU32(ipsetAttrHashSize, uint32(o.HashSize)))
+	}
+	if o.MaxElem > 0 {
+		children = append(children, attrU32(ipsetAttrMaxElem, uint32(o.MaxElem)))
+	}
+	if o.Timeout > 0 {
+		children = append(children, attrU32(ipsetAttrTimeout, uint32(o.Timeout)))
+	}
+	var flags uint32
+	if o.Counters {
+		flags |= ipsetFlagWithCounters
+	}
+	if o.Comment {
+		flags |= ipsetFlagWithComment
+	}
+	if flags != 0 {
+		children = append(children, attrU32(ipsetAttrCadtFlags, flags))
+	}
+	return attrNested(ipsetAttrData, children...)
+}
+
+func prefixData(cidr, comment string) ([]byte, uint8, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(cidr)
+		if addrErr != nil {
+			return nil, 0, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		p = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	p = p.Masked()
+
+	addr := p.Addr()
+	family := uint8(nfprotoIPv4)
+	var ip []byte
+	if addr.Is4() {
+		a := addr.As4()
+		ip = attr(ipsetAttrIPAddrIPv4|nlaFNetByteorder, a[:])
+	} else {
+		a := addr.As16()
+		ip = attr(ipsetAttrIPAddrIPv6|nlaFNetByteorder, a[:])
+		family = nfprotoIPv6
+	}
+
+	children := [][]byte{
+		attrNested(ipsetAttrIP, ip),
+		attrU8(ipsetAttrCIDR, uint8(p.Bits())),
+	}
+	if comment != "" {
+		children = append(children, attrString(ipsetAttrComment, comment))
+	}
+	return attrNested(ipsetAttrData, children...), family, nil
+}
+
+// parseListReply adds the header and members carried in one
+// IPSET_CMD_LIST reply to info.
+func parseListReply(msg []byte, info *setInfo) error {
+	if len(msg) < 4 {
+		return errors.New("short ipset list reply")
+	}
+	attrs, err := parseAttrs(msg[4:])
+	if err != nil {
+		return err
+	}
+
+	for _, a := range attrs {
+		switch a.typ {
+		case ipsetAttrTypename:
+			info.typ = strings.TrimRight(string(a.data), "\x00")
+		case ipsetAttrFamily:
+			if len(a.data) >= 1 && a.data[0] == nfprotoIPv6 {
+				info.family = familyInet6
+			}
+		case ipsetAttrData:
+			if err := parseListHeader(a.data, info); err != nil {
+				return err
+			}
+		case ipsetAttrADT:
+			entries, err := parseAttrs(a.data)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if e.typ != ipsetAttrData {
+					continue
+				}
+				m, err := parseEntry(e.data)
+				if err != nil {
+					return err
+				}
+				info.members = append(info.members, m)
+			}
+		}
+	}
+	return nil
+}
+
+func parseListHeader(b []byte, info *setInfo) error {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		if len(a.data) != 4 {
+			continue
+		}
+		v := int(binary.BigEndian.Uint32(a.data))
+		switch a.typ {
+		case ipsetAttrHashSize:
+			info.opts.HashSize = v
+		case ipsetAttrMaxElem:
+			info.opts.MaxElem = v
+		case ipsetAttrTimeout:
+			info.opts.Timeout = v
+		case ipsetAttrCadtFlags:
+			info.opts.Counters = v&ipsetFlagWithCounters != 0
+			info.opts.Comment = v&ipsetFlagWithComment != 0
+		}
+	}
+	return nil
+}
+
+func parseEntry(b []byte) (string, error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		addr netip.Addr
+		bits = -1
+	)
+	for _, a := range attrs {
+		switch a.typ {
+		case ipsetAttrIP:
+			ips, err := parseAttrs(a.data)
+			if err != nil {
+				return "", err
+			}
+			for _, ip := range ips {
+				if v, ok := netip.AddrFromSlice(ip.data); ok {
+					addr = v
+				}
+			}
+		case ipsetAttrCIDR:
+			if len(a.data) >= 1 {
+				bits = int(a.data[0])
+			}
+		}
+	}
+	if !addr.IsValid() {
+		return "", errors.New("ipset entry without address")
+	}
+	if bits < 0 {
+		bits = addr.BitLen()
+	}
+	return netip.PrefixFrom(addr, bits).String(), nil
+}
+
+type nlAttr struct {
+	typ  uint16
+	data []byte
+}
+
+func attr(typ uint16, data []byte) []byte {
+	n := nlaHdrLen + len(data)
+	b := make([]byte, nlaAlign(n))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(n))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[nlaHdrLen:], data)
+	return b
+}
+
+func attrU8(typ uint16, v uint8) []byte {
+	return attr(typ, []byte{v})
+}
+
+// attrU32 encodes v in network byte order, as ipset expects.
+func attrU32(typ uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return attr(typ|nlaFNetByteorder, b)
+}
+
+func attrString(typ uint16, s string) []byte {
+	return attr(typ, append([]byte(s), 0))
+}
+
+func attrNested(typ uint16, children ...[]byte) []byte {
+	var data []byte
+	for _, c := range children {
+		data = append(data, c...)
+	}
+	return attr(typ|nlaFNested, data)
+}
+
+func parseAttrs(b []byte) ([]nlAttr, error) {
+	var attrs []nlAttr
+	for len(b) >= nlaHdrLen {
+		n := int(binary.NativeEndian.Uint16(b[0:2]))
+		if n < nlaHdrLen || n > len(b) {
+			return nil, errors.New("malformed netlink attribute")
+		}
+		attrs = append(attrs, nlAttr{
+			typ:  binary.NativeEndian.Uint16(b[2:4]) & nlaTypeMask,
+			data: b[nlaHdrLen:n],
+		})
+		if a := nlaAlign(n); a < len(b) {
+			b = b[a:]
+		} else {
+			break
+		}
+	}
+	return attrs, nil
+}
+
+func nlaAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+func nlMessage(msgType, flags uint16, seq uint32, payload []byte) []byte {
+	b := make([]byte, nlmsgHdrLen, nlmsgHdrLen+len(payload))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(nlmsgHdrLen+len(payload)))
+	binary.NativeEndian.PutUint16(b[4:6], msgType)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	return append(b, payload...)
+}
+
+// parseReplies splits a datagram into messages for seq. It reports done once
+// the request is complete: an ack, an error, NLMSG_DONE, or a single-part
+// reply.
+func parseReplies(b []byte, seq uint32) (payloads [][]byte, done bool, err error) {
+	for len(b) >= nlmsgHdrLen {
+		n := int(binary.NativeEndian.Uint32(b[0:4]))
+		if n < nlmsgHdrLen || n > len(b) {
+			return nil, false, errors.New("malformed netlink message")
+		}
+		typ := binary.NativeEndian.Uint16(b[4:6])
+		flags := binary.NativeEndian.Uint16(b[6:8])
+		msgSeq := binary.NativeEndian.Uint32(b[8:12])
+		body := b[nlmsgHdrLen:n]
+		b = b[min(nlaAlign(n), len(b)):]
+
+		if msgSeq != seq {
+			continue
+		}
+		switch typ {
+		case nlmsgDone:
+			return payloads, true, nil
+		case nlmsgError:
+			if len(body) < 4 {
+				return nil, false, errors.New("short netlink error message")
+			}
+			if code := int32(binary.NativeEndian.Uint32(body[0:4])); code != 0 {
+				return nil, true, ipsetErrno(int(-code))
+			}
+			return payloads, true, nil
+		default:
+			payloads = append(payloads, body)
+			if flags&nlmFMulti == 0 {
+				done = true
+			}
+		}
+	}
+	return payloads, done, nil
+}
+
+func ipsetErrno(code int) error {
+	if msg, ok := ipsetErrors[code]; ok {
+		return fmt.Errorf("%s (errno %d)", msg, code)
+	}
+	if code >= ipsetErrPrivate {
+		return fmt.Errorf("ipset error %d", code)
+	}
+	return syscall.Errno(code)
+}
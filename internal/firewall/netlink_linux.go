@@ -0,0 +1,92 @@
+//go:build linux
+
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	netlinkNetfilter = 12
+	// netlinkReplyTimeouts is how many one-second receive timeouts a request
+	// waits for its reply. Rollbacks run without a deadline of their own, so
+	// a lost reply must not block them forever.
+	netlinkReplyTimeouts = 30
+)
+
+type netlinkConn struct {
+	fd  int
+	seq uint32
+	buf []byte
+}
+
+func dialNetlink() (nlConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return nil, fmt.Errorf("open netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("bind netlink socket: %w", err)
+	}
+	return &netlinkConn{
+		fd:  fd,
+		seq: uint32(time.Now().Unix()),
+		buf: make([]byte, 64*1024),
+	}, nil
+}
+
+func (c *netlinkConn) Execute(ctx context.Context, msgType, flags uint16, payload []byte) ([][]byte, error) {
+	c.seq++
+	seq := c.seq
+
+	// Bound each receive so a cancelled context is noticed.
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return nil, fmt.Errorf("set netlink timeout: %w", err)
+	}
+
+	msg := nlMessage(msgType, flags, seq, payload)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("send netlink message: %w", err)
+	}
+
+	var out [][]byte
+	timeouts := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, _, err := syscall.Recvfrom(c.fd, c.buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				if timeouts++; timeouts == netlinkReplyTimeouts {
+					return nil, fmt.Errorf("no netlink reply after %ds", netlinkReplyTimeouts)
+				}
+				continue
+			}
+			if err == syscall.EINTR {
+				continue
+			}
+			return nil, fmt.Errorf("receive netlink message: %w", os.NewSyscallError("recvfrom", err))
+		}
+		payloads, done, err := parseReplies(c.buf[:n], seq)
+		for _, p := range payloads {
+			out = append(out, append([]byte(nil), p...))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return out, nil
+		}
+	}
+}
+
+func (c *netlinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package firewall
+
+import "errors"
+
+func dialNetlink() (nlConn, error) {
+	return nil, errors.New("netlink backend is only supported on linux")
+}
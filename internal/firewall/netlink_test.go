@@ -0,0 +1,252 @@
+package firewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type fakeConn struct {
+	reqs    []fakeRequest
+	replies map[uint16][][]byte
+	failAt  int
+	err     error
+	closed  bool
+}
+
+type fakeRequest struct {
+	msgType uint16
+	flags   uint16
+	attrs   []nlAttr
+}
+
+func (f *fakeConn) Execute(ctx context.Context, msgType, flags uint16, payload []byte) ([][]byte, error) {
+	if f.failAt >= 0 && len(f.reqs) == f.failAt {
+		return nil, f.err
+	}
+	attrs, err := parseAttrs(payload[4:])
+	if err != nil {
+		return nil, err
+	}
+	f.reqs = append(f.reqs, fakeRequest{msgType: msgType, flags: flags, attrs: attrs})
+	return f.replies[msgType&0xff], nil
+}
+
+func (f *fakeConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (r fakeRequest) attr(typ uint16) []byte {
+	for _, a := range r.attrs {
+		if a.typ == typ {
+			return a.data
+		}
+	}
+	return nil
+}
+
+func typeReply(rev uint8) []byte {
+	return ipsetPayload(nfprotoIPv4, attrU8(ipsetAttrRevision, rev))
+}
+
+func TestNetlinkApplyEncodesOps(t *testing.T) {
+	fc := &fakeConn{
+		failAt:  -1,
+		replies: map[uint16][][]byte{ipsetCmdType: {typeReply(7)}},
+	}
+	d := &netlinkDriver{dial: func() (nlConn, error) { return fc, nil }}
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/32"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	if err := d.Apply(context.Background(), txOps(swapTx(familyUpdates(cfg)))); err != nil {
+		t.Fatalf("Apply error: %v", err)
+	}
+	if !fc.closed {
+		t.Fatalf("expected connection to be closed")
+	}
+
+	var cmds []uint16
+	for _, r := range fc.reqs {
+		if r.msgType>>8 != nfnlSubsysIPSet {
+			t.Fatalf("unexpected subsystem in message type %#x", r.msgType)
+		}
+		cmds = append(cmds, r.msgType&0xff)
+	}
+	expected := []uint16{
+		ipsetCmdType, ipsetCmdCreate, ipsetCmdFlush, ipsetCmdAdd,
+		ipsetCmdType, ipsetCmdCreate, ipsetCmdFlush, ipsetCmdAdd,
+		ipsetCmdCreate, ipsetCmdCreate,
+		ipsetCmdSwap, ipsetCmdSwap,
+		ipsetCmdDestroy, ipsetCmdDestroy,
+	}
+	if len(cmds) != len(expected) {
+		t.Fatalf("unexpected commands: got %v want %v", cmds, expected)
+	}
+	for i := range expected {
+		if cmds[i] != expected[i] {
+			t.Fatalf("command %d mismatch: got %d want %d", i, cmds[i], expected[i])
+		}
+	}
+
+	create := fc.reqs[1]
+	if got := string(create.attr(ipsetAttrSetname)); got != "v4_tmp\x00" {
+		t.Fatalf("unexpected create setname %q", got)
+	}
+	if got := create.attr(ipsetAttrRevision); len(got) != 1 || got[0] != 7 {
+		t.Fatalf("unexpected create revision %v", got)
+	}
+	// The temp set is created as with -exist, the live set exclusively.
+	if create.flags&nlmFExcl != 0 || fc.reqs[8].flags&nlmFExcl == 0 {
+		t.Fatalf("unexpected create flags %#x and %#x", create.flags, fc.reqs[8].flags)
+	}
+
+	add := fc.reqs[3]
+	entry, err := parseEntry(add.attr(ipsetAttrData))
+	if err != nil {
+		t.Fatalf("parse add entry: %v", err)
+	}
+	if entry != "1.1.1.0/24" {
+		t.Fatalf("unexpected add entry %q", entry)
+	}
+
+	swap := fc.reqs[10]
+	if got := string(swap.attr(ipsetAttrSetname2)); got != "v4_tmp\x00" {
+		t.Fatalf("unexpected swap setname2 %q", got)
+	}
+}
+
+func TestNetlinkCreateOptionsAndComment(t *testing.T) {
+	fc := &fakeConn{
+		failAt:  -1,
+		replies: map[uint16][][]byte{ipsetCmdType: {typeReply(7)}},
+	}
+	d := &netlinkDriver{dial: func() (nlConn, error) { return fc, nil }}
+
+	ops := []setOp{
+		{cmd: "create", set: "v4", family: familyInet, opts: SetOptions{HashSize: 4096, MaxElem: 131072, Timeout: 600, Comment: true}},
+		{cmd: "add", set: "v4", arg: "1.1.1.0/24", comment: "cloudflare"},
+		{cmd: "rename", set: "v4_tmp", arg: "v4"},
+	}
+	if err := d.Apply(context.Background(), ops); err != nil {
+		t.Fatalf("Apply error: %v", err)
+	}
+
+	data, err := parseAttrs(fc.reqs[1].attr(ipsetAttrData))
+	if err != nil {
+		t.Fatalf("parse create data: %v", err)
+	}
+	info := &setInfo{}
+	if err := parseListHeader(fc.reqs[1].attr(ipsetAttrData), info); err != nil {
+		t.Fatalf("parse create header: %v", err)
+	}
+	if len(data) != 4 || info.opts.HashSize != 4096 || info.opts.MaxElem != 131072 || info.opts.Timeout != 600 || !info.opts.Comment {
+		t.Fatalf("unexpected create options: %+v", info.opts)
+	}
+
+	entry, err := parseAttrs(fc.reqs[2].attr(ipsetAttrData))
+	if err != nil {
+		t.Fatalf("parse add data: %v", err)
+	}
+	var comment string
+	for _, a := range entry {
+		if a.typ == ipsetAttrComment {
+			comment = string(a.data)
+		}
+	}
+	if comment != "cloudflare\x00" {
+		t.Fatalf("unexpected comment %q", comment)
+	}
+
+	if fc.reqs[3].msgType&0xff != ipsetCmdRename {
+		t.Fatalf("expected rename command, got %d", fc.reqs[3].msgType&0xff)
+	}
+}
+
+func TestNetlinkApplyStopsOnError(t *testing.T) {
+	fc := &fakeConn{
+		failAt:  3,
+		err:     errors.New("boom"),
+		replies: map[uint16][][]byte{ipsetCmdType: {typeReply(7)}},
+	}
+	d := &netlinkDriver{dial: func() (nlConn, error) { return fc, nil }}
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	err := d.Apply(context.Background(), txOps(swapTx(familyUpdates(cfg))))
+	if err == nil || !strings.Contains(err.Error(), "op 3 (add v4_tmp 1.1.1.0/24 -exist): boom") {
+		t.Fatalf("expected error naming the add op, got %v", err)
+	}
+}
+
+func TestNetlinkList(t *testing.T) {
+	v4, _, _ := prefixData("1.1.1.0/24", "")
+	v6, _, _ := prefixData("2606:4700::/32", "")
+	host, _, _ := prefixData("10.0.0.1", "cloudflare")
+
+	reply := ipsetPayload(nfprotoIPv4,
+		attrString(ipsetAttrSetname, "v4"),
+		attrString(ipsetAttrTypename, "hash:net"),
+		attrU8(ipsetAttrFamily, nfprotoIPv4),
+		createData(SetOptions{MaxElem: 131072, Counters: true}),
+		attrNested(ipsetAttrADT, v4, v6, host),
+	)
+	fc := &fakeConn{
+		failAt:  -1,
+		replies: map[uint16][][]byte{ipsetCmdList: {reply}},
+	}
+	d := &netlinkDriver{dial: func() (nlConn, error) { return fc, nil }}
+
+	info, err := d.List(context.Background(), "v4")
+	if err != nil {
+		t.Fatalf("List error: %v", err)
+	}
+	want := []string{"1.1.1.0/24", "2606:4700::/32", "10.0.0.1/32"}
+	if strings.Join(info.members, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected members: %v", info.members)
+	}
+	if !info.swappable(familyInet) || info.opts.MaxElem != 131072 || !info.opts.Counters || info.opts.Comment {
+		t.Fatalf("unexpected header: %+v", info)
+	}
+	if fc.reqs[0].flags&nlmFDump != nlmFDump {
+		t.Fatalf("expected dump flag on list request")
+	}
+}
+
+func TestParseRepliesError(t *testing.T) {
+	body := make([]byte, 4+nlmsgHdrLen)
+	code := int32(-4101)
+	binary.NativeEndian.PutUint32(body[0:4], uint32(code))
+	msg := nlMessage(nlmsgError, 0, 42, body)
+
+	_, done, err := parseReplies(msg, 42)
+	if !done {
+		t.Fatalf("expected error to complete the request")
+	}
+	if err == nil || !strings.Contains(err.Error(), "second set does not exist") {
+		t.Fatalf("expected mapped ipset error, got %v", err)
+	}
+}
+
+func TestParseRepliesDump(t *testing.T) {
+	part := nlMessage(ipsetMsgType(ipsetCmdList), nlmFMulti, 7, ipsetPayload(nfprotoIPv4))
+	other := nlMessage(ipsetMsgType(ipsetCmdList), nlmFMulti, 6, ipsetPayload(nfprotoIPv4))
+	done := nlMessage(nlmsgDone, nlmFMulti, 7, make([]byte, 4))
+
+	payloads, finished, err := parseReplies(append(append(part, other...), done...), 7)
+	if err != nil {
+		t.Fatalf("parseReplies error: %v", err)
+	}
+	if !finished || len(payloads) != 1 {
+		t.Fatalf("unexpected result: done=%v payloads=%d", finished, len(payloads))
+	}
+}
@@ -0,0 +1,219 @@
+package firewall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const defaultNFTTable = "cf_ip_guard"
+
+// nftBackend keeps the ranges in named interval sets of an inet table and
+// replaces both families in a single nft transaction.
+type nftBackend struct{}
+
+func (nftBackend) Check(ctx context.Context) error {
+	if err := runner.Run(ctx, "nft", "list", "tables"); err != nil {
+		return fmt.Errorf("nft not available or permission denied: %w", err)
+	}
+	return nil
+}
+
+// Update always replaces both sets: the nft transaction is atomic, so there
+// is no window to avoid by patching. The live sets are only read to report
+// what changed, by coverage, since auto-merge stores prefixes joined.
+func (b nftBackend) Update(ctx context.Context, cfg UpdateConfig) (UpdateResult, error) {
+	res := UpdateResult{Added: len(cfg.IPv4CIDRs) + len(cfg.IPv6CIDRs), Swapped: true}
+	if live4, live6, err := b.List(ctx, cfg); err == nil {
+		added := append(uncovered(cfg.IPv4CIDRs, live4), uncovered(cfg.IPv6CIDRs, live6)...)
+		res.RemovedCIDRs = append(uncovered(live4, cfg.IPv4CIDRs), uncovered(live6, cfg.IPv6CIDRs)...)
+		res.Added = len(added)
+		res.Removed = len(res.RemovedCIDRs)
+	}
+
+	if err := nftApply(ctx, nftScript(cfg)); err != nil {
+		return UpdateResult{}, err
+	}
+	return res, nil
+}
+
+func (nftBackend) List(ctx context.Context, cfg UpdateConfig) ([]string, []string, error) {
+	v4, err := nftListSet(ctx, nftTable(cfg), cfg.IPv4SetName)
+	if err != nil {
+		return nil, nil, err
+	}
+	v6, err := nftListSet(ctx, nftTable(cfg), cfg.IPv6SetName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v4, v6, nil
+}
+
+func nftApply(ctx context.Context, script string) error {
+	if ir, ok := runner.(InputRunner); ok {
+		return ir.RunInput(ctx, script, "nft", "-f", "-")
+	}
+
+	f, err := os.CreateTemp("", "cf-ip-guard-*.nft")
+	if err != nil {
+		return fmt.Errorf("create nft script: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		return fmt.Errorf("write nft script: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write nft script: %w", err)
+	}
+
+	return runner.Run(ctx, "nft", "-f", f.Name())
+}
+
+func nftTable(cfg UpdateConfig) string {
+	if cfg.NFTTable == "" {
+		return defaultNFTTable
+	}
+	return cfg.NFTTable
+}
+
+func nftListSet(ctx context.Context, table, set string) ([]string, error) {
+	or, ok := runner.(OutputRunner)
+	if !ok {
+		return nil, errors.New("nft list: runner cannot capture output")
+	}
+	out, err := or.Output(ctx, "nft", "-j", "list", "set", "inet", table, set)
+	if err != nil {
+		return nil, err
+	}
+	return parseNFTSet(out)
+}
+
+// parseNFTSet extracts the elements from "nft -j list set" output. Elements
+// come as plain addresses, prefixes, or ranges when auto-merge joined
+// adjacent prefixes; ranges are split back into prefixes.
+func parseNFTSet(out []byte) ([]string, error) {
+	var doc struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []json.RawMessage `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("decode nft json: %w", err)
+	}
+
+	var members []string
+	for _, obj := range doc.Nftables {
+		if obj.Set == nil {
+			continue
+		}
+		for _, raw := range obj.Set.Elem {
+			m, err := parseNFTElem(raw)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, m...)
+		}
+	}
+	return members, nil
+}
+
+func parseNFTElem(raw json.RawMessage) ([]string, error) {
+	var addr string
+	if err := json.Unmarshal(raw, &addr); err == nil {
+		return []string{normalizeCIDR(addr)}, nil
+	}
+
+	var e struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+		Range []string `json:"range"`
+		Elem  *struct {
+			Val json.RawMessage `json:"val"`
+		} `json:"elem"`
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, fmt.Errorf("decode nft element: %w", err)
+	}
+
+	switch {
+	case e.Elem != nil:
+		return parseNFTElem(e.Elem.Val)
+	case e.Prefix != nil:
+		return []string{fmt.Sprintf("%s/%d", e.Prefix.Addr, e.Prefix.Len)}, nil
+	case len(e.Range) == 2:
+		from, err := netip.ParseAddr(e.Range[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := netip.ParseAddr(e.Range[1])
+		if err != nil {
+			return nil, err
+		}
+		var members []string
+		for _, p := range rangePrefixes(from, to) {
+			members = append(members, p.String())
+		}
+		return members, nil
+	}
+	return nil, fmt.Errorf("unsupported nft element: %s", raw)
+}
+
+// rangePrefixes returns the minimal prefixes covering from..to inclusive.
+func rangePrefixes(from, to netip.Addr) []netip.Prefix {
+	var out []netip.Prefix
+	for from.IsValid() && from.Compare(to) <= 0 {
+		bits := from.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1).Masked()
+			if p.Addr() != from || lastAddr(p).Compare(to) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		out = append(out, p)
+		from = lastAddr(p).Next()
+	}
+	return out
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(a)*8; i++ {
+		a[i/8] |= 1 << (7 - uint(i%8))
+	}
+	last, _ := netip.AddrFromSlice(a)
+	return last
+}
+
+func nftScript(cfg UpdateConfig) string {
+	table := nftTable(cfg)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\tauto-merge\n\t}\n", cfg.IPv4SetName)
+	fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\tauto-merge\n\t}\n", cfg.IPv6SetName)
+	b.WriteString("}\n")
+
+	fmt.Fprintf(&b, "flush set inet %s %s\n", table, cfg.IPv4SetName)
+	fmt.Fprintf(&b, "flush set inet %s %s\n", table, cfg.IPv6SetName)
+
+	if len(cfg.IPv4CIDRs) > 0 {
+		fmt.Fprintf(&b, "add element inet %s %s { %s }\n", table, cfg.IPv4SetName, strings.Join(cfg.IPv4CIDRs, ", "))
+	}
+	if len(cfg.IPv6CIDRs) > 0 {
+		fmt.Fprintf(&b, "add element inet %s %s { %s }\n", table, cfg.IPv6SetName, strings.Join(cfg.IPv6CIDRs, ", "))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,191 @@
+package firewall
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// scriptRunner records calls and the contents of any "-f" script argument.
+type scriptRunner struct {
+	calls   []string
+	scripts []string
+}
+
+func (s *scriptRunner) Run(ctx context.Context, name string, args ...string) error {
+	s.calls = append(s.calls, name+" "+strings.Join(args, " "))
+	if len(args) == 2 && args[0] == "-f" {
+		b, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		s.scripts = append(s.scripts, string(b))
+	}
+	return nil
+}
+
+func TestUpdateIPSetsNFT(t *testing.T) {
+	fr := &fakeRunner{failAt: -1}
+	orig := runner
+	runner = fr
+	defer func() { runner = orig }()
+	SetLogger(zap.NewNop().Sugar())
+
+	cfg := UpdateConfig{
+		Backend:     BackendNFT,
+		IPv4CIDRs:   []string{"1.1.1.0/24", "1.1.2.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/32"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+
+	if _, err := UpdateIPSets(context.Background(), cfg); err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+
+	if len(fr.calls) != 2 || fr.calls[1] != "nft -f -" {
+		t.Fatalf("expected a single nft -f - call, got %v", fr.calls)
+	}
+
+	expected := `table inet cf_ip_guard {
+	set v4 {
+		type ipv4_addr
+		flags interval
+		auto-merge
+	}
+	set v6 {
+		type ipv6_addr
+		flags interval
+		auto-merge
+	}
+}
+flush set inet cf_ip_guard v4
+flush set inet cf_ip_guard v6
+add element inet cf_ip_guard v4 { 1.1.1.0/24, 1.1.2.0/24 }
+add element inet cf_ip_guard v6 { 2606:4700::/32 }
+`
+	if fr.inputs[0] != expected {
+		t.Fatalf("unexpected script:\n%s", fr.inputs[0])
+	}
+}
+
+func TestUpdateIPSetsNFTScriptFile(t *testing.T) {
+	sr := &scriptRunner{}
+	orig := runner
+	runner = sr
+	defer func() { runner = orig }()
+	SetLogger(zap.NewNop().Sugar())
+
+	cfg := UpdateConfig{
+		Backend:     BackendNFT,
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+
+	if _, err := UpdateIPSets(context.Background(), cfg); err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+
+	if len(sr.calls) != 1 || !strings.HasPrefix(sr.calls[0], "nft -f ") {
+		t.Fatalf("expected a single nft -f call, got %v", sr.calls)
+	}
+	if sr.scripts[0] != nftScript(cfg) {
+		t.Fatalf("unexpected script:\n%s", sr.scripts[0])
+	}
+}
+
+func TestNFTScriptSkipsEmptyFamily(t *testing.T) {
+	script := nftScript(UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		NFTTable:    "guard",
+	})
+
+	if !strings.Contains(script, "flush set inet guard v6\n") {
+		t.Fatalf("expected v6 flush in script:\n%s", script)
+	}
+	if strings.Contains(script, "add element inet guard v6") {
+		t.Fatalf("unexpected v6 add element in script:\n%s", script)
+	}
+}
+
+func TestUpdateIPSetsNFTReportsDelta(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"nft -j list set inet cf_ip_guard v4": `{"nftables": [{"metainfo": {"json_schema_version": 1}}, {"set": {"family": "inet", "name": "v4", "table": "cf_ip_guard", "type": "ipv4_addr", "flags": ["interval"], "elem": [{"prefix": {"addr": "1.1.1.0", "len": 24}}, "10.0.0.1"]}}]}`,
+			"nft -j list set inet cf_ip_guard v6": `{"nftables": [{"set": {"name": "v6", "elem": [{"range": ["2606:4700::", "2606:4701:ffff:ffff:ffff:ffff:ffff:ffff"]}]}}]}`,
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		Backend:     BackendNFT,
+		IPv4CIDRs:   []string{"1.1.1.0/24", "1.0.0.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/31"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if res.Added != 1 || res.Removed != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+// Prefixes auto-merge joined are still allowed, so only the range that is
+// really gone is reported for conntrack cleanup.
+func TestUpdateIPSetsNFTRemovedByCoverage(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"nft -j list set inet cf_ip_guard v4": `{"nftables": [{"set": {"name": "v4", "elem": [{"prefix": {"addr": "10.0.0.0", "len": 23}}, {"prefix": {"addr": "192.0.2.0", "len": 24}}]}}]}`,
+			"nft -j list set inet cf_ip_guard v6": `{"nftables": [{"set": {"name": "v6"}}]}`,
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		Backend:     BackendNFT,
+		IPv4CIDRs:   []string{"10.0.0.0/24", "10.0.1.0/24", "192.0.2.0/25"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if res.Added != 0 || strings.Join(res.RemovedCIDRs, ",") != "192.0.2.128/25" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	from := netip.MustParseAddr("10.0.0.1")
+	to := netip.MustParseAddr("10.0.0.8")
+
+	var got []string
+	for _, p := range rangePrefixes(from, to) {
+		got = append(got, p.String())
+	}
+	want := "10.0.0.1/32,10.0.0.2/31,10.0.0.4/30,10.0.0.8/32"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("unexpected prefixes: %v", got)
+	}
+}
+
+func TestUpdateIPSetsUnknownBackend(t *testing.T) {
+	_, err := UpdateIPSets(context.Background(), UpdateConfig{Backend: "pf"})
+	if err == nil || !strings.Contains(err.Error(), "unsupported firewall backend") {
+		t.Fatalf("expected unsupported backend error, got %v", err)
+	}
+}
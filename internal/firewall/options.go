@@ -0,0 +1,152 @@
+package firewall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const defaultMaxElem = 65536
+
+// SetOptions are the hash:net creation parameters of one set. Zero values
+// leave the ipset defaults in place, except MaxElem which is sized from the
+// list being applied.
+type SetOptions struct {
+	HashSize int
+	MaxElem  int
+	// Timeout in seconds. The daemon re-adds all entries every cycle and
+	// at least every Timeout/2, so they only expire once it stops.
+	Timeout  int
+	Counters bool
+	// Comment tags each entry with UpdateConfig.Comment.
+	Comment bool
+}
+
+// ParseSetOptions parses a comma separated option list such as
+// "hashsize=4096,maxelem=131072,timeout=3600,counters,comment".
+func ParseSetOptions(s string) (SetOptions, error) {
+	var o SetOptions
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, hasVal := strings.Cut(part, "=")
+		switch key {
+		case "counters", "comment":
+			if hasVal {
+				return o, fmt.Errorf("set option %s takes no value", key)
+			}
+			if key == "counters" {
+				o.Counters = true
+			} else {
+				o.Comment = true
+			}
+		case "hashsize", "maxelem", "timeout":
+			n, err := strconv.Atoi(val)
+			if !hasVal || err != nil || n < 0 {
+				return o, fmt.Errorf("set option %s needs a non-negative number", key)
+			}
+			switch key {
+			case "hashsize":
+				o.HashSize = n
+			case "maxelem":
+				o.MaxElem = n
+			default:
+				o.Timeout = n
+			}
+		default:
+			return o, fmt.Errorf("unknown set option %q", key)
+		}
+	}
+	return o, nil
+}
+
+// sized fills in MaxElem so the set holds n entries with room to grow.
+func (o SetOptions) sized(n int) SetOptions {
+	if o.MaxElem > 0 {
+		return o
+	}
+	o.MaxElem = defaultMaxElem
+	for o.MaxElem < 2*n {
+		o.MaxElem *= 2
+	}
+	return o
+}
+
+// args renders the options for "ipset create", leaving out defaults.
+func (o SetOptions) args() []string {
+	var args []string
+	if o.HashSize > 0 {
+		args = append(args, "hashsize", strconv.Itoa(o.HashSize))
+	}
+	if o.MaxElem > 0 && o.MaxElem != defaultMaxElem {
+		args = append(args, "maxelem", strconv.Itoa(o.MaxElem))
+	}
+	if o.Timeout > 0 {
+		args = append(args, "timeout", strconv.Itoa(o.Timeout))
+	}
+	if o.Counters {
+		args = append(args, "counters")
+	}
+	if o.Comment {
+		args = append(args, "comment")
+	}
+	return args
+}
+
+// setInfo is what can be read back from a live set.
+type setInfo struct {
+	typ     string
+	family  string
+	opts    SetOptions
+	members []string
+}
+
+// swappable reports whether the kernel will swap the set with a hash:net
+// set of family.
+func (i *setInfo) swappable(family string) bool {
+	return i.typ == "hash:net" && i.family == family
+}
+
+// compatible reports whether the set can be patched in place to hold want.
+func (i *setInfo) compatible(family string, want SetOptions) bool {
+	return i.swappable(family) &&
+		i.opts.Counters == want.Counters &&
+		i.opts.Comment == want.Comment &&
+		i.opts.Timeout == want.Timeout &&
+		i.opts.MaxElem >= want.MaxElem
+}
+
+// parseIPSetHeader parses the "create" line of "ipset save" output.
+func parseIPSetHeader(fields []string) (*setInfo, error) {
+	if len(fields) < 3 || fields[0] != "create" {
+		return nil, fmt.Errorf("unexpected ipset header %q", strings.Join(fields, " "))
+	}
+	info := &setInfo{typ: fields[2], family: familyInet, opts: SetOptions{MaxElem: defaultMaxElem}}
+	for i := 3; i < len(fields); i++ {
+		switch fields[i] {
+		case "counters":
+			info.opts.Counters = true
+		case "comment":
+			info.opts.Comment = true
+		case "family", "hashsize", "maxelem", "timeout", "netmask", "bucketsize", "initval":
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("ipset header option %s without value", fields[i])
+			}
+			key, val := fields[i], fields[i+1]
+			i++
+			switch key {
+			case "family":
+				info.family = val
+			case "hashsize":
+				info.opts.HashSize, _ = strconv.Atoi(val)
+			case "maxelem":
+				info.opts.MaxElem, _ = strconv.Atoi(val)
+			case "timeout":
+				info.opts.Timeout, _ = strconv.Atoi(val)
+			}
+		}
+	}
+	return info, nil
+}
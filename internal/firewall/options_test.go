@@ -0,0 +1,119 @@
+package firewall
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseSetOptions(t *testing.T) {
+	o, err := ParseSetOptions("hashsize=4096, maxelem=131072,timeout=600,counters,comment")
+	if err != nil {
+		t.Fatalf("ParseSetOptions error: %v", err)
+	}
+	want := SetOptions{HashSize: 4096, MaxElem: 131072, Timeout: 600, Counters: true, Comment: true}
+	if o != want {
+		t.Fatalf("unexpected options: %+v", o)
+	}
+
+	for _, bad := range []string{"maxelem", "maxelem=-1", "counters=1", "probes=4"} {
+		if _, err := ParseSetOptions(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSetOptionsSized(t *testing.T) {
+	if got := (SetOptions{}).sized(100).MaxElem; got != defaultMaxElem {
+		t.Fatalf("unexpected maxelem for small list: %d", got)
+	}
+	if got := (SetOptions{}).sized(40000).MaxElem; got != 131072 {
+		t.Fatalf("unexpected maxelem for large list: %d", got)
+	}
+	if got := (SetOptions{MaxElem: 1024}).sized(40000).MaxElem; got != 1024 {
+		t.Fatalf("explicit maxelem should be kept, got %d", got)
+	}
+}
+
+func TestUpdateIPSetsOptionsAndComment(t *testing.T) {
+	fr := &fakeRunner{failAt: -1}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		IPv4Options: SetOptions{HashSize: 4096, Counters: true, Comment: true},
+		IPv6Options: SetOptions{MaxElem: 1024},
+		Comment:     "cloudflare 2026-10-17T00:00:00Z",
+	}
+	if _, err := UpdateIPSets(context.Background(), cfg); err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+
+	for _, line := range []string{
+		"create v4_tmp hash:net hashsize 4096 counters comment -exist\n",
+		`add v4_tmp 1.1.1.0/24 comment "cloudflare 2026-10-17T00:00:00Z" -exist` + "\n",
+		"create v6_tmp hash:net family inet6 maxelem 1024 -exist\n",
+	} {
+		if !strings.Contains(fr.inputs[0], line) {
+			t.Fatalf("expected %q in prepare script:\n%s", line, fr.inputs[0])
+		}
+	}
+}
+
+func TestUpdateIPSetsRecreatesIncompatibleSets(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			// Right family but created without counters: swapping fixes it.
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\nadd v4 1.1.1.0/24\n",
+			// Wrong type: cannot be swapped, so it is replaced.
+			"ipset save v6": "create v6 hash:ip family inet6 hashsize 1024 maxelem 65536\n",
+			// Leftover temp set from an earlier run.
+			"ipset save v4_tmp": "create v4_tmp hash:net family inet hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/32"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+		IPv4Options: SetOptions{Counters: true},
+	}
+	res, err := UpdateIPSets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("UpdateIPSets error: %v", err)
+	}
+	if !res.Swapped {
+		t.Fatalf("expected a swap, got %+v", res)
+	}
+
+	want := strings.Join([]string{
+		"destroy v4_tmp",
+		"create v4_tmp hash:net counters -exist",
+		"flush v4_tmp",
+		"add v4_tmp 1.1.1.0/24 -exist",
+		"create v6_tmp hash:net family inet6 -exist",
+		"flush v6_tmp",
+		"add v6_tmp 2606:4700::/32 -exist",
+		"swap v4 v4_tmp",
+		"rename v6 v6_old",
+		"rename v6_tmp v6",
+		"destroy v4_tmp",
+		"destroy v6_old",
+	}, "\n") + "\n"
+	if got := strings.Join(fr.inputs, ""); got != want {
+		t.Fatalf("unexpected restore script:\n%s", got)
+	}
+}
+
+func TestSplitRestoreLine(t *testing.T) {
+	got := splitRestoreLine(`add v4 1.1.1.0/24 comment "cloudflare 2026" -exist`)
+	want := []string{"add", "v4", "1.1.1.0/24", "comment", "cloudflare 2026", "-exist"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("unexpected split: %q", got)
+	}
+}
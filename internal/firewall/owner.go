@@ -0,0 +1,209 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/atomicfile"
+)
+
+// maxSetNameLen is IPSET_MAXNAMELEN minus the terminating NUL.
+const maxSetNameLen = 31
+
+// auxSetName derives the temp or rename-aside name of a set. Names that
+// would get too long are shortened and tagged with a hash of the full name,
+// so the result is stable across runs and distinct per set.
+func auxSetName(set, suffix string) string {
+	name := set + suffix
+	if len(name) <= maxSetNameLen {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(set))
+	tag := fmt.Sprintf("%08x", h.Sum32())
+	return set[:maxSetNameLen-len(tag)-len(suffix)] + tag + suffix
+}
+
+func validSetName(name string, maxLen int) error {
+	if name == "" {
+		return errors.New("set name is empty")
+	}
+	if len(name) > maxLen {
+		return fmt.Errorf("set name %q is longer than %d characters", name, maxLen)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return fmt.Errorf("set name %q contains %q", name, c)
+		}
+	}
+	return nil
+}
+
+// Validate checks the set names for the configured backend.
+func (cfg UpdateConfig) Validate() error {
+	maxLen := maxSetNameLen
+	if cfg.Backend == BackendNFT {
+		maxLen = 255
+	}
+	if err := validSetName(cfg.IPv4SetName, maxLen); err != nil {
+		return err
+	}
+	if err := validSetName(cfg.IPv6SetName, maxLen); err != nil {
+		return err
+	}
+	if cfg.IPv4SetName == cfg.IPv6SetName {
+		return fmt.Errorf("IPv4 and IPv6 sets are both named %q", cfg.IPv4SetName)
+	}
+	return nil
+}
+
+// Registry remembers which sets and rule chains cf-ip-guard created, so they
+// can be told apart from same-named ones made by other tools.
+type Registry struct {
+	path  string
+	mu    sync.Mutex
+	names map[string]bool
+	// legacy is set when no registry file existed at load, as after an
+	// upgrade from a version that did not record its sets.
+	legacy bool
+}
+
+var registry *Registry
+
+// SetRegistry enables ownership checks. Without a registry every set is
+// treated as owned.
+func SetRegistry(r *Registry) {
+	registry = r
+}
+
+// LoadRegistry reads the names recorded at path, one per line. A
+// missing file is an empty registry that takes over existing hash:net sets
+// with the configured names, which earlier versions created unrecorded.
+func LoadRegistry(path string) (*Registry, error) {
+	r := &Registry{path: path, names: map[string]bool{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		r.legacy = true
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			r.names[line] = true
+		}
+	}
+	return r, nil
+}
+
+func (r *Registry) Owns(name string) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.names[name]
+}
+
+// Record adds names to the registry and writes it out atomically.
+func (r *Registry) Record(names ...string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := false
+	for _, n := range names {
+		if !r.names[n] {
+			r.names[n] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return r.save()
+}
+
+// Forget drops names from the registry, once what they name is gone.
+func (r *Registry) Forget(names ...string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := false
+	for _, n := range names {
+		if r.names[n] {
+			delete(r.names, n)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return r.save()
+}
+
+func (r *Registry) save() error {
+	list := make([]string, 0, len(r.names))
+	for n := range r.names {
+		list = append(list, n)
+	}
+	sort.Strings(list)
+	return atomicfile.WriteFile(r.path, []byte(strings.Join(list, "\n")+"\n"))
+}
+
+func (cfg UpdateConfig) owns(set string) bool {
+	return cfg.AdoptSets || registry.Owns(set)
+}
+
+// chainEntry is the registry entry for a rule chain. Set names cannot
+// contain spaces, so it never collides with one.
+func chainEntry(chain string) string {
+	return "chain " + chain
+}
+
+// adoptsLegacy reports whether an unrecorded set that can hold family is
+// taken over because it predates the registry.
+func (r *Registry) adoptsLegacy(info *setInfo, family string) bool {
+	return r != nil && r.legacy && info.swappable(family)
+}
+
+// RemoveOrphans destroys temp and renamed-aside sets left behind by an
+// update that never finished, for the owned sets in cfg. It returns the
+// names it removed. The nft backend keeps no such sets.
+func RemoveOrphans(ctx context.Context, cfg UpdateConfig) ([]string, error) {
+	b, err := backendFor(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	ib, ok := b.(ipsetBackend)
+	if !ok {
+		return nil, nil
+	}
+
+	var removed []string
+	for _, f := range familyUpdates(cfg) {
+		if !cfg.owns(f.set) {
+			continue
+		}
+		for _, name := range []string{f.tmp, f.old} {
+			if _, err := ib.driver.List(ctx, name); err != nil {
+				continue
+			}
+			if err := ib.driver.Apply(ctx, []setOp{{cmd: "destroy", set: name}}); err != nil {
+				return removed, fmt.Errorf("destroy orphaned set %s: %w", name, err)
+			}
+			removed = append(removed, name)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,178 @@
+package firewall
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuxSetName(t *testing.T) {
+	if got := auxSetName("cloudflare4", "_tmp"); got != "cloudflare4_tmp" {
+		t.Fatalf("short name changed: %s", got)
+	}
+
+	a := auxSetName("cloudflare_origin_allowlist_v4", "_tmp")
+	b := auxSetName("cloudflare_origin_allowlist_v6", "_tmp")
+	if len(a) > maxSetNameLen || len(b) > maxSetNameLen {
+		t.Fatalf("temp names too long: %s %s", a, b)
+	}
+	if a == b || !strings.HasSuffix(a, "_tmp") {
+		t.Fatalf("temp names not distinct: %s %s", a, b)
+	}
+	if a != auxSetName("cloudflare_origin_allowlist_v4", "_tmp") {
+		t.Fatalf("temp name not stable")
+	}
+}
+
+func TestUpdateConfigValidate(t *testing.T) {
+	cases := []struct {
+		cfg UpdateConfig
+		ok  bool
+	}{
+		{UpdateConfig{IPv4SetName: "v4", IPv6SetName: "v6"}, true},
+		{UpdateConfig{IPv4SetName: "v4", IPv6SetName: ""}, false},
+		{UpdateConfig{IPv4SetName: "same", IPv6SetName: "same"}, false},
+		{UpdateConfig{IPv4SetName: "bad name", IPv6SetName: "v6"}, false},
+		{UpdateConfig{IPv4SetName: strings.Repeat("a", 32), IPv6SetName: "v6"}, false},
+		{UpdateConfig{Backend: BackendNFT, IPv4SetName: strings.Repeat("a", 32), IPv6SetName: "v6"}, true},
+	}
+	for _, c := range cases {
+		if err := c.cfg.Validate(); (err == nil) != c.ok {
+			t.Fatalf("Validate(%+v) = %v, want ok=%v", c.cfg, err, c.ok)
+		}
+	}
+}
+
+// withRegistry installs an empty registry whose file exists, as on any run
+// after the first.
+func withRegistry(t *testing.T) *Registry {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sets")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadRegistry error: %v", err)
+	}
+	SetRegistry(r)
+	t.Cleanup(func() { SetRegistry(nil) })
+	return r
+}
+
+func TestRegistryRecord(t *testing.T) {
+	r := withRegistry(t)
+	if r.Owns("v4") {
+		t.Fatalf("empty registry should own nothing")
+	}
+	if err := r.Record("v4", "v6"); err != nil {
+		t.Fatalf("Record error: %v", err)
+	}
+
+	loaded, err := LoadRegistry(r.path)
+	if err != nil {
+		t.Fatalf("LoadRegistry error: %v", err)
+	}
+	if !loaded.Owns("v4") || !loaded.Owns("v6") || loaded.Owns("other") {
+		t.Fatalf("unexpected registry contents: %v", loaded.names)
+	}
+}
+
+func TestUpdateIPSetsRefusesForeignSet(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+	r := withRegistry(t)
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	_, err := UpdateIPSets(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "not created by cf-ip-guard") {
+		t.Fatalf("expected foreign set error, got %v", err)
+	}
+	if len(fr.inputs) != 0 {
+		t.Fatalf("foreign set should not be modified: %v", fr.inputs)
+	}
+
+	cfg.AdoptSets = true
+	if _, err := UpdateIPSets(context.Background(), cfg); err != nil {
+		t.Fatalf("UpdateIPSets with AdoptSets error: %v", err)
+	}
+	if !r.Owns("v4") || !r.Owns("v6") {
+		t.Fatalf("adopted sets should be recorded")
+	}
+}
+
+// Sets made by a version without a registry are taken over on the first
+// run, unless their type or family is wrong.
+func TestUpdateIPSetsAdoptsLegacySets(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4": "create v4 hash:net family inet hashsize 1024 maxelem 65536\nadd v4 1.1.1.0/24\n",
+			"ipset save v6": "create v6 hash:ip family inet6 hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+	r, err := LoadRegistry(filepath.Join(t.TempDir(), "sets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRegistry(r)
+	t.Cleanup(func() { SetRegistry(nil) })
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	_, err = UpdateIPSets(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "set v6 exists but was not created") {
+		t.Fatalf("expected the hash:ip set to be refused, got %v", err)
+	}
+
+	fr.outputs["ipset save v6"] = "create v6 hash:net family inet6 hashsize 1024 maxelem 65536\n"
+	if _, err := UpdateIPSets(context.Background(), cfg); err != nil {
+		t.Fatalf("legacy sets not taken over: %v", err)
+	}
+	loaded, err := LoadRegistry(r.path)
+	if err != nil || !loaded.Owns("v4") || !loaded.Owns("v6") || loaded.legacy {
+		t.Fatalf("taken over sets not recorded: %+v, %v", loaded, err)
+	}
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"ipset save v4_tmp": "create v4_tmp hash:net family inet hashsize 1024 maxelem 65536\n",
+			"ipset save v6_tmp": "create v6_tmp hash:net family inet6 hashsize 1024 maxelem 65536\n",
+		},
+	}
+	withRunner(t, fr)
+	r := withRegistry(t)
+	if err := r.Record("v4"); err != nil {
+		t.Fatalf("Record error: %v", err)
+	}
+
+	removed, err := RemoveOrphans(context.Background(), UpdateConfig{IPv4SetName: "v4", IPv6SetName: "v6"})
+	if err != nil {
+		t.Fatalf("RemoveOrphans error: %v", err)
+	}
+	// v6 is not owned, so its temp set is left alone.
+	if len(removed) != 1 || removed[0] != "v4_tmp" {
+		t.Fatalf("unexpected removed sets: %v", removed)
+	}
+	if len(fr.inputs) != 1 || fr.inputs[0] != "destroy v4_tmp\n" {
+		t.Fatalf("unexpected restore input: %q", fr.inputs)
+	}
+}
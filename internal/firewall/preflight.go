@@ -2,12 +2,16 @@ package firewall
 
 import (
 	"context"
-	"fmt"
 )
 
 func CheckEnv(ctx context.Context) error {
-	if err := runner.Run(ctx, "ipset", "list"); err != nil {
-		return fmt.Errorf("ipset not available or permission denied: %w", err)
+	return CheckBackend(ctx, BackendIPSet)
+}
+
+func CheckBackend(ctx context.Context, name string) error {
+	b, err := backendFor(name)
+	if err != nil {
+		return err
 	}
-	return nil
+	return b.Check(ctx)
 }
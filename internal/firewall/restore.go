@@ -0,0 +1,172 @@
+package firewall
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// InputRunner is a Runner that can also feed a script to the command's stdin.
+type InputRunner interface {
+	Runner
+	RunInput(ctx context.Context, input string, name string, args ...string) error
+}
+
+// OutputRunner is a Runner that also returns the command's stdout.
+type OutputRunner interface {
+	Runner
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+func (r *execRunner) RunInput(ctx context.Context, input string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v failed: %w (output: %s)", name, args, err, string(out))
+	}
+	return nil
+}
+
+func (r *execRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %v failed: %w (output: %s)", name, args, err, stderr.String())
+	}
+	return out, nil
+}
+
+// execDriver drives the ipset binary.
+type execDriver struct{}
+
+func (execDriver) Check(ctx context.Context) error {
+	if err := runner.Run(ctx, "ipset", "list"); err != nil {
+		return fmt.Errorf("ipset not available or permission denied: %w", err)
+	}
+	return nil
+}
+
+func (execDriver) Apply(ctx context.Context, ops []setOp) error {
+	return ipsetRestore(ctx, ops)
+}
+
+func (execDriver) List(ctx context.Context, set string) (*setInfo, error) {
+	or, ok := runner.(OutputRunner)
+	if !ok {
+		return nil, fmt.Errorf("ipset list: runner cannot capture output")
+	}
+	out, err := or.Output(ctx, "ipset", "save", set)
+	if err != nil {
+		return nil, err
+	}
+	return parseIPSetSave(out)
+}
+
+// parseIPSetSave reads the header and members from "ipset save" output.
+// Host entries are printed without a prefix length, so one is added.
+func parseIPSetSave(out []byte) (*setInfo, error) {
+	var info *setInfo
+	var members []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "create":
+			h, err := parseIPSetHeader(fields)
+			if err != nil {
+				return nil, err
+			}
+			info = h
+		case "add":
+			if len(fields) >= 3 {
+				members = append(members, withPrefixLen(fields[2]))
+			}
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("ipset save: no set header in output")
+	}
+	info.members = members
+	return info, nil
+}
+
+func withPrefixLen(s string) string {
+	if strings.Contains(s, "/") {
+		return s
+	}
+	if strings.Contains(s, ":") {
+		return s + "/128"
+	}
+	return s + "/32"
+}
+
+// ipset reports restore failures as "Error in line N: ...".
+var restoreLineRe = regexp.MustCompile(`Error in line (\d+)`)
+
+// ipsetRestore applies ops in one "ipset restore" invocation. Runners
+// without stdin support get one process per op instead. Either way a
+// failure that can be traced to a line is reported as an *opError.
+func ipsetRestore(ctx context.Context, ops []setOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if ir, ok := runner.(InputRunner); ok {
+		var b strings.Builder
+		for _, op := range ops {
+			b.WriteString(op.String())
+			b.WriteByte('\n')
+		}
+		err := ir.RunInput(ctx, b.String(), "ipset", "restore")
+		if err == nil {
+			return nil
+		}
+		if m := restoreLineRe.FindStringSubmatch(err.Error()); m != nil {
+			if n, convErr := strconv.Atoi(m[1]); convErr == nil && n >= 1 && n <= len(ops) {
+				return &opError{what: "ipset restore line", index: n - 1, op: ops[n-1], err: err}
+			}
+		}
+		return fmt.Errorf("ipset restore: %w", err)
+	}
+
+	for i, op := range ops {
+		if err := runner.Run(ctx, "ipset", splitRestoreLine(op.String())...); err != nil {
+			return &opError{what: "ipset restore line", index: i, op: op, err: err}
+		}
+	}
+	return nil
+}
+
+// splitRestoreLine splits a restore line into arguments, keeping quoted
+// comments together.
+func splitRestoreLine(line string) []string {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return args
+		}
+		if line[0] == '"' {
+			if q, err := strconv.QuotedPrefix(line); err == nil {
+				s, _ := strconv.Unquote(q)
+				args = append(args, s)
+				line = line[len(q):]
+				continue
+			}
+		}
+		field, rest, _ := strings.Cut(line, " ")
+		args = append(args, field)
+		line = rest
+	}
+}
@@ -0,0 +1,264 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const DefaultChain = "CF-IP-GUARD"
+
+var defaultRulePorts = []int{80, 443}
+
+// RuleConfig describes the iptables/ip6tables chain owned by the daemon:
+// INPUT jumps to Chain for the given TCP ports, and Chain accepts sources in
+// the managed sets and drops everything else.
+type RuleConfig struct {
+	Chain       string
+	Ports       []int
+	IPv4SetName string
+	IPv6SetName string
+	// ExtraSets are further set pairs whose sources are accepted.
+	ExtraSets []SetPair
+}
+
+type SetPair struct {
+	IPv4 string
+	IPv6 string
+}
+
+type ruleFamily struct {
+	cmd  string
+	sets []string
+}
+
+func (cfg RuleConfig) withDefaults() RuleConfig {
+	if cfg.Chain == "" {
+		cfg.Chain = DefaultChain
+	}
+	if len(cfg.Ports) == 0 {
+		cfg.Ports = defaultRulePorts
+	}
+	return cfg
+}
+
+func (cfg RuleConfig) families() []ruleFamily {
+	v4 := ruleFamily{cmd: "iptables", sets: []string{cfg.IPv4SetName}}
+	v6 := ruleFamily{cmd: "ip6tables", sets: []string{cfg.IPv6SetName}}
+	for _, p := range cfg.ExtraSets {
+		v4.sets = append(v4.sets, p.IPv4)
+		v6.sets = append(v6.sets, p.IPv6)
+	}
+	return []ruleFamily{v4, v6}
+}
+
+// EnsureRules creates the chain and its INPUT jump in both families, and
+// repairs them if they were changed, deleted or reordered. It reports
+// whether anything had to be changed.
+func EnsureRules(ctx context.Context, cfg RuleConfig) (bool, error) {
+	cfg = cfg.withDefaults()
+	or, ok := runner.(OutputRunner)
+	if !ok {
+		return false, errors.New("manage rules: runner cannot capture output")
+	}
+
+	ir, ok := runner.(InputRunner)
+	if !ok {
+		return false, errors.New("manage rules: runner cannot feed a script")
+	}
+	if err := registry.Record(chainEntry(cfg.Chain)); err != nil {
+		return false, fmt.Errorf("record chain %s: %w", cfg.Chain, err)
+	}
+
+	changed := false
+	for _, fam := range cfg.families() {
+		c, err := ensureChain(ctx, or, ir, fam, cfg)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || c
+
+		c, err = ensureJump(ctx, or, fam, cfg)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// RemoveRules deletes the INPUT jumps and the chain in both families. A
+// missing chain is not an error, and a chain the daemon did not record as
+// its own is left alone unless it holds exactly the rules the daemon would
+// create and predates the registry.
+func RemoveRules(ctx context.Context, cfg RuleConfig) error {
+	cfg = cfg.withDefaults()
+	or, ok := runner.(OutputRunner)
+	if !ok {
+		return errors.New("remove rules: runner cannot capture output")
+	}
+
+	owned := registry.Owns(chainEntry(cfg.Chain))
+	for _, fam := range cfg.families() {
+		out, err := or.Output(ctx, fam.cmd, "-w", "-S", cfg.Chain)
+		if err != nil {
+			continue
+		}
+		if !owned && !(registry != nil && registry.legacy && sameRules(currentRules(out), chainRules(fam, cfg))) {
+			logger.Infow("leaving chain alone, it was not created by cf-ip-guard", "cmd", fam.cmd, "chain", cfg.Chain)
+			continue
+		}
+		input, err := or.Output(ctx, fam.cmd, "-w", "-S", "INPUT")
+		if err != nil {
+			return err
+		}
+		for _, rule := range jumpRules(input, cfg.Chain) {
+			if err := runner.Run(ctx, fam.cmd, append([]string{"-w", "-D"}, rule...)...); err != nil {
+				return err
+			}
+		}
+		if err := runner.Run(ctx, fam.cmd, "-w", "-F", cfg.Chain); err != nil {
+			return err
+		}
+		if err := runner.Run(ctx, fam.cmd, "-w", "-X", cfg.Chain); err != nil {
+			return err
+		}
+	}
+	if owned {
+		return registry.Forget(chainEntry(cfg.Chain))
+	}
+	return nil
+}
+
+func chainRules(fam ruleFamily, cfg RuleConfig) []string {
+	var rules []string
+	for _, set := range fam.sets {
+		rules = append(rules, fmt.Sprintf("-A %s -m set --match-set %s src -j ACCEPT", cfg.Chain, set))
+	}
+	return append(rules, fmt.Sprintf("-A %s -j DROP", cfg.Chain))
+}
+
+func jumpRule(cfg RuleConfig) string {
+	ports := make([]string, len(cfg.Ports))
+	for i, p := range cfg.Ports {
+		ports[i] = strconv.Itoa(p)
+	}
+	return fmt.Sprintf("-A INPUT -p tcp -m multiport --dports %s -j %s", strings.Join(ports, ","), cfg.Chain)
+}
+
+// currentRules returns the -A lines of an -S listing.
+func currentRules(out []byte) []string {
+	var rules []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, strings.TrimSpace(line))
+		}
+	}
+	return rules
+}
+
+func sameRules(a, b []string) bool {
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
+
+// ensureChain creates or rewrites the chain in one iptables-restore
+// transaction. Declaring an existing chain with --noflush empties it in the
+// same commit that adds the new rules, so the chain is never seen without
+// its DROP and a failed write leaves the old rules in place.
+func ensureChain(ctx context.Context, or OutputRunner, ir InputRunner, fam ruleFamily, cfg RuleConfig) (bool, error) {
+	out, err := or.Output(ctx, fam.cmd, "-w", "-S", cfg.Chain)
+	if err != nil {
+		out = nil
+	}
+	want := chainRules(fam, cfg)
+	if sameRules(currentRules(out), want) {
+		return false, nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*filter\n:%s - [0:0]\n", cfg.Chain)
+	for _, rule := range want {
+		b.WriteString(rule + "\n")
+	}
+	b.WriteString("COMMIT\n")
+	if err := ir.RunInput(ctx, b.String(), fam.cmd+"-restore", "-w", "--noflush"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ensureJump keeps exactly one jump to the chain, as the first INPUT rule.
+func ensureJump(ctx context.Context, or OutputRunner, fam ruleFamily, cfg RuleConfig) (bool, error) {
+	out, err := or.Output(ctx, fam.cmd, "-w", "-S", "INPUT")
+	if err != nil {
+		return false, err
+	}
+
+	want := jumpRule(cfg)
+	var first string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-A INPUT ") {
+			first = strings.TrimSpace(line)
+			break
+		}
+	}
+	if len(jumpRules(out, cfg.Chain)) == 1 && first == want {
+		return false, nil
+	}
+
+	// The new jump goes in before any old one is deleted, so the ports are
+	// never left without one.
+	if first != want {
+		args := append([]string{"-w", "-I", "INPUT", "1"}, strings.Fields(want)[2:]...)
+		if err := runner.Run(ctx, fam.cmd, args...); err != nil {
+			return false, err
+		}
+		if out, err = or.Output(ctx, fam.cmd, "-w", "-S", "INPUT"); err != nil {
+			return true, err
+		}
+	}
+	// Every jump after the first is stale. Deleting from the bottom keeps
+	// the numbers of the others valid.
+	nums := jumpNumbers(out, cfg.Chain)
+	for i := len(nums) - 1; i >= 1; i-- {
+		if err := runner.Run(ctx, fam.cmd, "-w", "-D", "INPUT", strconv.Itoa(nums[i])); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// jumpNumbers returns the INPUT rule numbers of the jumps to chain, in
+// order.
+func jumpNumbers(out []byte, chain string) []int {
+	var nums []int
+	n := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || fields[1] != "INPUT" {
+			continue
+		}
+		n++
+		if len(fields) >= 4 && fields[len(fields)-2] == "-j" && fields[len(fields)-1] == chain {
+			nums = append(nums, n)
+		}
+	}
+	return nums
+}
+
+// jumpRules returns the INPUT rules jumping to chain, as arguments for -D.
+func jumpRules(out []byte, chain string) [][]string {
+	var rules [][]string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "-A" || fields[1] != "INPUT" {
+			continue
+		}
+		if fields[len(fields)-2] == "-j" && fields[len(fields)-1] == chain {
+			rules = append(rules, fields[1:])
+		}
+	}
+	return rules
+}
@@ -0,0 +1,300 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func withRunner(t *testing.T, r Runner) {
+	t.Helper()
+	orig := runner
+	runner = r
+	t.Cleanup(func() { runner = orig })
+	SetLogger(zap.NewNop().Sugar())
+}
+
+func assertCalls(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("unexpected calls:\ngot  %s\nwant %s", strings.Join(got, "\n     "), strings.Join(want, "\n     "))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("call %d mismatch: got %q want %q", i, got[i], want[i])
+		}
+	}
+}
+
+var testRuleCfg = RuleConfig{IPv4SetName: "v4", IPv6SetName: "v6"}
+
+func TestEnsureRulesCreatesChain(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"iptables -w -S INPUT":  "-P INPUT ACCEPT\n-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT\n",
+			"ip6tables -w -S INPUT": "-P INPUT ACCEPT\n",
+		},
+	}
+	withRunner(t, fr)
+
+	changed, err := EnsureRules(context.Background(), testRuleCfg)
+	if err != nil {
+		t.Fatalf("EnsureRules error: %v", err)
+	}
+	if !changed {
+		t.Fatalf("expected changed=true")
+	}
+
+	assertCalls(t, fr.calls, []string{
+		"iptables -w -S CF-IP-GUARD",
+		"iptables-restore -w --noflush",
+		"iptables -w -S INPUT",
+		"iptables -w -I INPUT 1 -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD",
+		"iptables -w -S INPUT",
+		"ip6tables -w -S CF-IP-GUARD",
+		"ip6tables-restore -w --noflush",
+		"ip6tables -w -S INPUT",
+		"ip6tables -w -I INPUT 1 -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD",
+		"ip6tables -w -S INPUT",
+	})
+	assertCalls(t, fr.inputs, []string{
+		"*filter\n:CF-IP-GUARD - [0:0]\n-A CF-IP-GUARD -m set --match-set v4 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\nCOMMIT\n",
+		"*filter\n:CF-IP-GUARD - [0:0]\n-A CF-IP-GUARD -m set --match-set v6 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\nCOMMIT\n",
+	})
+}
+
+// A chain that lost its rules is rewritten in one restore, never flushed
+// and refilled rule by rule, so a failure cannot leave it without a DROP.
+func TestEnsureRulesRewritesChainAtomically(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: 1,
+		err:    errors.New("iptables-restore: line 3 failed"),
+		outputs: map[string]string{
+			"iptables -w -S CF-IP-GUARD": "-N CF-IP-GUARD\n-A CF-IP-GUARD -j DROP\n",
+		},
+	}
+	withRunner(t, fr)
+
+	if _, err := EnsureRules(context.Background(), testRuleCfg); err == nil {
+		t.Fatalf("expected the restore error")
+	}
+	assertCalls(t, fr.calls, []string{"iptables -w -S CF-IP-GUARD"})
+}
+
+func TestEnsureRulesInSync(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"iptables -w -S CF-IP-GUARD":  "-N CF-IP-GUARD\n-A CF-IP-GUARD -m set --match-set v4 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\n",
+			"iptables -w -S INPUT":        "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD\n",
+			"ip6tables -w -S CF-IP-GUARD": "-N CF-IP-GUARD\n-A CF-IP-GUARD -m set --match-set v6 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\n",
+			"ip6tables -w -S INPUT":       "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD\n",
+		},
+	}
+	withRunner(t, fr)
+
+	changed, err := EnsureRules(context.Background(), testRuleCfg)
+	if err != nil {
+		t.Fatalf("EnsureRules error: %v", err)
+	}
+	if changed {
+		t.Fatalf("expected no changes, got calls %v", fr.calls)
+	}
+	if len(fr.calls) != 4 {
+		t.Fatalf("expected only reads, got %v", fr.calls)
+	}
+}
+
+func TestEnsureRulesRepairsOrder(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"iptables -w -S CF-IP-GUARD":  "-N CF-IP-GUARD\n-A CF-IP-GUARD -m set --match-set v4 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\n",
+			"iptables -w -S INPUT":        "-P INPUT ACCEPT\n-A INPUT -p tcp -m tcp --dport 443 -j ACCEPT\n-A INPUT -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD\n",
+			"ip6tables -w -S CF-IP-GUARD": "-N CF-IP-GUARD\n-A CF-IP-GUARD -m set --match-set v6 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\n",
+			"ip6tables -w -S INPUT":       "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD\n",
+		},
+	}
+	fr.onRun = func(call string) {
+		if call == "iptables -w -I INPUT 1 -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD" {
+			fr.outputs["iptables -w -S INPUT"] = "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD\n" +
+				"-A INPUT -p tcp -m tcp --dport 443 -j ACCEPT\n-A INPUT -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD\n"
+		}
+	}
+	withRunner(t, fr)
+
+	changed, err := EnsureRules(context.Background(), testRuleCfg)
+	if err != nil {
+		t.Fatalf("EnsureRules error: %v", err)
+	}
+	if !changed {
+		t.Fatalf("expected changed=true")
+	}
+
+	// The new jump is in place before the old one goes.
+	assertCalls(t, fr.calls, []string{
+		"iptables -w -S CF-IP-GUARD",
+		"iptables -w -S INPUT",
+		"iptables -w -I INPUT 1 -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD",
+		"iptables -w -S INPUT",
+		"iptables -w -D INPUT 3",
+		"ip6tables -w -S CF-IP-GUARD",
+		"ip6tables -w -S INPUT",
+	})
+}
+
+// Changed ports get their jump before the old one is deleted, and a failed
+// insert leaves the old jump in place.
+func TestEnsureRulesChangesPortsWithoutGap(t *testing.T) {
+	chains := map[string]string{
+		"iptables -w -S CF-IP-GUARD": "-N CF-IP-GUARD\n-A CF-IP-GUARD -m set --match-set v4 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\n",
+		"iptables -w -S INPUT":       "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 443 -j CF-IP-GUARD\n",
+	}
+	fr := &fakeRunner{failAt: 2, err: errors.New("iptables: no chain"), outputs: chains}
+	withRunner(t, fr)
+
+	if _, err := EnsureRules(context.Background(), testRuleCfg); err == nil {
+		t.Fatalf("expected the insert error")
+	}
+	assertCalls(t, fr.calls, []string{"iptables -w -S CF-IP-GUARD", "iptables -w -S INPUT"})
+
+	fr.calls, fr.failAt = nil, -1
+	fr.onRun = func(call string) {
+		if strings.HasPrefix(call, "iptables -w -I INPUT 1") {
+			chains["iptables -w -S INPUT"] = "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD\n" +
+				"-A INPUT -p tcp -m multiport --dports 443 -j CF-IP-GUARD\n"
+		}
+	}
+	if _, err := EnsureRules(context.Background(), testRuleCfg); err == nil {
+		t.Fatalf("expected an error for the missing ip6tables chain")
+	}
+	assertCalls(t, fr.calls[:5], []string{
+		"iptables -w -S CF-IP-GUARD",
+		"iptables -w -S INPUT",
+		"iptables -w -I INPUT 1 -p tcp -m multiport --dports 80,443 -j CF-IP-GUARD",
+		"iptables -w -S INPUT",
+		"iptables -w -D INPUT 2",
+	})
+}
+
+func TestRemoveRules(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"iptables -w -S CF-IP-GUARD": "-N CF-IP-GUARD\n-A CF-IP-GUARD -j DROP\n",
+			"iptables -w -S INPUT":       "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 443 -j CF-IP-GUARD\n",
+		},
+	}
+	withRunner(t, fr)
+
+	if err := RemoveRules(context.Background(), testRuleCfg); err != nil {
+		t.Fatalf("RemoveRules error: %v", err)
+	}
+
+	assertCalls(t, fr.calls, []string{
+		"iptables -w -S CF-IP-GUARD",
+		"iptables -w -S INPUT",
+		"iptables -w -D INPUT -p tcp -m multiport --dports 443 -j CF-IP-GUARD",
+		"iptables -w -F CF-IP-GUARD",
+		"iptables -w -X CF-IP-GUARD",
+		"ip6tables -w -S CF-IP-GUARD",
+	})
+}
+
+func TestRemoveRulesOnlyOwnedChains(t *testing.T) {
+	ours := map[string]string{
+		"iptables -w -S CF-IP-GUARD": "-N CF-IP-GUARD\n-A CF-IP-GUARD -m set --match-set v4 src -j ACCEPT\n-A CF-IP-GUARD -j DROP\n",
+		"iptables -w -S INPUT":       "-P INPUT ACCEPT\n",
+	}
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"iptables -w -S CF-IP-GUARD": "-N CF-IP-GUARD\n-A CF-IP-GUARD -s 192.0.2.1/32 -j ACCEPT\n",
+		},
+	}
+	withRunner(t, fr)
+	r := withRegistry(t)
+
+	// A same-named chain an admin made is not touched.
+	if err := RemoveRules(context.Background(), testRuleCfg); err != nil {
+		t.Fatalf("RemoveRules error: %v", err)
+	}
+	assertCalls(t, fr.calls, []string{"iptables -w -S CF-IP-GUARD", "ip6tables -w -S CF-IP-GUARD"})
+
+	// Nor is one that looks like ours but was never recorded.
+	fr.calls, fr.outputs = nil, ours
+	if err := RemoveRules(context.Background(), testRuleCfg); err != nil {
+		t.Fatalf("RemoveRules error: %v", err)
+	}
+	assertCalls(t, fr.calls, []string{"iptables -w -S CF-IP-GUARD", "ip6tables -w -S CF-IP-GUARD"})
+
+	// A recorded chain is removed and forgotten.
+	if err := r.Record(chainEntry(DefaultChain)); err != nil {
+		t.Fatal(err)
+	}
+	fr.calls = nil
+	if err := RemoveRules(context.Background(), testRuleCfg); err != nil {
+		t.Fatalf("RemoveRules error: %v", err)
+	}
+	assertCalls(t, fr.calls, []string{
+		"iptables -w -S CF-IP-GUARD",
+		"iptables -w -S INPUT",
+		"iptables -w -F CF-IP-GUARD",
+		"iptables -w -X CF-IP-GUARD",
+		"ip6tables -w -S CF-IP-GUARD",
+	})
+	if r.Owns(chainEntry(DefaultChain)) {
+		t.Fatalf("removed chain still recorded")
+	}
+
+	// Before the registry existed, a chain holding exactly our rules is ours.
+	legacy, err := LoadRegistry(filepath.Join(t.TempDir(), "sets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRegistry(legacy)
+	fr.calls = nil
+	if err := RemoveRules(context.Background(), testRuleCfg); err != nil {
+		t.Fatalf("RemoveRules error: %v", err)
+	}
+	if len(fr.calls) != 5 {
+		t.Fatalf("legacy chain not removed: %v", fr.calls)
+	}
+}
+
+func TestEnsureRulesRecordsChain(t *testing.T) {
+	fr := &fakeRunner{
+		failAt: -1,
+		outputs: map[string]string{
+			"iptables -w -S INPUT":  "-P INPUT ACCEPT\n",
+			"ip6tables -w -S INPUT": "-P INPUT ACCEPT\n",
+		},
+	}
+	withRunner(t, fr)
+	r := withRegistry(t)
+
+	if _, err := EnsureRules(context.Background(), testRuleCfg); err != nil {
+		t.Fatalf("EnsureRules error: %v", err)
+	}
+	if !r.Owns(chainEntry(DefaultChain)) {
+		t.Fatalf("managed chain not recorded")
+	}
+}
+
+func TestChainRulesExtraSets(t *testing.T) {
+	cfg := testRuleCfg
+	cfg.ExtraSets = []SetPair{{IPv4: "jd4", IPv6: "jd6"}}
+	cfg = cfg.withDefaults()
+
+	fams := cfg.families()
+	assertCalls(t, chainRules(fams[1], cfg), []string{
+		"-A CF-IP-GUARD -m set --match-set v6 src -j ACCEPT",
+		"-A CF-IP-GUARD -m set --match-set jd6 src -j ACCEPT",
+		"-A CF-IP-GUARD -j DROP",
+	})
+}
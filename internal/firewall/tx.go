@@ -0,0 +1,135 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// opError reports which op of a batch failed.
+type opError struct {
+	what  string
+	index int
+	op    setOp
+	err   error
+}
+
+func (e *opError) Error() string {
+	return fmt.Sprintf("%s %d (%s): %v", e.what, e.index+1, e.op, e.err)
+}
+
+func (e *opError) Unwrap() error {
+	return e.err
+}
+
+// ApplyError is returned when an update failed part way. Step names the
+// operation that failed; RolledBack tells whether the live sets were put
+// back the way they were.
+type ApplyError struct {
+	Step        string
+	Err         error
+	RolledBack  bool
+	RollbackErr error
+}
+
+func (e *ApplyError) Error() string {
+	if e.RolledBack {
+		return fmt.Sprintf("update step %q failed, rolled back: %v", e.Step, e.Err)
+	}
+	return fmt.Sprintf("update step %q failed, rollback failed (%v): %v", e.Step, e.RollbackErr, e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// step is an op that changes the live sets, with the ops that undo it.
+type step struct {
+	op   setOp
+	undo []setOp
+}
+
+// transaction applies an update to both families as one unit. prepare only
+// touches temp sets. commit changes the live sets in one batch; if a commit
+// step fails the completed ones are undone in reverse order. abort runs
+// after a failure and cleanup after success, both best effort.
+type transaction struct {
+	prepare []setOp
+	commit  []step
+	// replayable marks undo ops that are harmless for steps that never ran,
+	// so a failure that cannot be traced to a step undoes all of them.
+	// Otherwise such a failure leaves the live sets for the next update to
+	// repair, since undoing a swap that never happened would break them.
+	replayable bool
+	cleanup    []setOp
+	abort      []setOp
+}
+
+func (tx transaction) run(ctx context.Context, d setDriver) error {
+	if err := d.Apply(ctx, tx.prepare); err != nil {
+		// Cleanup must run even if ctx was cancelled mid-update.
+		tx.runAbort(context.WithoutCancel(ctx), d)
+		return &ApplyError{Step: failedStep(err, "prepare temp sets"), Err: err, RolledBack: true}
+	}
+
+	done, err := tx.runCommit(ctx, d)
+	if err != nil {
+		// Rollback must run even if ctx was cancelled mid-update.
+		rctx := context.WithoutCancel(ctx)
+		if done < 0 {
+			tx.runAbort(rctx, d)
+			return &ApplyError{Step: "commit", Err: err, RollbackErr: errors.New("cannot tell which steps ran")}
+		}
+		var rollbackErrs []error
+		for i := done - 1; i >= 0; i-- {
+			if uerr := d.Apply(rctx, tx.commit[i].undo); uerr != nil {
+				rollbackErrs = append(rollbackErrs, fmt.Errorf("undo %s: %w", tx.commit[i].op, uerr))
+			}
+		}
+		tx.runAbort(rctx, d)
+		rbErr := errors.Join(rollbackErrs...)
+		return &ApplyError{Step: failedStep(err, "commit"), Err: err, RolledBack: rbErr == nil, RollbackErr: rbErr}
+	}
+
+	if err := d.Apply(ctx, tx.cleanup); err != nil {
+		logger.Warnw("destroy tmp set failed", "err", err)
+	}
+	return nil
+}
+
+// runCommit returns how many commit steps may have been applied, or -1 if
+// that is unknown and the undo ops must not be replayed.
+func (tx transaction) runCommit(ctx context.Context, d setDriver) (int, error) {
+	ops := make([]setOp, len(tx.commit))
+	for i, st := range tx.commit {
+		ops[i] = st.op
+	}
+	err := d.Apply(ctx, ops)
+	if err == nil {
+		return len(ops), nil
+	}
+	var oe *opError
+	if errors.As(err, &oe) {
+		return oe.index, err
+	}
+	if !tx.replayable {
+		return -1, err
+	}
+	return len(ops), err
+}
+
+func (tx transaction) runAbort(ctx context.Context, d setDriver) {
+	for _, op := range tx.abort {
+		if err := d.Apply(ctx, []setOp{op}); err != nil {
+			logger.Debugw("abort cleanup failed", "op", op.String(), "err", err)
+		}
+	}
+}
+
+func failedStep(err error, fallback string) string {
+	var oe *opError
+	if errors.As(err, &oe) {
+		return oe.op.String()
+	}
+	return fallback
+}
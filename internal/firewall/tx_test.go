@@ -0,0 +1,217 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// txOps flattens a transaction that runs without failures.
+func txOps(tx transaction) []setOp {
+	ops := append([]setOp(nil), tx.prepare...)
+	for _, st := range tx.commit {
+		ops = append(ops, st.op)
+	}
+	return append(ops, tx.cleanup...)
+}
+
+// scriptDriver records applied ops and fails the op matching failOn. With
+// untraced set the failure does not say which op it was.
+type scriptDriver struct {
+	applied  []string
+	failOn   string
+	untraced bool
+}
+
+func (d *scriptDriver) Check(ctx context.Context) error { return nil }
+
+func (d *scriptDriver) Apply(ctx context.Context, ops []setOp) error {
+	for i, op := range ops {
+		if op.String() == d.failOn {
+			if d.untraced {
+				return errors.New("boom")
+			}
+			return &opError{what: "test op", index: i, op: op, err: errors.New("boom")}
+		}
+		d.applied = append(d.applied, op.String())
+	}
+	return nil
+}
+
+func (d *scriptDriver) List(ctx context.Context, set string) (*setInfo, error) {
+	return nil, errors.New("not found")
+}
+
+func TestSwapTxRollsBackBothFamilies(t *testing.T) {
+	d := &scriptDriver{failOn: "swap v6 v6_tmp"}
+	withRunner(t, &fakeRunner{failAt: -1})
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/32"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+	fams := familyUpdates(cfg)
+	for _, f := range fams {
+		f.live = &setInfo{typ: "hash:net", family: f.family}
+	}
+
+	err := swapTx(fams).run(context.Background(), d)
+	var ae *ApplyError
+	if !errors.As(err, &ae) {
+		t.Fatalf("expected ApplyError, got %v", err)
+	}
+	if ae.Step != "swap v6 v6_tmp" || !ae.RolledBack {
+		t.Fatalf("unexpected apply error: %+v", ae)
+	}
+	if !strings.Contains(err.Error(), `update step "swap v6 v6_tmp" failed, rolled back`) {
+		t.Fatalf("unexpected error message: %v", err)
+	}
+
+	want := []string{
+		"create v4_tmp hash:net -exist",
+		"flush v4_tmp",
+		"add v4_tmp 1.1.1.0/24 -exist",
+		"create v6_tmp hash:net family inet6 -exist",
+		"flush v6_tmp",
+		"add v6_tmp 2606:4700::/32 -exist",
+		"swap v4 v4_tmp",
+		"swap v4 v4_tmp", // rollback
+		"destroy v4_tmp",
+		"destroy v6_tmp",
+	}
+	if strings.Join(d.applied, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected ops:\n%s", strings.Join(d.applied, "\n"))
+	}
+}
+
+func TestSwapTxPrepareFailureCleansUp(t *testing.T) {
+	d := &scriptDriver{failOn: "add v6_tmp 2606:4700::/32 -exist"}
+	withRunner(t, &fakeRunner{failAt: -1})
+
+	cfg := UpdateConfig{
+		IPv4CIDRs:   []string{"1.1.1.0/24"},
+		IPv6CIDRs:   []string{"2606:4700::/32"},
+		IPv4SetName: "v4",
+		IPv6SetName: "v6",
+	}
+
+	err := swapTx(familyUpdates(cfg)).run(context.Background(), d)
+	var ae *ApplyError
+	if !errors.As(err, &ae) || !ae.RolledBack || ae.Step != "add v6_tmp 2606:4700::/32 -exist" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, op := range d.applied {
+		if strings.HasPrefix(op, "swap") || op == "create v4 hash:net" {
+			t.Fatalf("live sets touched after prepare failure: %v", d.applied)
+		}
+	}
+	tail := d.applied[len(d.applied)-2:]
+	if tail[0] != "destroy v4_tmp" || tail[1] != "destroy v6_tmp" {
+		t.Fatalf("expected temp sets to be destroyed, got %v", d.applied)
+	}
+}
+
+func TestDeltaTxRollsBack(t *testing.T) {
+	d := &scriptDriver{failOn: "del v6 2400:cb00::/32 -exist"}
+	withRunner(t, &fakeRunner{failAt: -1})
+
+	fams := familyUpdates(UpdateConfig{IPv4SetName: "v4", IPv6SetName: "v6"})
+	deltas := []delta{
+		{added: []string{"1.1.5.0/24"}, removed: []string{"1.0.0.0/24"}},
+		{removed: []string{"2400:cb00::/32"}},
+	}
+
+	err := deltaTx(fams, deltas).run(context.Background(), d)
+	var ae *ApplyError
+	if !errors.As(err, &ae) || !ae.RolledBack {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"add v4 1.1.5.0/24 -exist",
+		"del v4 1.0.0.0/24 -exist",
+		"add v4 1.0.0.0/24 -exist", // undo del
+		"del v4 1.1.5.0/24 -exist", // undo add
+	}
+	if strings.Join(d.applied, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected ops:\n%s", strings.Join(d.applied, "\n"))
+	}
+}
+
+func TestTxReportsRollbackFailure(t *testing.T) {
+	d := &scriptDriver{failOn: "swap v6 v6_tmp"}
+	withRunner(t, &fakeRunner{failAt: -1})
+
+	fams := familyUpdates(UpdateConfig{IPv4SetName: "v4", IPv6SetName: "v6"})
+	for _, f := range fams {
+		f.live = &setInfo{typ: "hash:net", family: f.family}
+	}
+	tx := swapTx(fams)
+	// Make the undo of the first swap fail as well.
+	tx.commit[0].undo = []setOp{{cmd: "swap", set: "v6", arg: "v6_tmp"}}
+
+	err := tx.run(context.Background(), d)
+	var ae *ApplyError
+	if !errors.As(err, &ae) || ae.RolledBack || ae.RollbackErr == nil {
+		t.Fatalf("expected failed rollback, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "rollback failed") {
+		t.Fatalf("unexpected error message: %v", err)
+	}
+}
+
+// A swap batch that fails without saying where is not undone blindly, as
+// swapping back a pair that was never swapped would break it.
+func TestSwapTxUntracedFailureSkipsUndo(t *testing.T) {
+	d := &scriptDriver{failOn: "swap v6 v6_tmp", untraced: true}
+	withRunner(t, &fakeRunner{failAt: -1})
+
+	fams := familyUpdates(UpdateConfig{IPv4SetName: "v4", IPv6SetName: "v6"})
+	for _, f := range fams {
+		f.live = &setInfo{typ: "hash:net", family: f.family}
+	}
+
+	err := swapTx(fams).run(context.Background(), d)
+	var ae *ApplyError
+	if !errors.As(err, &ae) || ae.RolledBack || ae.RollbackErr == nil {
+		t.Fatalf("expected an unknown rollback state, got %v", err)
+	}
+	if n := strings.Count(strings.Join(d.applied, "\n"), "swap v4 v4_tmp"); n != 1 {
+		t.Fatalf("swap replayed after an untraced failure: %v", d.applied)
+	}
+}
+
+// Temp sets made before a shutdown interrupted prepare are still destroyed.
+func TestTxAbortsWithCancelledContext(t *testing.T) {
+	d := &ctxDriver{}
+	withRunner(t, &fakeRunner{failAt: -1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tx := transaction{
+		prepare: []setOp{{cmd: "create", set: "v4_tmp", family: familyInet}},
+		abort:   []setOp{{cmd: "destroy", set: "v4_tmp"}},
+	}
+	if err := tx.run(ctx, d); err == nil {
+		t.Fatalf("expected the prepare to fail")
+	}
+	if len(d.applied) != 1 || d.applied[0] != "destroy v4_tmp" {
+		t.Fatalf("temp set not destroyed: %v", d.applied)
+	}
+}
+
+// ctxDriver fails every op once its context is done, like a runner whose
+// process is killed.
+type ctxDriver struct {
+	scriptDriver
+}
+
+func (d *ctxDriver) Apply(ctx context.Context, ops []setOp) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.scriptDriver.Apply(ctx, ops)
+}
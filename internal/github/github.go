@@ -0,0 +1,91 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+const DefaultURL = "https://api.github.com/meta"
+
+// Client reads the ranges listed under Keys of GitHub's /meta document,
+// e.g. hooks, actions, api, web, git, pages.
+type Client struct {
+	HTTPClient *http.Client
+	URL        string
+	Keys       []string
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+func (c *Client) Name() string {
+	return "github"
+}
+
+// Fetch sends the ETag of the last fetch as If-None-Match. Versions carry
+// the selected keys, so the ETag is only reused for the same selection.
+func (c *Client) Fetch(ctx context.Context, prevVersion string) (*provider.Result, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{}
+	}
+	if c.URL == "" {
+		c.URL = DefaultURL
+	}
+	if len(c.Keys) == 0 {
+		return nil, fmt.Errorf("no /meta keys selected")
+	}
+	keys := strings.Join(c.Keys, ",")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if prevKeys, etag, ok := strings.Cut(prevVersion, "|"); ok && prevKeys == keys && etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	fresh := provider.FreshUntil(resp.Header, time.Now())
+
+	if resp.StatusCode == http.StatusNotModified {
+		return &provider.Result{Version: prevVersion, FreshUntil: fresh, NotModified: true}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, provider.NewStatusError(resp)
+	}
+
+	var meta map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+
+	res := &provider.Result{Version: keys + "|" + resp.Header.Get("ETag"), FreshUntil: fresh}
+	seen := map[string]bool{}
+	for _, key := range c.Keys {
+		raw, ok := meta[key]
+		if !ok {
+			return nil, fmt.Errorf("/meta has no key %q", key)
+		}
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, fmt.Errorf("/meta key %q is not a range list", key)
+		}
+		for _, cidr := range list {
+			if !seen[cidr] {
+				seen[cidr] = true
+				res.Add(cidr)
+			}
+		}
+	}
+	return res, nil
+}
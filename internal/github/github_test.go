@@ -0,0 +1,71 @@
+package github
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testMeta = `{
+	"verifiable_password_authentication": false,
+	"ssh_key_fingerprints": {"SHA256_RSA": "x"},
+	"hooks": ["192.30.252.0/22", "185.199.108.0/22", "2a0a:a440::/29"],
+	"web": ["192.30.252.0/22", "140.82.112.0/20"],
+	"actions": ["4.148.0.0/16"]
+}`
+
+func newServer(t *testing.T, etag string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(testMeta))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestFetchSelectedKeys(t *testing.T) {
+	ts := newServer(t, `W/"abc"`)
+
+	c := &Client{URL: ts.URL, Keys: []string{"hooks", "web"}}
+	res, err := c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 3 || len(res.IPv6) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	again, err := c.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if !again.NotModified || again.Version != res.Version {
+		t.Fatalf("expected not modified, got %+v", again)
+	}
+
+	// Another key selection must not reuse the ETag.
+	c.Keys = []string{"actions"}
+	other, err := c.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if other.NotModified || len(other.IPv4) != 1 || other.IPv4[0].String() != "4.148.0.0/16" {
+		t.Fatalf("unexpected result: %+v", other)
+	}
+}
+
+func TestFetchBadKey(t *testing.T) {
+	ts := newServer(t, `"e"`)
+
+	for _, key := range []string{"missing", "ssh_key_fingerprints"} {
+		c := &Client{URL: ts.URL, Keys: []string{key}}
+		if _, err := c.Fetch(context.Background(), ""); err == nil {
+			t.Fatalf("expected error for key %q", key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+const (
+	// CloudURL lists Google Cloud customer ranges, with a scope per prefix.
+	CloudURL = "https://www.gstatic.com/ipranges/cloud.json"
+	// GoogURL lists all of Google's ranges, without scopes.
+	GoogURL = "https://www.gstatic.com/ipranges/goog.json"
+)
+
+// Client reads one of Google's prefix documents, keeping the prefixes of
+// the given scopes. Empty Scopes keeps everything; prefixes without a
+// scope, as in goog.json, are only kept then.
+type Client struct {
+	HTTPClient *http.Client
+	URL        string
+	// Scopes are matched against "scope", e.g. us-central1 or global.
+	Scopes []string
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+type prefixList struct {
+	SyncToken string `json:"syncToken"`
+	Prefixes  []struct {
+		IPv4Prefix string `json:"ipv4Prefix"`
+		IPv6Prefix string `json:"ipv6Prefix"`
+		Scope      string `json:"scope"`
+	} `json:"prefixes"`
+}
+
+func (c *Client) Name() string {
+	return "google"
+}
+
+// Fetch downloads the document and reports it as unchanged when its
+// syncToken matches prevVersion.
+func (c *Client) Fetch(ctx context.Context, prevVersion string) (*provider.Result, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{}
+	}
+	if c.URL == "" {
+		c.URL = CloudURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	fresh := provider.FreshUntil(resp.Header, time.Now())
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, provider.NewStatusError(resp)
+	}
+
+	var doc prefixList
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	if doc.SyncToken == "" {
+		return nil, fmt.Errorf("prefix list without syncToken")
+	}
+
+	version := doc.SyncToken
+	if len(c.Scopes) > 0 {
+		version += ";" + strings.Join(c.Scopes, ",")
+	}
+	if version == prevVersion {
+		return &provider.Result{Version: version, FreshUntil: fresh, NotModified: true}, nil
+	}
+
+	res := &provider.Result{Version: version, FreshUntil: fresh}
+	matched := false
+	for _, p := range doc.Prefixes {
+		if !c.inScope(p.Scope) {
+			continue
+		}
+		matched = true
+		if p.IPv4Prefix != "" {
+			res.AddIPv4(p.IPv4Prefix)
+		}
+		if p.IPv6Prefix != "" {
+			res.AddIPv6(p.IPv6Prefix)
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("no prefixes match scopes %v", c.Scopes)
+	}
+	return res, nil
+}
+
+func (c *Client) inScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if strings.EqualFold(s, scope) {
+			return true
+		}
+	}
+	return false
+}
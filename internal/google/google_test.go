@@ -0,0 +1,71 @@
+package google
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testCloud = `{
+	"syncToken": "1700000000000",
+	"creationTime": "2026-10-17T00:00:00",
+	"prefixes": [
+		{"ipv4Prefix": "34.1.208.0/20", "service": "Google Cloud", "scope": "africa-south1"},
+		{"ipv4Prefix": "34.35.0.0/16", "service": "Google Cloud", "scope": "us-central1"},
+		{"ipv6Prefix": "2600:1900:8000::/44", "service": "Google Cloud", "scope": "us-central1"}
+	]
+}`
+
+const testGoog = `{
+	"syncToken": "1700000000001",
+	"creationTime": "2026-10-17T00:00:00",
+	"prefixes": [{"ipv4Prefix": "8.8.4.0/24"}, {"ipv6Prefix": "2001:4860::/32"}]
+}`
+
+func serve(t *testing.T, body string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestFetchCloudScopes(t *testing.T) {
+	ts := serve(t, testCloud)
+
+	c := &Client{URL: ts.URL, Scopes: []string{"us-central1"}}
+	res, err := c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 1 || res.IPv4[0].String() != "34.35.0.0/16" || len(res.IPv6) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	again, err := c.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if !again.NotModified {
+		t.Fatalf("same syncToken should be not modified")
+	}
+
+	c.Scopes = []string{"europe-west1"}
+	if _, err := c.Fetch(context.Background(), ""); err == nil {
+		t.Fatalf("expected error when no scope matches")
+	}
+}
+
+func TestFetchGoog(t *testing.T) {
+	ts := serve(t, testGoog)
+
+	c := &Client{URL: ts.URL}
+	res, err := c.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 1 || len(res.IPv6) != 1 || res.Version != "1700000000001" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
@@ -0,0 +1,132 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/provider"
+)
+
+// File reads ranges from a local file: plain text with one CIDR per line
+// and # comments, or a Cloudflare /ips shaped JSON document. The file is
+// only read again when its mtime or size changes.
+type File struct {
+	Path string
+}
+
+var _ provider.Provider = (*File)(nil)
+
+// FromURL returns the File of a file:// URL. A host other than localhost
+// is an error: file://etc/cf.txt would otherwise read /cf.txt.
+func FromURL(raw string) (*File, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" || u.Path == "" {
+		return nil, fmt.Errorf("not a file:// URL: %s", raw)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file URL %s names host %q, use file:///%s%s for a local path", raw, u.Host, u.Host, u.Path)
+	}
+	return &File{Path: u.Path}, nil
+}
+
+// IsFileURL reports whether raw should be read with FromURL.
+func IsFileURL(raw string) bool {
+	return strings.HasPrefix(raw, "file://")
+}
+
+func (f *File) Name() string {
+	return "file:" + f.Path
+}
+
+func (f *File) Fetch(ctx context.Context, prevVersion string) (*provider.Result, error) {
+	st, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	version := fmt.Sprintf("%d-%d", st.ModTime().UnixNano(), st.Size())
+	if version == prevVersion {
+		return &provider.Result{Version: version, NotModified: true}, nil
+	}
+
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	cidrs, err := parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+
+	res := &provider.Result{Version: version}
+	res.Add(cidrs...)
+	return res, nil
+}
+
+type cloudflareDoc struct {
+	Success *bool `json:"success"`
+	Result  struct {
+		IPv4Cidrs []string `json:"ipv4_cidrs"`
+		IPv6Cidrs []string `json:"ipv6_cidrs"`
+	} `json:"result"`
+}
+
+func parse(b []byte) ([]string, error) {
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		var doc cloudflareDoc
+		if err := json.Unmarshal(trimmed, &doc); err != nil {
+			return nil, fmt.Errorf("decode json: %w", err)
+		}
+		if doc.Success != nil && !*doc.Success {
+			return nil, fmt.Errorf("document has success=false")
+		}
+		return append(doc.Result.IPv4Cidrs, doc.Result.IPv6Cidrs...), nil
+	}
+
+	var cidrs []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	return cidrs, sc.Err()
+}
+
+// Static serves a fixed list of CIDRs from the configuration.
+type Static struct {
+	CIDRs []string
+}
+
+var _ provider.Provider = (*Static)(nil)
+
+func (s *Static) Name() string {
+	return "static"
+}
+
+func (s *Static) Fetch(ctx context.Context, prevVersion string) (*provider.Result, error) {
+	sum := sha256.Sum256([]byte(strings.Join(s.CIDRs, "\n")))
+	version := hex.EncodeToString(sum[:8])
+	if version == prevVersion {
+		return &provider.Result{Version: version, NotModified: true}, nil
+	}
+
+	res := &provider.Result{Version: version}
+	var err error
+	res.IPv4, res.IPv6, err = provider.ParsePrefixes(s.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,105 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	text := "# bastions\n10.1.0.0/16\n\n192.0.2.10/32 # monitor\n2001:db8::/32\n"
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := FromURL("file://" + path)
+	if err != nil {
+		t.Fatalf("FromURL error: %v", err)
+	}
+	res, err := f.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 2 || len(res.IPv6) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	again, err := f.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if !again.NotModified {
+		t.Fatalf("unchanged file should be not modified")
+	}
+
+	if err := os.WriteFile(path, []byte("10.2.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := f.Fetch(context.Background(), res.Version)
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if changed.NotModified || len(changed.IPv4) != 1 || len(changed.IPv6) != 0 {
+		t.Fatalf("modified file not re-read: %+v", changed)
+	}
+}
+
+func TestFileCloudflareJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ips.json")
+	doc := `{"success": true, "result": {"ipv4_cidrs": ["173.245.48.0/20"], "ipv6_cidrs": ["2400:cb00::/32"], "etag": "x"}}`
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := (&File{Path: path}).Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 1 || len(res.IPv6) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestFromURLRejectsOtherSchemes(t *testing.T) {
+	if _, err := FromURL("https://example.com/ips"); err == nil {
+		t.Fatalf("expected error for https URL")
+	}
+}
+
+func TestFromURLHost(t *testing.T) {
+	_, err := FromURL("file://etc/cf.txt")
+	if err == nil || !strings.Contains(err.Error(), "use file:///etc/cf.txt") {
+		t.Fatalf("expected an error pointing to file:///etc/cf.txt, got %v", err)
+	}
+	for _, raw := range []string{"file:///etc/cf.txt", "file://localhost/etc/cf.txt"} {
+		if f, err := FromURL(raw); err != nil || f.Path != "/etc/cf.txt" {
+			t.Errorf("FromURL(%q) = %+v, %v", raw, f, err)
+		}
+	}
+}
+
+func TestStatic(t *testing.T) {
+	s := &Static{CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}
+	res, err := s.Fetch(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if len(res.IPv4) != 1 || len(res.IPv6) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if again, _ := s.Fetch(context.Background(), res.Version); !again.NotModified {
+		t.Fatalf("static list should be not modified on the second fetch")
+	}
+
+	if _, err := (&Static{CIDRs: []string{"not-a-cidr"}}).Fetch(context.Background(), ""); err == nil {
+		t.Fatalf("expected error for invalid CIDR")
+	}
+}
@@ -0,0 +1,50 @@
+package provider
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FreshUntil reads how long a response may be reused from its
+// Cache-Control max-age, less its Age, or else from Expires. It returns
+// the zero time when the response gives no lifetime or forbids reuse.
+func FreshUntil(h http.Header, now time.Time) time.Time {
+	if cc := h.Get("Cache-Control"); cc != "" {
+		for _, d := range strings.Split(cc, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return time.Time{}
+			case "max-age":
+				secs, err := strconv.Atoi(strings.Trim(value, `"`))
+				if err != nil || secs <= 0 {
+					return time.Time{}
+				}
+				if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+					secs -= age
+				}
+				if secs <= 0 {
+					return time.Time{}
+				}
+				return now.Add(time.Duration(secs) * time.Second)
+			}
+		}
+	}
+	if t, err := http.ParseTime(h.Get("Expires")); err == nil && t.After(now) {
+		return t
+	}
+	return time.Time{}
+}
+
+// Earliest returns the earliest non-zero time, or zero if all are zero.
+func Earliest(ts ...time.Time) time.Time {
+	var out time.Time
+	for _, t := range ts {
+		if !t.IsZero() && (out.IsZero() || t.Before(out)) {
+			out = t
+		}
+	}
+	return out
+}
@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshUntil(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name string
+		h    http.Header
+		want time.Time
+	}{
+		{"none", http.Header{}, time.Time{}},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=600"}}, now.Add(10 * time.Minute)},
+		{"age", http.Header{"Cache-Control": {"max-age=600"}, "Age": {"100"}}, now.Add(500 * time.Second)},
+		{"aged out", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"100"}}, time.Time{}},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=600"}}, time.Time{}},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"Sat, 17 Oct 2026 13:00:00 GMT"}}, now.Add(time.Minute)},
+		{"expires", http.Header{"Expires": {"Sat, 17 Oct 2026 13:00:00 GMT"}}, now.Add(time.Hour)},
+		{"expired", http.Header{"Expires": {"Sat, 17 Oct 2026 11:00:00 GMT"}}, time.Time{}},
+		{"bad expires", http.Header{"Expires": {"0"}}, time.Time{}},
+	}
+	for _, tc := range cases {
+		if got := FreshUntil(tc.h, now); !got.Equal(tc.want) {
+			t.Errorf("%s: FreshUntil = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEarliest(t *testing.T) {
+	a := time.Unix(100, 0)
+	b := time.Unix(200, 0)
+	if got := Earliest(time.Time{}, b, a); !got.Equal(a) {
+		t.Fatalf("Earliest = %s, want %s", got, a)
+	}
+	if got := Earliest(time.Time{}); !got.IsZero() {
+		t.Fatalf("Earliest = %s, want zero", got)
+	}
+}
@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Rejected is a fetched entry that was left out of a Result.
+type Rejected struct {
+	Entry  string
+	Reason string
+}
+
+func (r Rejected) String() string {
+	return r.Entry + ": " + r.Reason
+}
+
+// Add validates entries of either family. Bare addresses are taken as
+// host prefixes and host bits are masked off; anything else that does not
+// parse is recorded in Rejected.
+func (r *Result) Add(entries ...string) {
+	for _, e := range entries {
+		if p, ok := r.parse(e); ok {
+			r.add(p)
+		}
+	}
+}
+
+// AddIPv4 is Add for a list that must only hold IPv4 prefixes.
+func (r *Result) AddIPv4(entries ...string) {
+	for _, e := range entries {
+		if p, ok := r.parse(e); ok {
+			if !p.Addr().Is4() {
+				r.reject(e, "not an IPv4 prefix")
+				continue
+			}
+			r.add(p)
+		}
+	}
+}
+
+// AddIPv6 is Add for a list that must only hold IPv6 prefixes.
+func (r *Result) AddIPv6(entries ...string) {
+	for _, e := range entries {
+		if p, ok := r.parse(e); ok {
+			if !p.Addr().Is6() {
+				r.reject(e, "not an IPv6 prefix")
+				continue
+			}
+			r.add(p)
+		}
+	}
+}
+
+func (r *Result) parse(entry string) (netip.Prefix, bool) {
+	s := strings.TrimSpace(entry)
+	var p netip.Prefix
+	var err error
+	if strings.Contains(s, "/") {
+		p, err = netip.ParsePrefix(s)
+	} else {
+		var a netip.Addr
+		a, err = netip.ParseAddr(s)
+		p = netip.PrefixFrom(a, a.BitLen())
+	}
+	switch {
+	case err != nil:
+		r.reject(entry, err.Error())
+		return netip.Prefix{}, false
+	case p.Addr().Is4In6():
+		r.reject(entry, "IPv4-mapped IPv6 prefix")
+		return netip.Prefix{}, false
+	}
+	return p.Masked(), true
+}
+
+func (r *Result) add(p netip.Prefix) {
+	if p.Addr().Is4() {
+		r.IPv4 = append(r.IPv4, p)
+	} else {
+		r.IPv6 = append(r.IPv6, p)
+	}
+}
+
+func (r *Result) reject(entry, reason string) {
+	r.Rejected = append(r.Rejected, Rejected{Entry: entry, Reason: reason})
+}
+
+// Normalize sorts and dedupes prefixes of one family. With aggregate it
+// also drops prefixes covered by others and merges adjacent ones, giving
+// the smallest list that covers the same addresses.
+func Normalize(ps []netip.Prefix, aggregate bool) []netip.Prefix {
+	sorted := append([]netip.Prefix(nil), ps...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := sorted[i].Addr().Compare(sorted[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return sorted[i].Bits() < sorted[j].Bits()
+	})
+
+	var out []netip.Prefix
+	for _, p := range sorted {
+		if n := len(out); n > 0 {
+			last := out[n-1]
+			if last == p || aggregate && last.Bits() <= p.Bits() && last.Contains(p.Addr()) {
+				continue
+			}
+		}
+		out = append(out, p)
+		for aggregate && len(out) >= 2 {
+			a, b := out[len(out)-2], out[len(out)-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				break
+			}
+			out = append(out[:len(out)-2], parent)
+		}
+	}
+	return out
+}
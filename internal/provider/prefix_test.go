@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestResultAdd(t *testing.T) {
+	var r Result
+	r.Add("10.0.0.1/8", "192.0.2.7", " 2001:db8::1/32 ", "::ffff:10.0.0.0/104", "bogus", "300.0.0.0/8")
+	if got := Strings(r.IPv4); !reflect.DeepEqual(got, []string{"10.0.0.0/8", "192.0.2.7/32"}) {
+		t.Fatalf("IPv4 = %v", got)
+	}
+	if got := Strings(r.IPv6); !reflect.DeepEqual(got, []string{"2001:db8::/32"}) {
+		t.Fatalf("IPv6 = %v", got)
+	}
+	if len(r.Rejected) != 3 {
+		t.Fatalf("Rejected = %v, want 3 entries", r.Rejected)
+	}
+	if r.Rejected[0].Entry != "::ffff:10.0.0.0/104" {
+		t.Fatalf("unexpected first rejection: %v", r.Rejected[0])
+	}
+}
+
+func TestResultAddFamily(t *testing.T) {
+	var r Result
+	r.AddIPv4("198.51.100.0/24", "2001:db8::/32")
+	r.AddIPv6("2001:db8::/48", "203.0.113.0/24")
+	if len(r.IPv4) != 1 || len(r.IPv6) != 1 {
+		t.Fatalf("unexpected result: %+v", r)
+	}
+	want := []Rejected{
+		{Entry: "2001:db8::/32", Reason: "not an IPv4 prefix"},
+		{Entry: "203.0.113.0/24", Reason: "not an IPv6 prefix"},
+	}
+	if !reflect.DeepEqual(r.Rejected, want) {
+		t.Fatalf("Rejected = %v, want %v", r.Rejected, want)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	in := mustPrefixes(t,
+		"10.0.1.0/24", "10.0.0.0/24", "10.0.0.0/24",
+		"192.0.2.0/25", "192.0.2.128/25",
+		"198.51.100.0/24", "198.51.100.64/26",
+		"10.0.3.0/24",
+	)
+
+	if got := Strings(Normalize(in, false)); !reflect.DeepEqual(got, []string{
+		"10.0.0.0/24", "10.0.1.0/24", "10.0.3.0/24",
+		"192.0.2.0/25", "192.0.2.128/25",
+		"198.51.100.0/24", "198.51.100.64/26",
+	}) {
+		t.Fatalf("Normalize(false) = %v", got)
+	}
+
+	if got := Strings(Normalize(in, true)); !reflect.DeepEqual(got, []string{
+		"10.0.0.0/23", "10.0.3.0/24", "192.0.2.0/24", "198.51.100.0/24",
+	}) {
+		t.Fatalf("Normalize(true) = %v", got)
+	}
+}
+
+func TestNormalizeCascades(t *testing.T) {
+	in := mustPrefixes(t, "10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/25", "10.0.1.0/24")
+	if got := Strings(Normalize(in, true)); !reflect.DeepEqual(got, []string{"10.0.0.0/23"}) {
+		t.Fatalf("Normalize = %v", got)
+	}
+
+	// Siblings that do not share a parent stay apart.
+	in = mustPrefixes(t, "10.0.1.0/24", "10.0.2.0/24")
+	if got := Normalize(in, true); len(got) != 2 {
+		t.Fatalf("Normalize = %v", got)
+	}
+}
+
+func mustPrefixes(t *testing.T, cidrs ...string) []netip.Prefix {
+	t.Helper()
+	ipv4, ipv6, err := ParsePrefixes(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(ipv4, ipv6...)
+}
@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Provider fetches the published IP ranges of one service.
+type Provider interface {
+	// Name identifies the provider in logs.
+	Name() string
+	// Fetch returns the current ranges, or a result with NotModified set
+	// when they are unchanged since prevVersion.
+	Fetch(ctx context.Context, prevVersion string) (*Result, error)
+}
+
+type Result struct {
+	IPv4 []netip.Prefix
+	IPv6 []netip.Prefix
+	// Rejected lists the entries that failed validation.
+	Rejected []Rejected
+	// Version identifies the fetched list, like an HTTP ETag.
+	Version     string
+	NotModified bool
+	// Source tells which of several sources of a provider answered.
+	Source string
+	// FreshUntil is when the list may next change according to the caching
+	// headers of the response; zero if they did not say.
+	FreshUntil time.Time
+}
+
+// Target is the set pair a provider feeds.
+type Target struct {
+	IPv4Set string
+	IPv6Set string
+}
+
+// ParsePrefixes parses CIDRs and splits them by family, failing on the
+// first invalid one. It is meant for configuration; fetched lists go
+// through Result.Add and friends instead.
+func ParsePrefixes(cidrs []string) (ipv4, ipv6 []netip.Prefix, err error) {
+	for _, s := range cidrs {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid prefix %q: %w", s, err)
+		}
+		if p.Addr().Is4() {
+			ipv4 = append(ipv4, p)
+		} else {
+			ipv6 = append(ipv6, p)
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+func Strings(ps []netip.Prefix) []string {
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = p.String()
+	}
+	return out
+}
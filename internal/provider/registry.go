@@ -0,0 +1,222 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+type entry struct {
+	target Target
+	p      Provider
+	// applied is the last result whose ranges made it into the sets.
+	applied *Result
+	// notBefore is when the server said the provider may be asked again.
+	notBefore time.Time
+}
+
+var now = time.Now
+
+// Registry fetches a group of providers once per cycle and merges their
+// ranges per target. A provider's version only advances once the update
+// of its target is committed, so a failed update is fetched in full again.
+type Registry struct {
+	entries []*entry
+	targets []Target
+	// invalidated makes the next Fetch ignore committed versions.
+	invalidated bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Add makes p feed target.
+func (r *Registry) Add(target Target, p Provider) {
+	r.entries = append(r.entries, &entry{target: target, p: p})
+	for _, t := range r.targets {
+		if t == target {
+			return
+		}
+	}
+	r.targets = append(r.targets, target)
+}
+
+// Targets returns the targets in the order they were first added.
+func (r *Registry) Targets() []Target {
+	return r.targets
+}
+
+// Fetched is one provider's answer in a cycle.
+type Fetched struct {
+	Provider string
+	Target   Target
+	Result   *Result
+	Err      error
+}
+
+// Update is the merged content of one target.
+type Update struct {
+	Target Target
+	// Providers names the providers feeding the target.
+	Providers []string
+	IPv4      []netip.Prefix
+	IPv6      []netip.Prefix
+	// PrevIPv4 and PrevIPv6 are the ranges committed last, empty before the
+	// first commit.
+	PrevIPv4 []netip.Prefix
+	PrevIPv6 []netip.Prefix
+	// Changed is set when any provider of the target returned new ranges.
+	Changed bool
+	// Err is set when a provider that never delivered ranges failed. The
+	// target must not be updated then, as its content would be incomplete.
+	Err error
+
+	fresh map[*entry]*Result
+}
+
+type Cycle struct {
+	Fetched []Fetched
+	Updates []*Update
+}
+
+// Fetch asks every provider for its ranges. A provider that fails keeps
+// contributing the ranges it delivered last. One whose server answered with
+// Retry-After is not asked again before then and counts as failed.
+func (r *Registry) Fetch(ctx context.Context) *Cycle {
+	c := &Cycle{}
+	updates := make(map[Target]*Update, len(r.targets))
+	for _, t := range r.targets {
+		u := &Update{Target: t, fresh: map[*entry]*Result{}}
+		updates[t] = u
+		c.Updates = append(c.Updates, u)
+	}
+
+	for _, e := range r.entries {
+		u := updates[e.target]
+		u.Providers = append(u.Providers, e.p.Name())
+		prev := ""
+		if e.applied != nil && !r.invalidated {
+			prev = e.applied.Version
+		}
+		var res *Result
+		var err error
+		if t := now(); t.Before(e.notBefore) {
+			// Only this provider waits; the others are asked as usual.
+			err = fmt.Errorf("server asked not to retry before %s", e.notBefore.Format(time.RFC3339))
+		} else {
+			res, err = e.p.Fetch(ctx, prev)
+			if d := RetryAfter(err); d > 0 {
+				e.notBefore = t.Add(d)
+			}
+		}
+		if err == nil && res.NotModified && e.applied == nil {
+			err = fmt.Errorf("not modified without an earlier result")
+		}
+		c.Fetched = append(c.Fetched, Fetched{Provider: e.p.Name(), Target: e.target, Result: res, Err: err})
+
+		if e.applied != nil {
+			u.PrevIPv4 = append(u.PrevIPv4, e.applied.IPv4...)
+			u.PrevIPv6 = append(u.PrevIPv6, e.applied.IPv6...)
+		}
+		use := e.applied
+		switch {
+		case err != nil:
+			if e.applied == nil && u.Err == nil {
+				u.Err = fmt.Errorf("%s: %w", e.p.Name(), err)
+			}
+		case !res.NotModified:
+			use = res
+			u.Changed = true
+			u.fresh[e] = res
+		}
+		if use != nil {
+			u.IPv4 = append(u.IPv4, use.IPv4...)
+			u.IPv6 = append(u.IPv6, use.IPv6...)
+		}
+	}
+	r.invalidated = false
+	return c
+}
+
+// Invalidate makes the next Fetch ask every provider for its full list, as
+// if nothing had been committed. Committed ranges still count as the
+// previous content of their targets.
+func (r *Registry) Invalidate() {
+	r.invalidated = true
+}
+
+// Commit records that the ranges of u are in the sets.
+func (r *Registry) Commit(u *Update) {
+	for e, res := range u.fresh {
+		e.applied = res
+	}
+	u.fresh = nil
+}
+
+// Version summarises the committed versions, e.g. for logs.
+func (r *Registry) Version() string {
+	var parts []string
+	for _, e := range r.entries {
+		if e.applied != nil {
+			parts = append(parts, e.p.Name()+"="+e.applied.Version)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// State is the committed result of one provider, kept across restarts.
+type State struct {
+	Provider string   `json:"provider"`
+	Target   Target   `json:"target"`
+	Version  string   `json:"version"`
+	IPv4     []string `json:"ipv4"`
+	IPv6     []string `json:"ipv6"`
+}
+
+// States returns the committed result of every provider that has one.
+func (r *Registry) States() []State {
+	var out []State
+	for _, e := range r.entries {
+		if e.applied != nil {
+			out = append(out, State{
+				Provider: e.p.Name(),
+				Target:   e.target,
+				Version:  e.applied.Version,
+				IPv4:     Strings(e.applied.IPv4),
+				IPv6:     Strings(e.applied.IPv6),
+			})
+		}
+	}
+	return out
+}
+
+// Restore marks saved results as committed, so that providers are asked
+// with their saved versions. Unless every state matches a provider of its
+// target, nothing is restored.
+func (r *Registry) Restore(states []State) error {
+	restored := map[*entry]*Result{}
+	for _, s := range states {
+		var match *entry
+		for _, e := range r.entries {
+			if e.target == s.Target && e.p.Name() == s.Provider && restored[e] == nil {
+				match = e
+				break
+			}
+		}
+		if match == nil {
+			return fmt.Errorf("no provider %s for sets %s/%s", s.Provider, s.Target.IPv4Set, s.Target.IPv6Set)
+		}
+		ipv4, ipv6, err := ParsePrefixes(append(append([]string(nil), s.IPv4...), s.IPv6...))
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.Provider, err)
+		}
+		restored[match] = &Result{IPv4: ipv4, IPv6: ipv6, Version: s.Version}
+	}
+	for e, res := range restored {
+		e.applied = res
+	}
+	return nil
+}
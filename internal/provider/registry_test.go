@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fakeProvider struct {
+	name  string
+	res   *Result
+	err   error
+	prevs []string
+}
+
+func (f *fakeProvider) Name() string { return f.name }
+
+func (f *fakeProvider) Fetch(ctx context.Context, prevVersion string) (*Result, error) {
+	f.prevs = append(f.prevs, prevVersion)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.res.Version == prevVersion {
+		return &Result{Version: prevVersion, NotModified: true}, nil
+	}
+	return f.res, nil
+}
+
+func result(version string, cidrs ...string) *Result {
+	v4, v6, err := ParsePrefixes(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return &Result{IPv4: v4, IPv6: v6, Version: version}
+}
+
+func TestRegistryMergesTarget(t *testing.T) {
+	target := Target{IPv4Set: "v4", IPv6Set: "v6"}
+	a := &fakeProvider{name: "a", res: result("1", "1.1.1.0/24", "2606:4700::/32")}
+	b := &fakeProvider{name: "b", res: result("x", "10.0.0.0/8")}
+	reg := NewRegistry()
+	reg.Add(target, a)
+	reg.Add(target, b)
+
+	c := reg.Fetch(context.Background())
+	if len(c.Updates) != 1 || len(c.Fetched) != 2 {
+		t.Fatalf("unexpected cycle: %+v", c)
+	}
+	u := c.Updates[0]
+	if !u.Changed || u.Err != nil || len(u.IPv4) != 2 || len(u.IPv6) != 1 {
+		t.Fatalf("unexpected update: %+v", u)
+	}
+	reg.Commit(u)
+	if got := reg.Version(); got != "a=1,b=x" {
+		t.Fatalf("unexpected version: %s", got)
+	}
+
+	// Only b changes; a's ranges are carried over.
+	b.res = result("y", "10.0.0.0/8", "192.168.0.0/16")
+	u = reg.Fetch(context.Background()).Updates[0]
+	if !u.Changed || len(u.IPv4) != 3 {
+		t.Fatalf("unexpected update: %+v", u)
+	}
+	if len(u.PrevIPv4) != 2 || len(u.PrevIPv6) != 1 {
+		t.Fatalf("update should carry the committed ranges: %+v", u)
+	}
+	if a.prevs[1] != "1" || b.prevs[1] != "x" {
+		t.Fatalf("providers should see committed versions: %v %v", a.prevs, b.prevs)
+	}
+
+	// Not committed, so b is asked with its old version again.
+	reg.Fetch(context.Background())
+	if b.prevs[2] != "x" {
+		t.Fatalf("version advanced without commit: %v", b.prevs)
+	}
+}
+
+func TestRegistryFailedProvider(t *testing.T) {
+	target := Target{IPv4Set: "v4", IPv6Set: "v6"}
+	a := &fakeProvider{name: "a", res: result("1", "1.1.1.0/24")}
+	reg := NewRegistry()
+	reg.Add(target, a)
+
+	a.err = errors.New("down")
+	u := reg.Fetch(context.Background()).Updates[0]
+	if u.Err == nil {
+		t.Fatalf("target without earlier ranges should fail")
+	}
+
+	a.err = nil
+	reg.Commit(reg.Fetch(context.Background()).Updates[0])
+
+	a.err = errors.New("down")
+	c := reg.Fetch(context.Background())
+	u = c.Updates[0]
+	if u.Err != nil || u.Changed || len(u.IPv4) != 1 || u.IPv4[0] != netip.MustParsePrefix("1.1.1.0/24") {
+		t.Fatalf("failed provider should keep its applied ranges: %+v", u)
+	}
+	if c.Fetched[0].Err == nil {
+		t.Fatalf("fetch error should be reported")
+	}
+}
+
+func TestRegistryRestore(t *testing.T) {
+	target := Target{IPv4Set: "v4", IPv6Set: "v6"}
+	a := &fakeProvider{name: "a", res: result("1", "1.1.1.0/24", "2606:4700::/32")}
+	reg := NewRegistry()
+	reg.Add(target, a)
+	reg.Commit(reg.Fetch(context.Background()).Updates[0])
+	states := reg.States()
+	if len(states) != 1 || states[0].Version != "1" || len(states[0].IPv6) != 1 {
+		t.Fatalf("unexpected states: %+v", states)
+	}
+
+	fresh := &fakeProvider{name: "a", res: a.res}
+	reg = NewRegistry()
+	reg.Add(target, fresh)
+	if err := reg.Restore(states); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	u := reg.Fetch(context.Background()).Updates[0]
+	if u.Changed || len(u.IPv4) != 1 || fresh.prevs[0] != "1" {
+		t.Fatalf("restored registry should see unchanged data: %+v %v", u, fresh.prevs)
+	}
+
+	other := NewRegistry()
+	other.Add(target, &fakeProvider{name: "b", res: a.res})
+	if err := other.Restore(states); err == nil {
+		t.Fatalf("expected error for a provider that is gone")
+	}
+	if len(other.States()) != 0 {
+		t.Fatalf("failed restore should leave the registry untouched")
+	}
+}
+
+func TestRegistryInvalidate(t *testing.T) {
+	target := Target{IPv4Set: "v4", IPv6Set: "v6"}
+	a := &fakeProvider{name: "a", res: result("1", "1.1.1.0/24")}
+	reg := NewRegistry()
+	reg.Add(target, a)
+	reg.Commit(reg.Fetch(context.Background()).Updates[0])
+
+	reg.Invalidate()
+	u := reg.Fetch(context.Background()).Updates[0]
+	if !u.Changed || a.prevs[1] != "" || len(u.PrevIPv4) != 1 {
+		t.Fatalf("invalidated fetch should ignore versions: %+v %v", u, a.prevs)
+	}
+	if reg.Fetch(context.Background()); a.prevs[2] != "1" {
+		t.Fatalf("invalidation should only apply once: %v", a.prevs)
+	}
+}
+
+// A Retry-After holds back only the provider that sent it, until it passes.
+func TestRegistryRetryAfterPerProvider(t *testing.T) {
+	clock := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return clock }
+	defer func() { now = orig }()
+
+	a := &fakeProvider{name: "a", err: &StatusError{Status: "429", RetryAfter: time.Minute}}
+	b := &fakeProvider{name: "b", res: result("1", "10.0.0.0/8")}
+	reg := NewRegistry()
+	reg.Add(Target{IPv4Set: "a4", IPv6Set: "a6"}, a)
+	reg.Add(Target{IPv4Set: "b4", IPv6Set: "b6"}, b)
+
+	reg.Fetch(context.Background())
+	c := reg.Fetch(context.Background())
+	if len(a.prevs) != 1 || len(b.prevs) != 2 {
+		t.Fatalf("a asked %d times, b %d, want 1 and 2", len(a.prevs), len(b.prevs))
+	}
+	if c.Fetched[0].Err == nil || c.Fetched[1].Err != nil {
+		t.Fatalf("unexpected fetch errors: %+v", c.Fetched)
+	}
+
+	clock = clock.Add(time.Minute)
+	a.err, a.res = nil, result("1", "1.1.1.0/24")
+	if c := reg.Fetch(context.Background()); len(a.prevs) != 2 || c.Fetched[0].Err != nil {
+		t.Fatalf("a not asked after its Retry-After passed: %+v", c.Fetched)
+	}
+}
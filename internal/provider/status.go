@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusError is an HTTP answer other than the ones a provider handles.
+type StatusError struct {
+	Status string
+	// RetryAfter is set when a 429 or 503 answer said when to come back.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("unexpected status: %s, retry after %s", e.Status, e.RetryAfter)
+	}
+	return "unexpected status: " + e.Status
+}
+
+// NewStatusError describes an unexpected response.
+func NewStatusError(resp *http.Response) error {
+	e := &StatusError{Status: resp.Status}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		e.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return e
+}
+
+// maxRetryAfter bounds how long a server can keep a provider from being
+// asked again.
+const maxRetryAfter = 24 * time.Hour
+
+// parseRetryAfter reads either form of the header: delay seconds or an
+// HTTP date. The result is capped at maxRetryAfter.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if errors.Is(err, strconv.ErrRange) && secs > 0 {
+		return maxRetryAfter
+	}
+	if err == nil {
+		if secs < 0 {
+			return 0
+		}
+		// Clamped before converting, as huge values overflow a Duration.
+		return time.Duration(min(secs, int64(maxRetryAfter/time.Second))) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return min(t.Sub(now), maxRetryAfter)
+	}
+	return 0
+}
+
+// RetryAfter returns the longest RetryAfter of the StatusErrors in err,
+// which may be joined from several sources of one provider.
+func RetryAfter(err error) time.Duration {
+	var longest time.Duration
+	var walk func(error)
+	walk = func(err error) {
+		var se *StatusError
+		switch x := err.(type) {
+		case nil:
+		case interface{ Unwrap() []error }:
+			for _, e := range x.Unwrap() {
+				walk(e)
+			}
+		default:
+			if errors.As(err, &se) && se.RetryAfter > longest {
+				longest = se.RetryAfter
+			}
+		}
+	}
+	walk(err)
+	return longest
+}
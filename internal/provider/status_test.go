@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewStatusError(t *testing.T) {
+	resp := &http.Response{
+		Status:     "429 Too Many Requests",
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": {"120"}},
+	}
+	err := NewStatusError(resp)
+	if got := RetryAfter(err); got != 2*time.Minute {
+		t.Fatalf("RetryAfter = %s, want 2m", got)
+	}
+
+	resp = &http.Response{Status: "500 Internal Server Error", StatusCode: 500, Header: http.Header{"Retry-After": {"120"}}}
+	if got := RetryAfter(NewStatusError(resp)); got != 0 {
+		t.Fatalf("Retry-After only counts on 429 and 503, got %s", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"":                              0,
+		"30":                            30 * time.Second,
+		"-5":                            0,
+		"99999999":                      24 * time.Hour,
+		"99999999999999999999":          24 * time.Hour,
+		"Fri, 17 Oct 2036 12:00:00 GMT": 24 * time.Hour,
+		"soon":                          0,
+		"Sat, 17 Oct 2026 12:01:30 GMT": 90 * time.Second,
+		"Sat, 17 Oct 2026 11:00:00 GMT": 0,
+	}
+	for in, want := range cases {
+		if got := parseRetryAfter(in, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestRetryAfterJoined(t *testing.T) {
+	short := &StatusError{Status: "503", RetryAfter: time.Second}
+	long := &StatusError{Status: "429", RetryAfter: time.Minute}
+	err := errors.Join(
+		fmt.Errorf("a: %w", short),
+		errors.New("unrelated"),
+		fmt.Errorf("b: %w", long),
+	)
+	if got := RetryAfter(err); got != time.Minute {
+		t.Fatalf("RetryAfter = %s, want the longest", got)
+	}
+	if got := RetryAfter(errors.New("plain")); got != 0 {
+		t.Fatalf("RetryAfter = %s, want 0", got)
+	}
+}
@@ -0,0 +1,105 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Ringyuki/cf-ip-guard/internal/atomicfile"
+)
+
+//go:generate sh -c "{ echo '# Cloudflare IP ranges, refreshed with go generate.'; echo \"# taken $(date -u +%F)\"; curl -fsS https://www.cloudflare.com/ips-v4; echo; curl -fsS https://www.cloudflare.com/ips-v6; echo; } | grep -v '^$' > cloudflare.txt"
+
+//go:embed cloudflare.txt
+var embedded []byte
+
+// SourceEmbedded is the Source of the snapshot built into the binary.
+const SourceEmbedded = "embedded"
+
+// Snapshot is a last known good copy of the main sets, applied when the
+// daemon starts without a working fetch.
+type Snapshot struct {
+	IPv4  []string  `json:"ipv4"`
+	IPv6  []string  `json:"ipv6"`
+	Taken time.Time `json:"taken"`
+	// Source is SourceEmbedded or the file the snapshot was read from.
+	Source string `json:"-"`
+}
+
+// Embedded returns the Cloudflare ranges the binary was built with.
+func Embedded() (*Snapshot, error) {
+	s := &Snapshot{Source: SourceEmbedded}
+	sc := bufio.NewScanner(bytes.NewReader(embedded))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if taken, ok := strings.CutPrefix(line, "# taken "); ok {
+			t, err := time.Parse(time.DateOnly, taken)
+			if err != nil {
+				return nil, fmt.Errorf("embedded snapshot: %w", err)
+			}
+			s.Taken = t
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := netip.ParsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("embedded snapshot: %w", err)
+		}
+		if p.Addr().Is4() {
+			s.IPv4 = append(s.IPv4, line)
+		} else {
+			s.IPv6 = append(s.IPv6, line)
+		}
+	}
+	return s, sc.Err()
+}
+
+// Load reads a snapshot written by Save. A missing file is not an error;
+// the snapshot is nil then.
+func Load(path string) (*Snapshot, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s.Source = path
+	return &s, nil
+}
+
+func Save(path string, s *Snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b)
+}
+
+// Newest returns the most recently taken of the given snapshots, skipping
+// nil and empty ones.
+func Newest(snaps ...*Snapshot) *Snapshot {
+	var best *Snapshot
+	for _, s := range snaps {
+		if s == nil || len(s.IPv4)+len(s.IPv6) == 0 {
+			continue
+		}
+		if best == nil || s.Taken.After(best.Taken) {
+			best = s
+		}
+	}
+	return best
+}
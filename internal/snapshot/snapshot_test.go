@@ -0,0 +1,50 @@
+package snapshot
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEmbedded(t *testing.T) {
+	s, err := Embedded()
+	if err != nil {
+		t.Fatalf("Embedded error: %v", err)
+	}
+	if len(s.IPv4) == 0 || len(s.IPv6) == 0 || s.Taken.IsZero() || s.Source != SourceEmbedded {
+		t.Fatalf("unexpected embedded snapshot: %+v", s)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "snapshot.json")
+	if s, err := Load(path); s != nil || err != nil {
+		t.Fatalf("missing file should load as nil: %+v, %v", s, err)
+	}
+
+	want := &Snapshot{IPv4: []string{"192.0.2.0/24"}, IPv6: []string{"2001:db8::/32"}, Taken: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if err := Save(path, want); err != nil {
+		t.Fatalf("Save error: %v", err)
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if !reflect.DeepEqual(got.IPv4, want.IPv4) || !reflect.DeepEqual(got.IPv6, want.IPv6) || !got.Taken.Equal(want.Taken) || got.Source != path {
+		t.Fatalf("Load = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewest(t *testing.T) {
+	old := &Snapshot{IPv4: []string{"192.0.2.0/24"}, Taken: time.Unix(100, 0)}
+	recent := &Snapshot{IPv4: []string{"198.51.100.0/24"}, Taken: time.Unix(200, 0)}
+	empty := &Snapshot{Taken: time.Unix(300, 0)}
+
+	if got := Newest(old, nil, recent, empty); got != recent {
+		t.Fatalf("Newest = %+v, want the recent snapshot", got)
+	}
+	if got := Newest(nil, empty); got != nil {
+		t.Fatalf("Newest = %+v, want nil", got)
+	}
+}